@@ -0,0 +1,411 @@
+package bayou
+
+import (
+    "errors"
+    "fmt"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Prefix of the names of tables Bayou keeps in a database *
+ * besides the application's (which are not snapshotted)   */
+const INTERNAL_TABLE_PREFIX string = "bayou_"
+
+/* Names of the tables recording a database's applied index: *
+ * its CSN, and the writes applied after it (one per row,    *
+ * with the undo captured when the write was applied)        */
+const APPLIED_TABLE string = INTERNAL_TABLE_PREFIX + "applied"
+const APPLIED_WRITES_TABLE string = INTERNAL_TABLE_PREFIX + "applied_writes"
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Position in the log up to which a database reflects writes. It  *
+ * is saved in the database, in the same transaction as each write, *
+ * so a restarted server resumes replaying writes from it           */
+type AppliedIndex struct {
+    // CSN of the last commit applied (UNCOMMITTED_CSN if none)
+    CSN    int
+    // IDs of the writes applied after it, in order
+    // (tentative writes, for the full view)
+    Writes []int
+}
+
+/*****************************
+ *   APPLIED INDEX METHODS   *
+ *****************************/
+
+/* Returns the index after applying the provided write: commits *
+ * applied before any other write advance the CSN, and all       *
+ * other writes are appended to the applied writes               */
+func (applied AppliedIndex) apply(entry LogEntry) AppliedIndex {
+    if entry.CSN != UNCOMMITTED_CSN && len(applied.Writes) == 0 {
+        return AppliedIndex{entry.CSN, nil}
+    }
+    writes := make([]int, len(applied.Writes), len(applied.Writes) + 1)
+    copy(writes, applied.Writes)
+    return AppliedIndex{applied.CSN, append(writes, entry.WriteID)}
+}
+
+/* Returns the index after undoing the provided number of writes */
+func (applied AppliedIndex) undo(numUndone int) AppliedIndex {
+    numWrites := len(applied.Writes) - numUndone
+    if numWrites < 0 {
+        numWrites = 0
+    }
+    return AppliedIndex{applied.CSN, applied.Writes[:numWrites]}
+}
+
+/* Returns the index after the provided writes, which were applied *
+ * first (in order) after the index's CSN, were committed. Returns *
+ * false if they were not, in which case the index is unchanged    */
+func (applied AppliedIndex) commit(commits []LogEntry) (AppliedIndex,
+        bool) {
+    if applied.numApplied(commits) != len(commits) {
+        return applied, false
+    }
+    if len(commits) == 0 {
+        return applied, true
+    }
+    return AppliedIndex{commits[len(commits) - 1].CSN,
+            applied.Writes[len(commits):]}, true
+}
+
+/* Returns the number of the provided writes applied (in order) *
+ * after the index's CSN, or -1 if the index applied any other  *
+ * writes after it                                              */
+func (applied AppliedIndex) numApplied(log []LogEntry) int {
+    if len(applied.Writes) > len(log) {
+        return -1
+    }
+    for idx, writeID := range applied.Writes {
+        if log[idx].WriteID != writeID {
+            return -1
+        }
+    }
+    return len(applied.Writes)
+}
+
+/**************************************
+ *   DATABASE APPLIED INDEX METHODS   *
+ **************************************/
+
+/* Creates the tables recording the applied index, if needed */
+func (db *BayouDB) createAppliedTables() error {
+    _, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS ` + APPLIED_TABLE + `(
+        ID INTEGER PRIMARY KEY CHECK (ID == 0),
+        CSN INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS ` + APPLIED_WRITES_TABLE + `(
+        Seq INTEGER PRIMARY KEY,
+        WriteID INTEGER NOT NULL,
+        Undo TEXT
+    );
+    `)
+    return err
+}
+
+/* Loads the applied index saved in the database, returning *
+ * whether there was one (there is none until the database  *
+ * is first cleared or restored, e.g. when it was created)  */
+func (db *BayouDB) loadApplied() (bool, error) {
+    db.applied = AppliedIndex{UNCOMMITTED_CSN, nil}
+    result, err := db.Read(`SELECT CSN FROM ` + APPLIED_TABLE)
+    if err != nil || len(result) == 0 {
+        return false, err
+    }
+    applied := AppliedIndex{int(result[0]["CSN"].(int64)), nil}
+
+    result, err = db.Read(`SELECT WriteID FROM ` + APPLIED_WRITES_TABLE +
+            ` ORDER BY Seq`)
+    if err != nil {
+        return false, err
+    }
+    for _, row := range result {
+        applied.Writes = append(applied.Writes, int(row["WriteID"].(int64)))
+    }
+    db.applied = applied
+    return true, nil
+}
+
+/* Saves the provided applied index (outside of any write) */
+func (db *BayouDB) saveApplied(applied AppliedIndex) error {
+    err := saveApplied(db, db.applied, applied)
+    if err == nil {
+        db.applied = applied
+    }
+    return err
+}
+
+/* Saves the provided applied index, which the first of the saved  *
+ * index's writes were committed into, keeping what was saved for  *
+ * the writes after them                                           */
+func (db *BayouDB) saveCommitted(applied AppliedIndex) error {
+    tx, err := db.BeginTx()
+    if err != nil {
+        return err
+    }
+    err = tx.Execute(`
+        UPDATE ` + APPLIED_TABLE + ` SET CSN = ?;
+        DELETE FROM ` + APPLIED_WRITES_TABLE + ` WHERE Seq IN (
+            SELECT Seq FROM ` + APPLIED_WRITES_TABLE + ` ORDER BY Seq LIMIT ?
+        );
+    `, applied.CSN, len(db.applied.Writes) - len(applied.Writes))
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return queryError(err, "Error recording commits: ")
+    }
+    db.applied = applied
+    return nil
+}
+
+/* Drops all of the database's tables, and recreates the provided *
+ * schema's tables (at its first version), so that all writes can  *
+ * be applied again from scratch                                   */
+func (db *BayouDB) Clear(schema Schema) error {
+    tx, err := db.BeginTx()
+    if err != nil {
+        return err
+    }
+    err = tx.dropTables()
+    if err == nil {
+        err = tx.createTables(schema)
+    }
+    if err == nil {
+        err = tx.resetApplied(AppliedIndex{UNCOMMITTED_CSN, nil})
+    }
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return queryError(err, "Error clearing database: ")
+    }
+    db.applied = AppliedIndex{UNCOMMITTED_CSN, nil}
+    return nil
+}
+
+/*****************************************
+ *   TRANSACTION APPLIED INDEX METHODS   *
+ *****************************************/
+
+/* Saves the provided applied index within the transaction, *
+ * replacing the provided one, which is currently saved     */
+func (tx *BayouTx) saveApplied(saved AppliedIndex,
+        applied AppliedIndex) error {
+    return saveApplied(tx, saved, applied)
+}
+
+/* Replaces whatever applied index is saved in the *
+ * database with the provided one, within the      *
+ * transaction (so the database has an index)      */
+func (tx *BayouTx) resetApplied(applied AppliedIndex) error {
+    err := tx.Execute(`
+        DELETE FROM ` + APPLIED_TABLE + `;
+        DELETE FROM ` + APPLIED_WRITES_TABLE + `;
+        INSERT INTO ` + APPLIED_TABLE + `(ID, CSN) VALUES(0, ?);
+    `, applied.CSN)
+    if err != nil {
+        return err
+    }
+    return tx.saveApplied(AppliedIndex{applied.CSN, nil}, applied)
+}
+
+/* Drops all of the database's tables and views, besides Bayou's *
+ * own (which also drops the tables' indexes and triggers)        */
+func (tx *BayouTx) dropTables() error {
+    result, err := tx.Read(`
+        SELECT name FROM sqlite_master WHERE type == "view"
+    `)
+    if err != nil {
+        return err
+    }
+    for _, row := range result {
+        err = tx.Execute(fmt.Sprintf(`DROP VIEW "%s"`, row["name"]))
+        if err != nil {
+            return err
+        }
+    }
+
+    names, err := tx.tableNames()
+    if err != nil {
+        return err
+    }
+    for _, name := range names {
+        err = tx.Execute(`DROP TABLE "` + name + `"`)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Saves the provided applied index on the database or transaction, *
+ * replacing the saved one. Only what changed is saved (i.e. a       *
+ * single row, when a write is applied or undone), since this is     *
+ * part of every write                                               */
+func saveApplied(executor sqlExecutor, saved AppliedIndex,
+        applied AppliedIndex) error {
+    var err error
+    if applied.CSN != saved.CSN {
+        err = execute(executor, `UPDATE ` + APPLIED_TABLE + ` SET CSN = ?`,
+                []interface{}{applied.CSN})
+        if err != nil {
+            return err
+        }
+    }
+
+    numKept := 0
+    for numKept < len(saved.Writes) && numKept < len(applied.Writes) &&
+            saved.Writes[numKept] == applied.Writes[numKept] {
+        numKept++
+    }
+    if numKept < len(saved.Writes) {
+        err = execute(executor, `
+            DELETE FROM ` + APPLIED_WRITES_TABLE + ` WHERE Seq >= (
+                SELECT Seq FROM ` + APPLIED_WRITES_TABLE + `
+                ORDER BY Seq LIMIT 1 OFFSET ?
+            )
+        `, []interface{}{numKept})
+        if err != nil {
+            return err
+        }
+    }
+    for _, writeID := range applied.Writes[numKept:] {
+        err = execute(executor, `INSERT INTO ` + APPLIED_WRITES_TABLE +
+                `(WriteID) VALUES(?)`, []interface{}{writeID})
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/*****************************
+ *   SERVER REPLAY METHODS   *
+ *****************************/
+
+/* Brings both views up to date with the logs when the server starts, *
+ * through the same (transactional) path as when writes are applied    *
+ * Each view resumes from its applied index, and is rebuilt if it has  *
+ * none, or it does not match the logs. Returns an error if a view     *
+ * cannot be loaded or rebuilt                                         */
+func (server *BayouServer) replayLogs() error {
+    // Commits the commit view already reflects are skipped when applied
+    found, err := server.commitDB.loadApplied()
+    if err != nil {
+        return queryError(err, "Error loading commit view: ")
+    }
+
+    // If the view reflects commits the log lost (if the server crashed
+    // after applying them, but before logging them), it is rebuilt from
+    // the log, and the server recovers them before it commits writes
+    ahead := found && server.commitDB.applied.CSN > server.lastCSN()
+    if ahead {
+        debugf("Server #%d lost commits up to CSN %d from its log",
+                server.id, server.commitDB.applied.CSN)
+        if server.commitDB.applied.CSN > server.recoveryCSN {
+            server.recoveryCSN = server.commitDB.applied.CSN
+        }
+        server.persist(WALRecord{Rollback: NO_ROLLBACK,
+                State: server.persistState()})
+    }
+    if !found || ahead || server.commitDB.applied.CSN < server.omitCSN ||
+            len(server.commitDB.applied.Writes) > 0 {
+        err = server.rebuildCommitView()
+        if err != nil {
+            return err
+        }
+    }
+    for idx, _ := range server.CommitLog {
+        server.applyToDB(true, &server.CommitLog[idx])
+    }
+
+    // The full view must reflect the same commits, followed by
+    // a prefix of the tentative log, to resume from its index
+    // Note: commits it lacks can still be applied to it, if it
+    // did not apply any tentative writes after its commits
+    found, err = server.fullDB.loadApplied()
+    if err != nil {
+        return queryError(err, "Error loading full view: ")
+    }
+    if found && len(server.fullDB.applied.Writes) == 0 &&
+            server.fullDB.applied.CSN >= server.omitCSN {
+        for idx, _ := range server.CommitLog {
+            server.applyToDB(false, &server.CommitLog[idx])
+        }
+    }
+    numApplied := server.fullDB.applied.numApplied(server.TentativeLog)
+    if !found || numApplied < 0 ||
+            server.fullDB.applied.CSN != server.commitDB.applied.CSN {
+        err = server.rebuildFullView()
+        if err != nil {
+            return err
+        }
+        numApplied = 0
+    }
+    for idx := numApplied; idx < len(server.TentativeLog); idx++ {
+        server.applyToDB(false, &server.TentativeLog[idx])
+    }
+    return nil
+}
+
+/* Returns whether this server is recovering commits its log lost:  *
+ * until it has them again, or all of its active peers sent it their *
+ * commits (so none of them has the lost ones), it commits no writes *
+ * so that it never assigns their CSNs to other writes               */
+func (server *BayouServer) recovering() bool {
+    if server.lastCSN() >= server.recoveryCSN {
+        return false
+    }
+    for _, peerID := range server.activePeers() {
+        if !server.recoveredFrom[peerID] {
+            return true
+        }
+    }
+    return false
+}
+
+/* Rebuilds the commit view from scratch, so the commit log can be  *
+ * replayed on it. If commits were truncated from the log, the view *
+ * cannot be rebuilt from it, so a snapshot of a peer's commit view *
+ * is installed instead, during the server's first anti-entropy     *
+ * Returns an error if it has no peer to install one from           */
+func (server *BayouServer) rebuildCommitView() error {
+    debugf("Server #%d rebuilding its commit view", server.id)
+    server.dbLock.Lock()
+    err := server.commitDB.Clear(server.schema)
+    server.dbLock.Unlock()
+    if err != nil {
+        return queryError(err, "Error rebuilding commit view: ")
+    }
+
+    if server.omitCSN != UNCOMMITTED_CSN {
+        server.snapshotPeer = server.randomPeer()
+        if server.snapshotPeer == NO_PEER {
+            return errors.New(fmt.Sprintf("Server #%d cannot rebuild " +
+                    "its commit view, since commits were truncated and " +
+                    "no peer has them", server.id))
+        }
+    }
+    return nil
+}
+
+/* Rebuilds the full view from a copy of the commit view, *
+ * so the tentative log can be replayed on it             */
+func (server *BayouServer) rebuildFullView() error {
+    debugf("Server #%d rebuilding its full view", server.id)
+    server.dbLock.Lock()
+    defer server.dbLock.Unlock()
+    return queryError(server.fullDB.CopyFrom(server.commitDB),
+            "Error rebuilding full view: ")
+}
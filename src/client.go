@@ -1,26 +1,111 @@
 package bayou
 
 import (
+    "context"
+    "errors"
     "fmt"
+    "io"
     "net/rpc"
+    "reflect"
+    "sort"
+    "strings"
     "time"
 )
 
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Name of the merge procedure claiming the next free hour */
+const NEXT_FREE_HOUR_PROC string = "claimNextFreeHour"
+
+/* Maximum time (in ms) a client call waits for its server to *
+ * reply, if the call's context has no earlier deadline        */
+const CLIENT_CALL_TIMEOUT int = SESSION_WAIT_TIMEOUT * 4
+
+/* Kinds of errors returned by client calls */
+const (
+    // The call failed for another reason (e.g. its query failed)
+    CLIENT_ERROR_FAILED ClientErrorKind = iota
+    // The server is not active, or its connection was closed
+    CLIENT_ERROR_INACTIVE
+    // The call's deadline passed before the server replied
+    CLIENT_ERROR_TIMEOUT
+    // The call's context was canceled before the server replied
+    CLIENT_ERROR_CANCELED
+    // The write conflicted, and none of its alternates (nor its
+    // merge) resolved the conflict, so it had no effect
+    CLIENT_ERROR_CONFLICT
+    // The server's view does not include writes the session depends
+    // on, so it did not serve the call (though another server, or
+    // the same one later, may)
+    CLIENT_ERROR_UNRESOLVED
+)
+
+/* Policies choosing the replica a client calls */
+const (
+    // Keep calling the replica that served the last call,
+    // until it fails (then, the next one in order)
+    REPLICA_STICKY ReplicaPolicy = iota
+    // Call the replica that served calls the fastest (so the
+    // nearest, or least loaded), trying each at least once
+    REPLICA_NEAREST
+)
+
+/* Schema of the scheduling app's database, *
+ * which its servers are constructed with   */
+var ROOMS_SCHEMA = Schema{`
+    CREATE TABLE rooms(
+        Name TEXT,
+        StartTime DATETIME,
+        EndTime DATETIME,
+        Owner TEXT
+    );
+`, nil}
+
 /************************
  *   TYPE DEFINITIONS   *
  ************************/
 
 /* Go object representing a Bayou Client */
 type BayouClient struct {
-    id     int
-    server *rpc.Client
+    id       int
+    replicas []*clientReplica
+    current  int
+    session  *Session
+    // How the client chooses the replica it calls
+    Policy   ReplicaPolicy
+}
+
+/* Server a client can call: its address (empty if the client was  *
+ * constructed with its connection), its connection (nil until the  *
+ * client needs it), the average time it took to serve the client's *
+ * calls, and whether it was down when it was last called           */
+type clientReplica struct {
+    address string
+    server  *rpc.Client
+    latency time.Duration
+    down    bool
+}
+
+/* Policy choosing the replica a client calls */
+type ReplicaPolicy int
+
+/* Kind of error returned by a client call */
+type ClientErrorKind int
+
+/* Error returned by a client call: its kind, *
+ * and the error it was caused by             */
+type ClientError struct {
+    Kind ClientErrorKind
+    Err  error
 }
 
 /* Represents a room in the scheduling app */
 type Room struct {
-    Name        string
-    StartTime   time.Time
-    EndTime     time.Time
+    Name        string    `bayou:"Name"`
+    StartTime   time.Time `bayou:"StartTime"`
+    EndTime     time.Time `bayou:"EndTime"`
 }
 
 /****************************
@@ -29,36 +114,97 @@ type Room struct {
 
 /* Returns a new Bayou Client            *
  * Provided RPC client should already be *
- * connected to this client's server    */
+ * connected to this client's server     */
 func NewBayouClient(id int, rpcClient *rpc.Client) *BayouClient {
-    client := &BayouClient{id, rpcClient}
+    replica := &clientReplica{server: rpcClient}
+    client := &BayouClient{id, []*clientReplica{replica}, 0,
+            NewSession(NO_GUARANTEES), REPLICA_STICKY}
+    return client
+}
+
+/* Returns a new Bayou Client calling the servers at the provided *
+ * addresses (e.g. "localhost:1111"), connecting to each when it  *
+ * first calls it. Calls a server cannot serve (because it is     *
+ * down, or cannot meet the session's guarantees) are sent to the *
+ * next one, and since every server checks the session's clocks,  *
+ * switching servers never breaks the session's guarantees        */
+func NewReplicatedClient(id int, addresses []string) *BayouClient {
+    replicas := make([]*clientReplica, len(addresses))
+    for idx, address := range addresses {
+        replicas[idx] = &clientReplica{address: address}
+    }
+    client := &BayouClient{id, replicas, 0, NewSession(NO_GUARANTEES),
+            REPLICA_STICKY}
     return client
 }
 
+/* Starts a new session providing the provided guarantees *
+ * for all subsequent reads and writes of this client     */
+func (client *BayouClient) StartSession(guarantees SessionGuarantee) {
+    client.session = NewSession(guarantees)
+}
+
+/* Continues an existing session (e.g. one started by a *
+ * client of a different server), so that this client's *
+ * reads and writes are bound by its guarantees         */
+func (client *BayouClient) JoinSession(session *Session) {
+    client.session = session
+}
+
+/* Returns this client's current session */
+func (client *BayouClient) Session() *Session {
+    return client.session
+}
+
+/* Returns the address of the server that served the *
+ * client's last call (empty if it was constructed    *
+ * with the connection to its server)                 */
+func (client *BayouClient) Replica() string {
+    return client.replicas[client.current].address
+}
+
 /* "Kills" a Bayou Client, closing *
- * connection with the server      */
+ * connections with its servers    */
 func (client *BayouClient) Kill() {
-    client.server.Close()
+    for _, replica := range client.replicas {
+        if replica.server != nil {
+            replica.server.Close()
+        }
+    }
+}
+
+/* Reads the result of the provided query (binding the provided    *
+ * arguments to it) from the client's server into the slice of      *
+ * structs dest points to (see ResultSet.Scan). If onlyStable is    *
+ * true, the query is run on the server's committed data            */
+func (client *BayouClient) Read(ctx context.Context, dest interface{},
+        query string, onlyStable bool, args ...interface{}) error {
+    err, result := client.sendReadRPC(ctx, query, args, onlyStable)
+    if err != nil {
+        return err
+    }
+    return result.Scan(dest)
 }
 
 /* Returns the status of the room with provided name at the provided time *
  * If onlyStable is true, tentative claims are not considered             */
-func (client *BayouClient) CheckRoom(name string, day int, hour int,
-        onlyStable bool) Room {
+func (client *BayouClient) CheckRoom(ctx context.Context, name string,
+        day int, hour int, onlyStable bool) (Room, error) {
     // Generate Dates
     startDate := createDate(day, hour)
 //    endDate := createDate(day, hour + 1)
     startTxt := startDate.Format("2006-01-02 15:04")
 //    endTxt   := endDate.Format("2006-01-02 15:04")
 
-    query := fmt.Sprintf(`
+    query := `
     SELECT Name, StartTime, EndTime FROM rooms
-    WHERE StartTime BETWEEN dateTime("%s") AND dateTime("%s")
-    `, startTxt, startTxt);
-    err, result :=  client.sendReadRPC(query, false)
-    check(err, "SendReadRPC failed: ")
-
-    rooms := deserializeRooms(result)
+    WHERE StartTime BETWEEN dateTime(?) AND dateTime(?)
+    `
+    var rooms []Room
+    err := client.Read(ctx, &rooms, query, onlyStable, startTxt, startTxt)
+    if err != nil {
+        return Room{}, err
+    }
     if (len(rooms) > 1) {
         debugf("Multiple rooms returned")
     }
@@ -66,13 +212,16 @@ func (client *BayouClient) CheckRoom(name string, day int, hour int,
     if (len(rooms) == 0) {
         var r Room
         r.Name = "-1"
-        return r
+        return r, nil
     }
-    return rooms[0]
+    return rooms[0], nil
 }
 
-/* Claims a room at the provided date and time */
-func (client *BayouClient) ClaimRoom(name string, day int, hour int) {
+/* Claims a room at the provided date and time       *
+ * Returns a CLIENT_ERROR_CONFLICT error if the hour *
+ * was already claimed                               */
+func (client *BayouClient) ClaimRoom(ctx context.Context, name string,
+        day int, hour int) error {
     // Generate Dates
     startDate := createDate(day, hour)
     endDate   := createDate(day, hour + 1)
@@ -80,86 +229,390 @@ func (client *BayouClient) ClaimRoom(name string, day int, hour int) {
     endTxt    :=   endDate.Format("2006-01-02 15:04")
 
     // Create Room
-    query := fmt.Sprintf(`
+    query := `
     INSERT OR REPLACE INTO rooms(
         Name,
         StartTime,
         EndTime
-    ) values("%s", dateTime("%s"), dateTime("%s"))
-    `, name, startTxt, endTxt);
+    ) values(?, dateTime(?), dateTime(?))
+    `
+    queryArgs := []interface{}{name, startTxt, endTxt}
 
-    check := fmt.Sprintf(`
+    check := `
     SELECT CASE WHEN EXISTS (
             SELECT *
             FROM rooms
-            WHERE StartTime BETWEEN dateTime("%s") AND dateTime("%s")
+            WHERE StartTime BETWEEN dateTime(?) AND dateTime(?)
     )
     THEN CAST(0 AS BIT)
     ELSE CAST(1 AS BIT) END
-    `, startTxt, startTxt);
+    `
+    checkArgs := []interface{}{startTxt, startTxt}
 
     // Always return false because we can't merge
     merge := `
     SELECT 0
     `
 
-    // TODO: Check This
-    undo := fmt.Sprintf(`
-    DELETE FROM rooms
-    WHERE StartTime BETWEEN dateTime("%s") AND dateTime("%s") 
-          AND Name == "%s" 
-    `, startTxt, endTxt, name);
+    // No undo is provided, so the server reverts the
+    // rows the write changed (including any it replaced)
+    writeArgs := &WriteArgs{WriteID: randomInt(), Query: query,
+            Check: check, Merge: merge, QueryArgs: queryArgs,
+            CheckArgs: checkArgs}
+    err, _, _, _ := client.sendWrite(ctx, writeArgs)
+    return err
+}
+
+/* Claims a room at the provided date and time, or if that *
+ * hour is taken, the next free hour on the same day        *
+ * Returns a CLIENT_ERROR_CONFLICT error if none were free  */
+func (client *BayouClient) ClaimRoomOrNextHour(ctx context.Context,
+        name string, day int, hour int) error {
+    room := Room{name, createDate(day, hour), createDate(day, hour + 1)}
+    writeID := randomInt()
+    owner := fmt.Sprintf("%d", writeID)
+
+    writeArgs := &WriteArgs{
+        WriteID:   writeID,
+        Merge:     getBoolQuery(false),
+        MergeProc: NEXT_FREE_HOUR_PROC,
+        ProcArgs:  []interface{}{name, owner, day, hour},
+    }
+    writeArgs.Query, writeArgs.QueryArgs = getClaimQuery(room, owner)
+    writeArgs.Undo, writeArgs.UndoArgs = getUnclaimQuery(owner)
+    writeArgs.Check, writeArgs.CheckArgs = getIsFreeQuery(room.StartTime)
+    err, _, _, _ := client.sendWrite(ctx, writeArgs)
+    return err
+}
+
+/* Claims the first of the provided rooms (in order) that is  *
+ * free, e.g. "room A at 10, else room B at 10, else A at 11" *
+ * Returns the index of the claimed room, or -1 and an error  *
+ * (CLIENT_ERROR_CONFLICT if none of them were free)          */
+func (client *BayouClient) ClaimFirstFreeRoom(ctx context.Context,
+        rooms []Room) (int, error) {
+    if len(rooms) == 0 {
+        return -1, &ClientError{CLIENT_ERROR_FAILED,
+                errors.New("No rooms to claim")}
+    }
+
+    // Every room after the first becomes an alternate write
+    alternates := make([]Alternate, len(rooms) - 1)
+    for idx, room := range rooms[1:] {
+        alternate := &alternates[idx]
+        alternate.Query, alternate.QueryArgs = getInsertQuery(room)
+        alternate.Undo, alternate.UndoArgs = getDeleteQuery(room)
+        alternate.Check, alternate.CheckArgs = getIsRoomFreeQuery(room)
+    }
+    writeArgs := &WriteArgs{
+        WriteID:    randomInt(),
+        Merge:      getBoolQuery(false),
+        Alternates: alternates,
+    }
+    writeArgs.Query, writeArgs.QueryArgs = getInsertQuery(rooms[0])
+    writeArgs.Undo, writeArgs.UndoArgs = getDeleteQuery(rooms[0])
+    writeArgs.Check, writeArgs.CheckArgs = getIsRoomFreeQuery(rooms[0])
+
+    err, _, _, alternate := client.sendWrite(ctx, writeArgs)
+    if err != nil {
+        return -1, err
+    }
+    if alternate == NO_ALTERNATE {
+        return 0, nil
+    }
+    return alternate + 1, nil
+}
+
+/**************************
+ *   BOOKING PROCEDURES   *
+ **************************/
 
-    client.sendWriteRPC(query,
-            undo, check, merge)
-//    _, hasConflict, wasResolved := client.sendWriteRPC(query,
-//            undo, check, merge)
-//    debugf("hasConflict %v\n", hasConflict)
-//    debugf("wasResolved %v\n", wasResolved)
+func init() {
+    RegisterProcedure(NEXT_FREE_HOUR_PROC, claimNextFreeHour)
+}
+
+/* Merge procedure claiming the first free hour after the *
+ * requested one, on the same day. Returns an error (so   *
+ * the write fails) if its arguments are malformed        *
+ * Arguments: room name, owner, day, requested hour       */
+func claimNextFreeHour(tx *BayouTx, args []interface{}) (bool, error) {
+    if len(args) != 4 {
+        return false, errors.New(fmt.Sprintf("%s expects 4 arguments, " +
+                "got %d", NEXT_FREE_HOUR_PROC, len(args)))
+    }
+    name, nameOk := args[0].(string)
+    owner, ownerOk := args[1].(string)
+    day, dayOk := args[2].(int)
+    hour, hourOk := args[3].(int)
+    if !nameOk || !ownerOk || !dayOk || !hourOk {
+        return false, errors.New(fmt.Sprintf("%s expects a name, owner, " +
+                "day, and hour, got %v", NEXT_FREE_HOUR_PROC, args))
+    }
+
+    for nextHour := hour + 1; nextHour < 24; nextHour++ {
+        room := Room{name, createDate(day, nextHour),
+                createDate(day, nextHour + 1)}
+        isFree, isFreeArgs := getIsFreeQuery(room.StartTime)
+        free, err := tx.Check(isFree, isFreeArgs...)
+        if err != nil {
+            return false, err
+        }
+        if free {
+            claim, claimArgs := getClaimQuery(room, owner)
+            return true, tx.Execute(claim, claimArgs...)
+        }
+    }
+    return false, nil
+}
+
+/****************************
+ *   CLIENT ERROR METHODS   *
+ ****************************/
+
+func (err *ClientError) Error() string {
+    return err.Err.Error()
+}
+
+/* Returns the error the client error was caused by */
+func (err *ClientError) Unwrap() error {
+    return err.Err
+}
+
+/* Returns whether the provided error is (or wraps) *
+ * a client error of the provided kind              */
+func IsClientError(err error, kind ClientErrorKind) bool {
+    var clientErr *ClientError
+    return errors.As(err, &clientErr) && clientErr.Kind == kind
 }
 
 /**********************
  *   HELPER METHODS   *
  **********************/
 
-/* Sends a Read RPC to the client's server    *
- * Returns an error if the RPC fails, and     *
- * the result of the read query if successful */
-func (client *BayouClient) sendReadRPC(readQuery string,
-        fromCommit bool) (err error, data ReadResult) {
-    readArgs := &ReadArgs{readQuery, fromCommit}
+/* Sends a Read RPC (binding the provided arguments *
+ * to the query) to the client's server             *
+ * Returns an error if the RPC fails, and           *
+ * the result of the read query if successful       */
+func (client *BayouClient) sendReadRPC(ctx context.Context, readQuery string,
+        queryArgs []interface{}, fromCommit bool) (err error,
+        data ResultSet) {
+    readArgs := &ReadArgs{readQuery, fromCommit, *client.session, queryArgs}
     var readReply ReadReply
 
     // Send RPC and process the results
-    err = client.server.Call("BayouServer.Read", readArgs, &readReply)
+    err = client.call(ctx, "BayouServer.Read", readArgs, &readReply, true)
     if err == nil {
         data = readReply.Data
-    } else {
-        debugf("Client #%d Read RPC Failed: " + err.Error(), client.id)
-        data = nil
+        client.session.observeRead(readReply.ViewClock)
     }
     return
 }
 
-/* Sends a Write RPC to the client's server              *
- * Returns an error if the RPC fails, and if successful, *
- * whether the write had a conflict and whether it was   *
- * eventually resolved                                   */
-func (client *BayouClient) sendWriteRPC(writeQuery string, undoQuery string,
-        check string, merge string) (err error, hasConflict bool,
-        wasResolved bool) {
-    writeArgs := &WriteArgs{randomInt(), writeQuery, undoQuery, check, merge}
+/* Sends a Write RPC with the provided arguments (and the   *
+ * client's session) to the client's server                 *
+ * Returns an error if the RPC fails, or the write had an   *
+ * unresolved conflict, and whether the write had a         *
+ * conflict, whether it was eventually resolved, and the    *
+ * index of the alternate write that was applied (if any)   */
+func (client *BayouClient) sendWrite(ctx context.Context,
+        writeArgs *WriteArgs) (err error, hasConflict bool,
+        wasResolved bool, alternate int) {
+    writeArgs.Session = *client.session
     var writeReply WriteReply
 
     // Send RPC and process the results
-    err = client.server.Call("BayouServer.Write", writeArgs, &writeReply)
-    if err == nil {
-        hasConflict = writeReply.HasConflict
-        wasResolved = writeReply.WasResolved
-    } else {
-        debugf("Client #%d Write RPC Failed: " + err.Error(), client.id)
-        hasConflict = false
-        wasResolved = false
+    alternate = NO_ALTERNATE
+    err = client.call(ctx, "BayouServer.Write", writeArgs, &writeReply,
+            false)
+    if err != nil {
+        return
+    }
+    hasConflict = writeReply.HasConflict
+    wasResolved = writeReply.WasResolved
+    alternate = writeReply.Alternate
+    client.session.observeWrite(writeReply.AcceptStamp)
+    if hasConflict && !wasResolved {
+        err = &ClientError{CLIENT_ERROR_CONFLICT, errors.New(fmt.Sprintf(
+                "Write %d conflicted, and its conflict was not resolved",
+                writeArgs.WriteID))}
     }
     return
 }
+
+/* Calls the provided method of one of the client's servers,       *
+ * chosen by its policy, sending the call to the next one if the    *
+ * server could not serve it (or, for calls that can be repeated,   *
+ * did not reply). Returns a client error of the matching kind if   *
+ * no server served the call (preferring the error of one that was  *
+ * not down)                                                        */
+func (client *BayouClient) call(ctx context.Context, method string,
+        args interface{}, reply interface{}, repeatable bool) error {
+    var err *ClientError
+    for _, idx := range client.replicaOrder() {
+        callErr := client.callReplica(ctx, idx, method, args, reply)
+        if callErr == nil {
+            client.current = idx
+            return nil
+        }
+        if err == nil || callErr.Kind != CLIENT_ERROR_INACTIVE {
+            err = callErr
+        }
+        if !canFailOver(ctx, callErr, repeatable) {
+            return callErr
+        }
+    }
+    if err == nil {
+        return &ClientError{CLIENT_ERROR_FAILED, errors.New(fmt.Sprintf(
+                "Client #%d has no servers to call", client.id))}
+    }
+    return err
+}
+
+/* Calls the provided method of the client's replica with the      *
+ * provided index, connecting to it if needed, and waiting until   *
+ * it replies, or the context is done (or CLIENT_CALL_TIMEOUT      *
+ * passes). Returns a client error of the matching kind if the     *
+ * call fails                                                      *
+ * Note: the server may still serve a call after it is abandoned,  *
+ * in which case the client's session does not observe it          */
+func (client *BayouClient) callReplica(ctx context.Context, idx int,
+        method string, args interface{}, reply interface{}) *ClientError {
+    replica := client.replicas[idx]
+    ctx, cancel := context.WithTimeout(ctx,
+            time.Duration(CLIENT_CALL_TIMEOUT) * time.Millisecond)
+    defer cancel()
+    if ctx.Err() != nil {
+        return clientError(ctx.Err())
+    }
+    if replica.server == nil {
+        server, err := rpc.DialHTTP("tcp", replica.address)
+        if err != nil {
+            debugf("Client #%d failed to connect to %s: %s", client.id,
+                    replica.address, err.Error())
+            replica.down = true
+            return &ClientError{CLIENT_ERROR_INACTIVE, err}
+        }
+        replica.server = server
+    }
+
+    // Each call replies into a new value, as an abandoned
+    // call may still write to its reply when the server replies
+    attempt := reflect.New(reflect.TypeOf(reply).Elem())
+    start := time.Now()
+    var err error
+    call := replica.server.Go(method, args, attempt.Interface(),
+            make(chan *rpc.Call, 1))
+    select {
+    case <-call.Done:
+        err = call.Error
+    case <-ctx.Done():
+        err = ctx.Err()
+    }
+    if err != nil {
+        debugf("Client #%d %s RPC Failed: %s", client.id, method,
+                err.Error())
+        clientErr := clientError(err)
+        if clientErr.Kind == CLIENT_ERROR_INACTIVE {
+            replica.down = true
+        }
+        if isConnectionError(err) && replica.address != "" {
+            // Connect again the next time the replica is called
+            replica.server.Close()
+            replica.server = nil
+        }
+        return clientErr
+    }
+
+    replica.down = false
+    replica.observeLatency(time.Since(start))
+    reflect.ValueOf(reply).Elem().Set(attempt.Elem())
+    return nil
+}
+
+/* Returns the indexes of the client's replicas in the order a call *
+ * tries them, by the client's policy. Replicas that were down when *
+ * last called are tried after all others                           */
+func (client *BayouClient) replicaOrder() []int {
+    order := make([]int, len(client.replicas))
+    for offset := range order {
+        order[offset] = (client.current + offset) % len(client.replicas)
+    }
+    replicas := client.replicas
+    if client.Policy == REPLICA_NEAREST {
+        // Replicas never called have no latency, so they come first
+        sort.SliceStable(order, func(i, j int) bool {
+            return replicas[order[i]].latency < replicas[order[j]].latency
+        })
+    }
+    sort.SliceStable(order, func(i, j int) bool {
+        return !replicas[order[i]].down && replicas[order[j]].down
+    })
+    return order
+}
+
+/******************************
+ *   CLIENT REPLICA METHODS   *
+ ******************************/
+
+/* Adds the provided time a call took to the *
+ * replica's (moving) average latency        */
+func (replica *clientReplica) observeLatency(latency time.Duration) {
+    if replica.latency == 0 {
+        replica.latency = latency
+        return
+    }
+    replica.latency = (replica.latency * 3 + latency) / 4
+}
+
+/************************
+ *   CLIENT UTILITIES   *
+ ************************/
+
+/* Returns the provided error, returned by a call *
+ * to a server, as a client error of its kind     */
+func clientError(err error) *ClientError {
+    kind := CLIENT_ERROR_FAILED
+    switch {
+    case errors.Is(err, context.DeadlineExceeded):
+        kind = CLIENT_ERROR_TIMEOUT
+    case errors.Is(err, context.Canceled):
+        kind = CLIENT_ERROR_CANCELED
+    case isConnectionError(err) ||
+            strings.Contains(err.Error(), INACTIVE_ERROR):
+        kind = CLIENT_ERROR_INACTIVE
+    case strings.Contains(err.Error(), SESSION_ERROR):
+        kind = CLIENT_ERROR_UNRESOLVED
+    }
+    return &ClientError{kind, err}
+}
+
+/* Returns whether a call that failed with the provided error may be *
+ * sent to another server: if the server did not serve it (it was    *
+ * down, or could not meet the session's guarantees), or if the call *
+ * can be repeated, if the server did not reply in time. Calls whose *
+ * context is done are never sent again                              */
+func canFailOver(ctx context.Context, err *ClientError,
+        repeatable bool) bool {
+    if ctx.Err() != nil {
+        return false
+    }
+    switch err.Kind {
+    case CLIENT_ERROR_UNRESOLVED:
+        return true
+    case CLIENT_ERROR_INACTIVE:
+        // A connection closed during the call may have
+        // been closed after the server served it
+        return repeatable || (err.Err != io.EOF &&
+                err.Err != io.ErrUnexpectedEOF)
+    case CLIENT_ERROR_TIMEOUT:
+        return repeatable
+    }
+    return false
+}
+
+/* Returns whether the provided error, returned by a *
+ * call to a server, means its connection is closed  */
+func isConnectionError(err error) bool {
+    return err == rpc.ErrShutdown || err == io.EOF ||
+            err == io.ErrUnexpectedEOF
+}
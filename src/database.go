@@ -2,6 +2,8 @@ package bayou
 
 import (
     "encoding/gob"
+    "errors"
+    "fmt"
     "time"
     "database/sql"
     _ "github.com/mattn/go-sqlite3"
@@ -15,13 +17,48 @@ import (
  * Extends sqlite3 database type */
 type BayouDB struct {
     *sql.DB
+    // Position in the log the database reflects
+    // (loaded when the server replays its logs)
+    applied AppliedIndex
+    // Whether the changes made by each write are captured (so
+    // they can be undone), and the schema cookie the triggers
+    // capturing them were created for
+    capturesUndo bool
+    undoSchema   int
+}
+
+/* Transaction on a Bayou database         *
+ * Extends sqlite3 transaction type, and is *
+ * the handle given to Bayou procedures     */
+type BayouTx struct {
+    *sql.Tx
+}
+
+/* Common interface of databases and transactions, *
+ * used to share query methods between the two     */
+type sqlExecutor interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+    Query(query string, args ...interface{}) (*sql.Rows, error)
 }
 
 /* Represents the results of BayouDB read query: *
  * Each map in the slice corresponds to a row's  *
- * data, with the keys being the column names    */
+ * data, with the keys being the column names    *
+ * (and the values normalized, as in ResultSet)  */
 type ReadResult []map[string]interface{}
 
+/* Types of the arguments that can be bound to a query's *
+ * placeholders, which are registered with gob so they   *
+ * can be sent to (and logged by) every replica          */
+var queryArgTypes = []interface{}{int(0), int64(0), float64(0), false, "",
+        []byte{}, time.Time{}}
+
+func init() {
+    for _, argType := range queryArgTypes {
+        gob.Register(argType)
+    }
+}
+
 /************************
  *   DATABASE METHODS   *
  ************************/
@@ -29,99 +66,283 @@ type ReadResult []map[string]interface{}
 /*
  * Opens the Database file
  */
-func InitDB(filepath string) *BayouDB {
-    gob.Register(time.Time{})
+func InitDB(filepath string) (*BayouDB, error) {
     sqlDB, err := sql.Open("sqlite3", filepath)
-    if err != nil { Log.Fatal(err) }
-    if sqlDB == nil { Log.Fatal("db nil") }
-    db := &BayouDB{sqlDB}
-    db.CreateTable()
-    return db;
+    if err != nil {
+        return nil, err
+    }
+    if sqlDB == nil {
+        return nil, errors.New("Error opening database: db nil")
+    }
+    return newBayouDB(sqlDB)
 }
 
-/*
- * Creates a Database table if one
- * does not exist already
- */
-func (db *BayouDB) CreateTable() {
-    // create table if not exists
-    sql_table := `
-    CREATE TABLE IF NOT EXISTS rooms(
-        Name TEXT,
-        StartTime DATETIME,
-        EndTime DATETIME,
-        Owner TEXT
-    );
-    `
+/* Opens an empty in-memory database, used to stage *
+ * contents before they are copied to a view        */
+func newStagingDB() (*BayouDB, error) {
+    sqlDB, err := sql.Open("sqlite3", ":memory:")
+    if err != nil {
+        return nil, err
+    }
 
-    _, err := db.Exec(sql_table)
-    if err != nil { Log.Fatal(err) }
+    // Each connection would open a separate in-memory database
+    sqlDB.SetMaxOpenConns(1)
+    return newBayouDB(sqlDB)
 }
 
-/* Executes provided query on the database */
-func (db *BayouDB) Execute(query string) {
-    _, err := db.Exec(query)
-    check(err, "Error executing query (" + query + "): ")
+/* Wraps the opened database, creating Bayou's own tables */
+func newBayouDB(sqlDB *sql.DB) (*BayouDB, error) {
+    db := &BayouDB{sqlDB, AppliedIndex{UNCOMMITTED_CSN, nil}, false,
+            NO_UNDO_SCHEMA}
+    err := db.createAppliedTables()
+    if err == nil {
+        err = db.createUndoCaptureTable()
+    }
+    if err != nil {
+        sqlDB.Close()
+        return nil, err
+    }
+    return db, nil
+}
+
+/* Executes provided query on the database, binding *
+ * the provided arguments to its placeholders        */
+func (db *BayouDB) Execute(query string, args ...interface{}) error {
+    return execute(db, query, args)
 }
 
 /* Executes provided query on the   *
  * database, and returns the result */
-func (db *BayouDB) Read(query string) ReadResult {
-    rows, err := db.Query(query)
-    defer rows.Close()
-    check(err, "Error executing read (" + query + "): ")
+func (db *BayouDB) Read(query string, args ...interface{}) (ReadResult,
+        error) {
+    return read(db, query, args)
+}
+
+/* Executes provided query on the database, and returns *
+ * the typed result (as sent to clients)                */
+func (db *BayouDB) ReadTyped(query string, args ...interface{}) (ResultSet,
+        error) {
+    return readTyped(db, query, args)
+}
+
+/* Executes provided query on the database *
+ * and returns the (boolean) result        */
+func (db *BayouDB) Check(query string, args ...interface{}) (bool, error) {
+    return checkQuery(db, query, args)
+}
+
+/* Begins a new transaction on the database */
+func (db *BayouDB) BeginTx() (*BayouTx, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return nil, errors.New("Error beginning transaction: " + err.Error())
+    }
+    return &BayouTx{tx}, nil
+}
+
+/***************************
+ *   TRANSACTION METHODS   *
+ ***************************/
+
+/* Executes provided query within the transaction */
+func (tx *BayouTx) Execute(query string, args ...interface{}) error {
+    return execute(tx, query, args)
+}
+
+/* Executes provided query within the *
+ * transaction, and returns the result */
+func (tx *BayouTx) Read(query string, args ...interface{}) (ReadResult,
+        error) {
+    return read(tx, query, args)
+}
+
+/* Executes provided query within the transaction, *
+ * and returns the typed result                    */
+func (tx *BayouTx) ReadTyped(query string, args ...interface{}) (ResultSet,
+        error) {
+    return readTyped(tx, query, args)
+}
+
+/* Executes provided query within the transaction *
+ * and returns the (boolean) result               */
+func (tx *BayouTx) Check(query string, args ...interface{}) (bool, error) {
+    return checkQuery(tx, query, args)
+}
 
-    columns, err2 := rows.Columns()
-    check(err2, "Error getting columns for read query (" + query + ")")
+/* Returns the names of all of the database's tables, *
+ * besides SQLite's and Bayou's own                    */
+func (tx *BayouTx) tableNames() ([]string, error) {
+    result, err := tx.Read(`
+        SELECT name
+        FROM sqlite_master
+        WHERE type == "table" AND name NOT LIKE "sqlite_%"
+            AND substr(name, 1, ?) != ?
+        ORDER BY name
+    `, len(INTERNAL_TABLE_PREFIX), INTERNAL_TABLE_PREFIX)
+    if err != nil {
+        return nil, err
+    }
+    names := make([]string, len(result))
+    for idx, row := range result {
+        names[idx] = row["name"].(string)
+    }
+    return names, nil
+}
+
+/* Starts a savepoint with the provided name within the *
+ * transaction, which can later be rolled back to        */
+func (tx *BayouTx) savepoint(name string) error {
+    return tx.Execute("SAVEPOINT " + name)
+}
 
-    var result []map[string]interface{}
+/* Undoes all changes made within the transaction since the *
+ * savepoint with the provided name, and ends the savepoint */
+func (tx *BayouTx) rollbackTo(name string) error {
+    err := tx.Execute("ROLLBACK TO " + name)
+    if err != nil {
+        return err
+    }
+    return tx.release(name)
+}
+
+/* Ends the savepoint with the provided name, *
+ * keeping the changes made since it started  */
+func (tx *BayouTx) release(name string) error {
+    return tx.Execute("RELEASE " + name)
+}
+
+/************************
+ *   QUERY UTILITIES    *
+ ************************/
+
+/* Executes provided query (with the provided *
+ * arguments) on the database or transaction   */
+func execute(executor sqlExecutor, query string, args []interface{}) error {
+    _, err := executor.Exec(query, args...)
+    return queryError(err, "Error executing query (" + query + "): ")
+}
+
+/* Executes provided query on the database or *
+ * transaction, and returns the result        */
+func read(executor sqlExecutor, query string,
+        args []interface{}) (ReadResult, error) {
+    result, err := readTyped(executor, query, args)
+    if err != nil {
+        return nil, err
+    }
+    return result.maps(), nil
+}
+
+/* Executes provided query on the database or transaction, *
+ * and returns the typed result                            */
+func readTyped(executor sqlExecutor, query string,
+        args []interface{}) (ResultSet, error) {
+    var result ResultSet
+    rows, err := executor.Query(query, args...)
+    if err != nil {
+        return result, queryError(err, "Error executing read (" + query +
+                "): ")
+    }
+    defer rows.Close()
+
+    columnTypes, err := rows.ColumnTypes()
+    if err != nil {
+        return result, queryError(err, "Error getting columns for read " +
+                "query (" + query + "): ")
+    }
+    result.Columns = make([]ResultColumn, len(columnTypes))
+    for i, columnType := range columnTypes {
+        result.Columns[i] = ResultColumn{columnType.Name(),
+                columnType.DatabaseTypeName()}
+    }
+    result.Rows = make([][]interface{}, 0)
 
     for rows.Next() {
-        check(rows.Err(), "Error getting result of read query (" + query + ")")
 
         // sql package requires pointers when scanning, so
         // create slice to actually store the values, and
         // another slice to contain the pointers to them
-        columnVals := make([]interface{}, len(columns))
-        columnPtrs := make([]interface{}, len(columns))
-        for i, _ := range columns {
+        columnVals := make([]interface{}, len(columnTypes))
+        columnPtrs := make([]interface{}, len(columnTypes))
+        for i, _ := range columnTypes {
             columnPtrs[i] = &columnVals[i]
         }
 
         // Scan results into column pointer slice
         err = rows.Scan(columnPtrs...)
-        check(err, "Error scanning result of read query (" + query + ")")
+        if err != nil {
+            return result, queryError(err, "Error scanning result of read " +
+                    "query (" + query + "): ")
+        }
 
-        // Create map for the row, and append it to result slice
-        rowMap := make(map[string]interface{})
-        for i, columnName := range columns {
-            rowMap[columnName] = columnVals[i]
+        // Normalize the row's values, and append it to the result
+        for i, column := range result.Columns {
+            columnVals[i] = normalizeValue(columnVals[i], column.Type)
         }
-        result = append(result, rowMap)
+        result.Rows = append(result.Rows, columnVals)
+    }
+    if rows.Err() != nil {
+        return result, queryError(rows.Err(), "Error getting result of " +
+                "read query (" + query + "): ")
     }
 
-    return result
+    return result, nil
 }
 
-/* Executes provided query on the database *
- * and returns the (boolean) result        */
-func (db *BayouDB) Check(query string) bool {
-    rows, err := db.Query(query)
+/* Executes provided query on the database or  *
+ * transaction and returns the (boolean) result */
+func checkQuery(executor sqlExecutor, query string,
+        args []interface{}) (bool, error) {
+    rows, err := executor.Query(query, args...)
+    if err != nil {
+        return false, queryError(err, "Error executing check (" + query +
+                "): ")
+    }
     defer rows.Close()
-    check(err, "Error executing check (" + query + "): ")
 
     // Ensure the query returned a result
     hasResult := rows.Next()
+    if rows.Err() != nil {
+        return false, queryError(rows.Err(), "Error getting result of " +
+                "check query (" + query + "): ")
+    }
     if !hasResult {
-        Log.Fatal("No result returned from check query (" + query + ")")
+        return false, errors.New("No result returned from check query (" +
+                query + ")")
     }
-    check(rows.Err(), "Error getting result of check query (" + query + ")")
 
     var boolResult bool
     err = rows.Scan(&boolResult)
-    check(err, "Error scanning result of check (" + query + "): ")
+    if err != nil {
+        return false, queryError(err, "Error scanning result of check (" +
+                query + "): ")
+    }
 
-    return boolResult
+    return boolResult, nil
+}
+
+/* Returns an error if any of the provided query arguments has *
+ * a type that cannot be bound to a placeholder (or sent to     *
+ * other replicas). A nil argument binds NULL                   */
+func checkQueryArgs(args []interface{}) error {
+    for idx, arg := range args {
+        switch arg.(type) {
+        case nil, int, int64, float64, bool, string, []byte, time.Time:
+        default:
+            return errors.New(fmt.Sprintf("Query argument %d has " +
+                    "unsupported type %T", idx, arg))
+        }
+    }
+    return nil
+}
+
+/* Returns the provided query error prefixed with *
+ * the provided message (or nil if there is none) */
+func queryError(err error, prefix string) error {
+    if err == nil {
+        return nil
+    }
+    return errors.New(prefix + err.Error())
 }
 
 /*
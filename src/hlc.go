@@ -0,0 +1,115 @@
+package bayou
+
+import (
+    "fmt"
+    "time"
+)
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Source of the physical time (in ms since the Unix epoch) of a *
+ * hybrid logical clock: the system clock, unless replaced (e.g. *
+ * by tests simulating clocks that are not synchronized)         */
+type PhysicalClock func() int64
+
+/* Hybrid logical clock: stamps events with the physical time,  *
+ * unless the latest stamp it took (or observed) is not behind  *
+ * it, in which case it uses that stamp's physical time and the *
+ * next logical time. Stamps stay close to physical time, but   *
+ * still follow every stamp their server had seen               */
+type HybridClock struct {
+    serverID int
+    physical PhysicalClock
+    latest   HLCStamp
+}
+
+/* Stamp taken by a hybrid logical clock: its physical time (in ms), *
+ * the logical time ordering stamps with the same physical time, and *
+ * the ID of the server that took it (ordering all other stamps)     */
+type HLCStamp struct {
+    Physical int64
+    Logical  int
+    ServerID int
+}
+
+/****************************
+ *   HYBRID CLOCK METHODS   *
+ ****************************/
+
+/* Returns a new hybrid logical clock of the provided *
+ * server, reading physical time from the source      */
+func NewHybridClock(serverID int, physical PhysicalClock) *HybridClock {
+    return &HybridClock{serverID, physical, HLCStamp{}}
+}
+
+/* Returns a new stamp, later than all the stamps *
+ * the clock took or observed before              */
+func (clock *HybridClock) Now() HLCStamp {
+    physical := clock.physical()
+    if physical > clock.latest.Physical {
+        clock.latest = HLCStamp{physical, 0, clock.serverID}
+    } else {
+        clock.latest = HLCStamp{clock.latest.Physical,
+                clock.latest.Logical + 1, clock.serverID}
+    }
+    return clock.latest
+}
+
+/* Records a stamp taken by another clock (e.g. the stamp of *
+ * a write another server accepted), so that the stamps this *
+ * clock takes from now on are later than it                 */
+func (clock *HybridClock) Observe(stamp HLCStamp) {
+    if clock.latest.Compare(stamp) < 0 {
+        clock.latest = stamp
+    }
+}
+
+/* Replaces the source the clock reads physical time from *
+ * (stamps it already took or observed still come first)  */
+func (clock *HybridClock) SetPhysicalClock(physical PhysicalClock) {
+    clock.physical = physical
+}
+
+/*************************
+ *   HLC STAMP METHODS   *
+ *************************/
+
+/* Returns -1, 0 or 1 if this stamp is earlier than, the same as, *
+ * or later than the other: by physical time, then logical time,  *
+ * then by the ID of the server that took it                      */
+func (stamp HLCStamp) Compare(other HLCStamp) int {
+    switch {
+    case stamp.Physical != other.Physical:
+        return compareInts(stamp.Physical, other.Physical)
+    case stamp.Logical != other.Logical:
+        return compareInts(int64(stamp.Logical), int64(other.Logical))
+    }
+    return compareInts(int64(stamp.ServerID), int64(other.ServerID))
+}
+
+func (stamp HLCStamp) String() string {
+    return fmt.Sprintf("HLC: %d.%d #%d", stamp.Physical, stamp.Logical,
+            stamp.ServerID)
+}
+
+/*********************
+ *   HLC UTILITIES   *
+ *********************/
+
+/* Returns the system clock's time, in ms since the Unix epoch */
+func systemTime() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+/* Returns -1, 0 or 1 if a is less than, equal to, or greater than b */
+func compareInts(a int64, b int64) int {
+    if a < b {
+        return -1
+    }
+    if a > b {
+        return 1
+    }
+    return 0
+}
@@ -0,0 +1,554 @@
+package bayou
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/rpc"
+    "time"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Kinds of changes a write can make to the set of servers */
+const (
+    // The write does not change the set of servers
+    NO_MEMBER_CHANGE MemberChange = iota
+    // A new server joined the network
+    MEMBER_JOIN
+    // A server retired from the network
+    MEMBER_RETIRE
+    // A server was designated the primary
+    MEMBER_PRIMARY
+)
+
+/* Status the RPC server replies with once a connection is accepted */
+const RPC_CONNECTED = "200 Connected to Go RPC"
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Kind of change to the set of servers */
+type MemberChange int
+
+/* Change to the set of servers recorded by a write */
+type Membership struct {
+    Change   MemberChange
+    ServerID int
+    // RPC address of a joining server
+    Address  string
+    // Epoch started by a designated primary
+    Epoch    int
+}
+
+/* A server of the Bayou network, as known by the other servers *
+ * Servers created with the network have no address, since     *
+ * their peers were provided with RPC clients for them         */
+type Member struct {
+    Address    string
+    Retired    bool
+    // CSN of the write retiring the server, once it was committed
+    RetiredCSN int
+    // Whether the retired server was dropped from this server's
+    // clocks and per-server state (see dropMembers)
+    Dropped    bool
+}
+
+/* AddServer RPC arguments structure */
+type AddServerArgs struct {
+    // Address the new server's RPCs are served on
+    Address string
+}
+
+/* AddServer RPC reply structure */
+type AddServerReply struct {
+    // ID assigned to the new server, and its sponsor's ID
+    ServerID  int
+    SponsorID int
+    // Sponsor's commit view, to start the new server from
+    Snapshot  Snapshot
+}
+
+/****************************
+ *   MEMBERSHIP FUNCTIONS   *
+ ****************************/
+
+/* Returns a new Bayou Server joining an existing network through  *
+ * the sponsor (which must be the primary): the sponsor assigns    *
+ * the new server a unique ID, writes its creation to the log, and *
+ * sends it a snapshot to start from. The new server persists its  *
+ * state in dataDir, and serves RPCs on the provided port, which   *
+ * others reach at the given address                               */
+func JoinBayouServer(sponsor *rpc.Client, address string, commitDB *BayouDB,
+        fullDB *BayouDB, schema Schema, dataDir string,
+        port int) (*BayouServer, error) {
+    addServerArgs := AddServerArgs{address}
+    var addServerReply AddServerReply
+    err := sponsor.Call("BayouServer.AddServer", &addServerArgs,
+            &addServerReply)
+    if err != nil {
+        return nil, err
+    }
+
+    peers := make([]*rpc.Client, len(addServerReply.Snapshot.Members))
+    peers[addServerReply.SponsorID] = sponsor
+    server, err := NewBayouServer(addServerReply.ServerID, peers, commitDB,
+            fullDB, schema, dataDir, port)
+    if err != nil {
+        return nil, err
+    }
+
+    server.logLock.Lock()
+    err = server.installSnapshot(addServerReply.Snapshot)
+    server.logLock.Unlock()
+    if err != nil {
+        server.Kill()
+        return nil, err
+    }
+    return server, nil
+}
+
+/* AddServer RPC Handler                             *
+ * Introduces a new server to the network: assigns   *
+ * it an ID, and commits a write recording its join  */
+func (server *BayouServer) AddServer(args *AddServerArgs,
+        reply *AddServerReply) error {
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    // Server may have been killed while waiting for the lock
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    // Only the primary sponsors new servers, since it commits the join
+    // immediately, so IDs are assigned in a single (commit) order
+    if !server.IsPrimary {
+        return errors.New(fmt.Sprintf("Server #%d is not the primary, so " +
+                "it cannot add servers", server.id))
+    }
+    if !server.commits() {
+        return errors.New(fmt.Sprintf("Server #%d is not committing " +
+                "writes, so it cannot add servers", server.id))
+    }
+
+    newID := len(server.members)
+    server.writeMembership(Membership{MEMBER_JOIN, newID, args.Address, 0})
+    debugf("Server #%d added server %d at %s", server.id, newID,
+            args.Address)
+
+    snapshot, err := server.takeSnapshot()
+    if err != nil {
+        return err
+    }
+    reply.ServerID = newID
+    reply.SponsorID = server.id
+    reply.Snapshot = snapshot
+    return nil
+}
+
+/* Retires this server from the network: writes its retirement to  *
+ * the log, hands off its writes (including the retirement) to an  *
+ * active peer through anti-entropy, and then kills this server    *
+ * logLock is released while waiting for each peer, so reads are   *
+ * still served, but no writes are accepted (from clients or       *
+ * peers) during the hand off, so the peer receives all of them    *
+ * Returns an error if no peer could receive the writes            */
+func (server *BayouServer) Retire() error {
+    server.logLock.Lock()
+
+    if !server.isActive {
+        server.logLock.Unlock()
+        return server.inactiveError()
+    }
+    if server.IsPrimary {
+        server.logLock.Unlock()
+        return errors.New(fmt.Sprintf("Server #%d is the primary, so it " +
+                "cannot retire before handing off primaryship", server.id))
+    }
+    if server.retiring {
+        server.logLock.Unlock()
+        return errors.New(fmt.Sprintf("Server #%d is already retiring",
+                server.id))
+    }
+
+    server.writeMembership(Membership{MEMBER_RETIRE, server.id, "", 0})
+    server.retiring = true
+
+    // Hand off this server's writes to the first peer that accepts them
+    handedOff := false
+    peerIDs := server.activePeers()
+    offset := 0
+    if len(peerIDs) > 0 {
+        offset = randomIntn(len(peerIDs))
+    }
+    for i, _ := range peerIDs {
+        peerID := peerIDs[(i + offset) % len(peerIDs)]
+        if server.exchangeWith(peerID, false) {
+            debugf("Server #%d handed off its writes to %d", server.id,
+                    peerID)
+            handedOff = true
+            break
+        }
+    }
+    server.retiring = false
+
+    // Server may have been killed while waiting for a peer
+    if !server.isActive {
+        server.logLock.Unlock()
+        return server.inactiveError()
+    }
+    if !handedOff {
+        server.logLock.Unlock()
+        return errors.New(fmt.Sprintf("Server #%d could not hand off its " +
+                "writes before retiring", server.id))
+    }
+
+    // Stop handling requests before releasing the
+    // lock, so no writes are accepted after the hand off
+    server.isActive = false
+    server.logLock.Unlock()
+    server.Kill()
+    return nil
+}
+
+/***********************************
+ *   SERVER MEMBERSHIP UTILITIES   *
+ ***********************************/
+
+/* Writes a membership change to the log as this server *
+ * Must be called while holding logLock                 */
+func (server *BayouServer) writeMembership(membership Membership) {
+    server.tentativeClock.Inc(server.id)
+
+    // Membership writes do not change the database
+    noop := getBoolQuery(true)
+    writeEntry := NewLogEntry(randomInt(), server.tentativeClock, noop,
+            noop, getBoolQuery(false))
+    writeEntry.Membership = membership
+    writeEntry.HLC = server.hlc.Now()
+    undoEntry := NewLogEntry(writeEntry.WriteID, server.tentativeClock, noop,
+            noop, getBoolQuery(false))
+    server.applyWrite(writeEntry, undoEntry)
+}
+
+/* Applies a write's membership change to this server's view of *
+ * the network. Changes may be applied more than once (e.g. when *
+ * tentative writes are re-executed), so they are idempotent     *
+ * Note: retirements are never undone, and designations of the   *
+ * primary only take effect once committed                       */
+func (server *BayouServer) applyMembership(entry LogEntry) {
+    membership := entry.Membership
+    server.growMembers(membership.ServerID + 1)
+    member := &server.members[membership.ServerID]
+    switch membership.Change {
+    case MEMBER_JOIN:
+        if membership.Address != "" && !member.Dropped {
+            member.Address = membership.Address
+        }
+    case MEMBER_RETIRE:
+        member.Retired = true
+        if entry.CSN != UNCOMMITTED_CSN {
+            member.RetiredCSN = entry.CSN
+        }
+    case MEMBER_PRIMARY:
+        if entry.CSN != UNCOMMITTED_CSN {
+            server.applyDesignation(entry)
+        }
+    }
+}
+
+/* Adds the servers of the provided member list that this   *
+ * server has not heard of yet, and (committed) retirements *
+ * Servers the list dropped are only dropped by dropMembers */
+func (server *BayouServer) mergeMembers(members []Member) {
+    server.growMembers(len(members))
+    for id, member := range members {
+        if server.members[id].Address == "" && !server.members[id].Dropped {
+            server.members[id].Address = member.Address
+        }
+        if member.Retired {
+            server.members[id].Retired = true
+        }
+        if server.members[id].RetiredCSN == UNCOMMITTED_CSN {
+            server.members[id].RetiredCSN = member.RetiredCSN
+        }
+    }
+}
+
+/* Ensures this server knows of at least the provided number *
+ * of servers, growing its per-server state and clocks       */
+func (server *BayouServer) growMembers(numMembers int) {
+    for len(server.members) < numMembers {
+        server.members = append(server.members, Member{})
+    }
+    for len(server.peers) < numMembers {
+        server.peers = append(server.peers, nil)
+    }
+    for len(server.Omitted) < numMembers {
+        server.Omitted = append(server.Omitted, server.omitClock.Copy())
+    }
+    for len(server.acked) < numMembers {
+        server.acked = append(server.acked, server.memberClock())
+    }
+    server.commitClock.Max(server.memberClock())
+    server.tentativeClock.Max(server.memberClock())
+}
+
+/* Returns a vector clock with a zero logical time for *
+ * each server this server knows of and did not drop   */
+func (server *BayouServer) memberClock() VectorClock {
+    vc := NewVectorClock(0)
+    for id, member := range server.members {
+        if !member.Dropped {
+            vc[id] = 0
+        }
+    }
+    return vc
+}
+
+/* Returns the IDs of the servers this server dropped */
+func (server *BayouServer) droppedIDs() map[int]bool {
+    return droppedMembers(server.members)
+}
+
+/* Returns the IDs of the dropped servers of the member list */
+func droppedMembers(members []Member) map[int]bool {
+    dropped := make(map[int]bool)
+    for id, member := range members {
+        if member.Dropped {
+            dropped[id] = true
+        }
+    }
+    return dropped
+}
+
+/* Drops the provided retired servers from this server's clocks    *
+ * and per-server state. Retired servers accept no more writes, so *
+ * once every server committed a server's retirement (and so every *
+ * write it accepted), its logical time no longer tells clocks     *
+ * apart, and is left out of them. Servers send the servers they   *
+ * dropped along with their logs, so that both sides of a clock    *
+ * comparison dropped the same servers. Commits through the        *
+ * retirements are truncated first, so no log entry stamped by     *
+ * a dropped server is kept                                        *
+ * Returns an error (dropping no server) if this server has not    *
+ * committed the retirement of one of the servers yet              *
+ * Must be called while holding logLock                            */
+func (server *BayouServer) dropMembers(serverIDs map[int]bool) error {
+    truncateCSN := server.omitCSN
+    newlyDropped := make([]int, 0)
+    for id, _ := range serverIDs {
+        // A retiring server keeps its own entries until it is killed
+        if id == server.id {
+            continue
+        }
+        if id >= len(server.members) || !server.members[id].Retired ||
+                server.members[id].RetiredCSN == UNCOMMITTED_CSN ||
+                server.members[id].RetiredCSN > server.lastCSN() {
+            return errors.New(fmt.Sprintf("Server #%d has not committed " +
+                    "the retirement of server %d", server.id, id))
+        }
+        if server.members[id].Dropped {
+            continue
+        }
+        newlyDropped = append(newlyDropped, id)
+        if server.members[id].RetiredCSN > truncateCSN {
+            truncateCSN = server.members[id].RetiredCSN
+        }
+    }
+    if len(newlyDropped) == 0 {
+        return nil
+    }
+
+    truncateLength := 0
+    for truncateLength < len(server.CommitLog) &&
+            server.CommitLog[truncateLength].CSN <= truncateCSN {
+        truncateLength++
+    }
+    if truncateLength > 0 {
+        server.truncateTo(truncateLength)
+    }
+
+    for _, id := range newlyDropped {
+        member := &server.members[id]
+        member.Dropped = true
+        member.Address = ""
+        if server.peers[id] != nil {
+            server.peers[id].Close()
+            server.peers[id] = nil
+        }
+        server.Omitted[id] = nil
+        server.acked[id] = nil
+        debugf("Server #%d dropped retired server %d", server.id, id)
+    }
+    server.projectClocks()
+    server.checkpoint()
+    return nil
+}
+
+/* Leaves the dropped servers out of this server's clocks, and  *
+ * out of the stamps of the writes in its logs (which are       *
+ * copied, since arguments sent to peers may share the entries) */
+func (server *BayouServer) projectClocks() {
+    dropped := server.droppedIDs()
+    if len(dropped) == 0 {
+        return
+    }
+    server.commitClock = server.commitClock.without(dropped)
+    server.tentativeClock = server.tentativeClock.without(dropped)
+    server.omitClock = server.omitClock.without(dropped)
+    server.omitAcceptClock = server.omitAcceptClock.without(dropped)
+    for peerID, _ := range server.members {
+        if server.Omitted[peerID] != nil {
+            server.Omitted[peerID] = server.Omitted[peerID].without(dropped)
+        }
+        if server.acked[peerID] != nil {
+            server.acked[peerID] = server.acked[peerID].without(dropped)
+        }
+    }
+    server.CommitLog = projectEntries(server.CommitLog, dropped)
+    server.TentativeLog = projectEntries(server.TentativeLog, dropped)
+    server.UndoLog = projectEntries(server.UndoLog, dropped)
+    server.ErrorLog = projectEntries(server.ErrorLog, dropped)
+}
+
+/* Returns a copy of the log entries, whose timestamps and *
+ * accept stamps leave out the provided servers            */
+func projectEntries(log []LogEntry, serverIDs map[int]bool) []LogEntry {
+    projected := make([]LogEntry, len(log))
+    for idx, entry := range log {
+        entry.Timestamp = entry.Timestamp.without(serverIDs)
+        entry.AcceptStamp = entry.AcceptStamp.without(serverIDs)
+        projected[idx] = entry
+    }
+    return projected
+}
+
+/* Leaves the provided servers out of the sender's log and clocks */
+func (args *AntiEntropyArgs) project(serverIDs map[int]bool) {
+    args.CommitSet = projectEntries(args.CommitSet, serverIDs)
+    args.TentativeSet = projectEntries(args.TentativeSet, serverIDs)
+    args.UndoSet = projectEntries(args.UndoSet, serverIDs)
+    args.OmitTimestamp = args.OmitTimestamp.without(serverIDs)
+    args.CommitClock = args.CommitClock.without(serverIDs)
+    args.OmitClock = args.OmitClock.without(serverIDs)
+    args.TentativeClock = args.TentativeClock.without(serverIDs)
+    args.ViewClock = args.ViewClock.without(serverIDs)
+}
+
+/* Leaves the provided servers out of the receiver's log and clocks */
+func (reply *AntiEntropyReply) project(serverIDs map[int]bool) {
+    reply.CommitSet = projectEntries(reply.CommitSet, serverIDs)
+    reply.TentativeSet = projectEntries(reply.TentativeSet, serverIDs)
+    reply.UndoSet = projectEntries(reply.UndoSet, serverIDs)
+    reply.OmitTimestamp = reply.OmitTimestamp.without(serverIDs)
+    reply.OmitClock = reply.OmitClock.without(serverIDs)
+}
+
+/* Returns the RPC client for the provided server, connecting *
+ * to it first if necessary (nil if it cannot be reached)     *
+ * Must be called while holding logLock, which is held while  *
+ * connecting                                                 */
+func (server *BayouServer) getPeer(peerID int) *rpc.Client {
+    return server.connectPeer(peerID, true)
+}
+
+/* Returns the RPC client for the provided server like getPeer, *
+ * releasing logLock while connecting (unless holdLock is set)  *
+ * Returns nil if the server was killed in the meantime         *
+ * Must be called while holding logLock                         */
+func (server *BayouServer) connectPeer(peerID int,
+        holdLock bool) *rpc.Client {
+    server.growMembers(peerID + 1)
+    address := server.members[peerID].Address
+    if server.peers[peerID] != nil || address == "" {
+        return server.peers[peerID]
+    }
+
+    if !holdLock {
+        server.logLock.Unlock()
+    }
+    client, err := dialPeer(address)
+    if !holdLock {
+        server.logLock.Lock()
+    }
+    if err != nil {
+        debugf("Server #%d failed to connect to %d: %s", server.id,
+                peerID, err.Error())
+        return nil
+    }
+
+    // The server may have been killed, or connected to the
+    // peer from another goroutine, while logLock was released
+    if !server.isActive {
+        client.Close()
+        return nil
+    }
+    if server.peers[peerID] != nil {
+        client.Close()
+        return server.peers[peerID]
+    }
+    server.peers[peerID] = client
+    return client
+}
+
+/* Connects to the RPC server at the provided address like *
+ * rpc.DialHTTP, but fails if the peer does not accept the *
+ * connection and reply within the peer timeout            */
+func dialPeer(address string) (*rpc.Client, error) {
+    timeout := peerTimeout()
+    conn, err := net.DialTimeout("tcp", address, timeout)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(timeout))
+
+    io.WriteString(conn, "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n\n")
+    response, err := http.ReadResponse(bufio.NewReader(conn),
+            &http.Request{Method: "CONNECT"})
+    if err == nil && response.Status != RPC_CONNECTED {
+        err = errors.New(fmt.Sprintf("Unexpected HTTP response: %s",
+                response.Status))
+    }
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    conn.SetDeadline(time.Time{})
+    return rpc.NewClient(conn), nil
+}
+
+/* Returns the IDs of the other servers that have not *
+ * retired, and that this server can connect to       */
+func (server *BayouServer) activePeers() []int {
+    peerIDs := make([]int, 0)
+    for peerID, member := range server.members {
+        if peerID == server.id || member.Retired {
+            continue
+        }
+        if server.peers[peerID] != nil || member.Address != "" {
+            peerIDs = append(peerIDs, peerID)
+        }
+    }
+    return peerIDs
+}
+
+/* Returns the ID of a random active peer (or NO_PEER) */
+func (server *BayouServer) randomPeer() int {
+    peerIDs := server.activePeers()
+    if len(peerIDs) == 0 {
+        return NO_PEER
+    }
+    return peerIDs[randomIntn(len(peerIDs))]
+}
@@ -1,6 +1,8 @@
 package bayou
 
 import (
+    "context"
+    "fmt"
     "strconv"
     "testing"
     "time"
@@ -28,7 +30,8 @@ func TestWritePerformance(t *testing.T) {
         n := 50 * (2 << uint(i))
         start := time.Now()
         for j := 0; j < n; j++ {
-            clients[i].ClaimRoom("R" + strconv.Itoa(j), 1, 1)
+            clients[i].ClaimRoom(context.Background(),
+                    "R" + strconv.Itoa(j), 1, 1)
         }
         elapsed := time.Since(start)
         Log.Printf("Primary, %d took %s\n", n, elapsed)
@@ -39,9 +42,72 @@ func TestWritePerformance(t *testing.T) {
         n := 50 * (2 << uint(i))
         start := time.Now()
         for j := 0; j < n; j++ {
-            clients[5 + i].ClaimRoom("R" + strconv.Itoa(j), 1, 1)
+            clients[5 + i].ClaimRoom(context.Background(),
+                    "R" + strconv.Itoa(j), 1, 1)
         }
         elapsed := time.Since(start)
         Log.Printf("Not Primary, %d took %s\n", n, elapsed)
     }
 }
+
+/* Benchmarks rolling back the full view by undoing each tentative *
+ * write, and by rebuilding it from the commit view, as the number *
+ * of committed and tentative writes grows                         */
+func BenchmarkRollback(b *testing.B) {
+    modeNames := map[RollbackMode]string{ROLLBACK_UNDO: "Undo",
+            ROLLBACK_REBUILD: "Rebuild"}
+    for _, numWrites := range []int{100, 1000} {
+        for _, mode := range []RollbackMode{ROLLBACK_UNDO, ROLLBACK_REBUILD} {
+            name := fmt.Sprintf("%s/%d", modeNames[mode], numWrites)
+            b.Run(name, func(b *testing.B) {
+                benchmarkRollback(b, mode, numWrites)
+            })
+        }
+    }
+}
+
+/* Benchmarks rolling back the provided number of tentative writes *
+ * (made after as many commits) using the provided rollback mode   */
+func benchmarkRollback(b *testing.B, mode RollbackMode, numWrites int) {
+    serverPorts := []int{1146}
+    servers, clients := createNetwork("bench_rollback", serverPorts,
+            serverPorts)
+    defer removeNetwork(servers, clients)
+    server := servers[0]
+    server.RollbackMode = mode
+
+    write := func(i int) {
+        room := Room{fmt.Sprintf("BRB%d", i), createDate(i % 28, 0),
+                createDate(i % 28, 1)}
+        writeArgs := getRoomWriteArgs(i, room, getBoolQuery(true),
+                getBoolQuery(false))
+        var writeReply WriteReply
+        err := server.Write(writeArgs, &writeReply)
+        if err != nil {
+            b.Fatal(err)
+        }
+    }
+    server.IsPrimary = true
+    for i := 0; i < numWrites; i++ {
+        write(i)
+    }
+    server.IsPrimary = false
+    for i := numWrites; i < 2 * numWrites; i++ {
+        write(i)
+    }
+
+    // The rolled back writes are re-executed between rollbacks
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+    tentativeSet := make([]LogEntry, len(server.TentativeLog))
+    copy(tentativeSet, server.TentativeLog)
+    undoSet := make([]LogEntry, len(server.UndoLog))
+    copy(undoSet, server.UndoLog)
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        server.rollbackDB(0)
+        b.StopTimer()
+        server.matchLog(nil, tentativeSet, undoSet)
+        b.StartTimer()
+    }
+}
@@ -5,21 +5,111 @@ import (
     "fmt"
     "io/ioutil"
     "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
 )
 
-const PERSIST_FILE_PREFIX string = "/tmp/bayou-data."
+/* Prefix of the names of a server's persist files, *
+ * which are followed by the server's ID            */
+const PERSIST_FILE_PREFIX string = "bayou-data."
 const FILE_NOT_FOUND_ERROR string = "File does not exist"
 
-/* Saves provided data to disk under the provided id */
-func save(data []byte, id int) {
-     filePath := PERSIST_FILE_PREFIX + fmt.Sprintf("%d", id)
-     err := ioutil.WriteFile(filePath, data, 0644)
-     check(err, "Error writing to file: ")
+/* Infix between the persist file path and WAL segment numbers */
+const WAL_SEGMENT_INFIX string = ".wal."
+
+/* Suffixes of a server's lock file, and of temporary *
+ * files written before replacing a persist file      */
+const LOCK_FILE_SUFFIX string = ".lock"
+const TMP_FILE_SUFFIX string = ".tmp"
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Directory holding a server's persist files. The server holds *
+ * an exclusive lock on its lock file while the store is open,  *
+ * so no other process opens the same server's state            */
+type PersistStore struct {
+    dir  string
+    id   int
+    lock *os.File
+}
+
+/*****************************
+ *   PERSIST STORE METHODS   *
+ *****************************/
+
+/* Opens the persist files of the provided server in the provided  *
+ * directory (creating it if necessary), and locks them. Returns an *
+ * error if another process (or server) already opened them         */
+func OpenPersistStore(dir string, id int) (*PersistStore, error) {
+    err := os.MkdirAll(dir, os.ModePerm)
+    if err != nil {
+        return nil, err
+    }
+
+    store := &PersistStore{dir, id, nil}
+    lock, err := os.OpenFile(store.path() + LOCK_FILE_SUFFIX,
+            os.O_RDWR | os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+    if err != nil {
+        lock.Close()
+        return nil, errors.New(fmt.Sprintf("Data of server #%d in %s is " +
+                "already in use: %s", id, dir, err.Error()))
+    }
+    store.lock = lock
+    return store, nil
+}
+
+/* Releases the lock on the persist files */
+func (store *PersistStore) Close() {
+    if store.lock == nil {
+        return
+    }
+    syscall.Flock(int(store.lock.Fd()), syscall.LOCK_UN)
+    store.lock.Close()
+    store.lock = nil
+}
+
+/* Saves provided data to disk                                      *
+ * The data is written to a temporary file, synced, and renamed     *
+ * over the old data (syncing the directory to make the rename      *
+ * durable), so a crash never leaves partially saved data           *
+ * Returns an error (leaving the old data) if it cannot be saved    */
+func (store *PersistStore) save(data []byte) error {
+     filePath := store.path()
+     tmpPath := filePath + TMP_FILE_SUFFIX
+     file, err := os.OpenFile(tmpPath,
+             os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+     if err != nil {
+         return errors.New("Error writing to file: " + err.Error())
+     }
+     _, err = file.Write(data)
+     if err == nil {
+         err = file.Sync()
+     }
+     closeErr := file.Close()
+     if err == nil {
+         err = closeErr
+     }
+     if err == nil {
+         err = os.Rename(tmpPath, filePath)
+     }
+     if err != nil {
+         return errors.New("Error writing to file: " + err.Error())
+     }
+     return store.syncDir()
 }
 
-/* Loads saved data for the provided id from disk */
-func load(id int) ([]byte, error) {
-     filePath := PERSIST_FILE_PREFIX + fmt.Sprintf("%d", id)
+/* Loads saved data from disk */
+func (store *PersistStore) load() ([]byte, error) {
+     filePath := store.path()
      if !fileExists(filePath) {
          return nil, errors.New(FILE_NOT_FOUND_ERROR)
      }
@@ -27,11 +117,78 @@ func load(id int) ([]byte, error) {
      return dat, err
 }
 
-/* Deletes saved data for the provided id from disk */
-func DeletePersist(id int) {
-    filePath := PERSIST_FILE_PREFIX + fmt.Sprintf("%d", id)
-    if fileExists(filePath) {
-        err := os.Remove(filePath)
-        check(err, "Error deleting persistent file: ")
+/* Syncs the directory, so that files created, renamed, or *
+ * deleted in it remain so after a crash                   */
+func (store *PersistStore) syncDir() error {
+    dir, err := os.Open(store.dir)
+    if err != nil {
+        return errors.New("Error opening data directory: " + err.Error())
+    }
+    defer dir.Close()
+    err = dir.Sync()
+    if err != nil {
+        return errors.New("Error syncing data directory: " + err.Error())
+    }
+    return nil
+}
+
+/* Returns the path of the server's persist file, *
+ * which other persist files' paths start with    */
+func (store *PersistStore) path() string {
+    return persistPath(store.dir, store.id)
+}
+
+/* Returns the path of the provided WAL segment */
+func (store *PersistStore) segmentPath(segment int) string {
+    return store.path() + WAL_SEGMENT_INFIX + fmt.Sprintf("%d", segment)
+}
+
+/* Returns the numbers of all WAL segments, in increasing order */
+func (store *PersistStore) listSegments() []int {
+    return listSegments(store.dir, store.id)
+}
+
+/*************************
+ *   PERSIST UTILITIES   *
+ *************************/
+
+/* Deletes saved data (and WAL segments) of the provided *
+ * server from the provided directory                    */
+func DeletePersist(dir string, id int) {
+    filePath := persistPath(dir, id)
+    paths := []string{filePath, filePath + TMP_FILE_SUFFIX,
+            filePath + LOCK_FILE_SUFFIX}
+    for _, segment := range listSegments(dir, id) {
+        paths = append(paths, filePath + WAL_SEGMENT_INFIX +
+                fmt.Sprintf("%d", segment))
+    }
+    for _, path := range paths {
+        if fileExists(path) {
+            err := os.Remove(path)
+            check(err, "Error deleting persistent file: ")
+        }
+    }
+}
+
+/* Returns the path of the provided server's persist file */
+func persistPath(dir string, id int) string {
+    return filepath.Join(dir, PERSIST_FILE_PREFIX + fmt.Sprintf("%d", id))
+}
+
+/* Returns the numbers of all WAL segments saved for the *
+ * provided server, in increasing order                   */
+func listSegments(dir string, id int) []int {
+    prefix := persistPath(dir, id) + WAL_SEGMENT_INFIX
+    paths, err := filepath.Glob(prefix + "*")
+    check(err, "Error listing WAL segments: ")
+
+    segments := make([]int, 0)
+    for _, path := range paths {
+        segment, err := strconv.Atoi(strings.TrimPrefix(path, prefix))
+        if err == nil {
+            segments = append(segments, segment)
+        }
     }
+    sort.Ints(segments)
+    return segments
 }
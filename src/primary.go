@@ -0,0 +1,349 @@
+package bayou
+
+import (
+    "errors"
+    "fmt"
+)
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Epoch of a primary: each committed designation of a new *
+ * primary starts a new epoch, with a higher number. The   *
+ * primary the network was created with has epoch zero     */
+type Epoch struct {
+    Number    int
+    // Designated primary (NO_PEER for the initial primary)
+    PrimaryID int
+    // CSN of the designation (UNCOMMITTED_CSN for epoch zero)
+    StartCSN  int
+}
+
+/* PromiseEpoch RPC arguments structure */
+type PromiseArgs struct {
+    // Server taking over primaryship, and the epoch it would start
+    CandidateID int
+    Number      int
+}
+
+/* PromiseEpoch RPC reply structure */
+type PromiseReply struct {
+    Granted bool
+}
+
+/**********************
+ *   EPOCH METHODS    *
+ **********************/
+
+/* Returns whether this epoch supersedes the other one. Epochs  *
+ * with the same number (which promises keep concurrent take    *
+ * overs from starting) are ordered by the ID of their primary  */
+func (epoch Epoch) NewerThan(other Epoch) bool {
+    if epoch.Number != other.Number {
+        return epoch.Number > other.Number
+    }
+    return epoch.PrimaryID > other.PrimaryID
+}
+
+/* Returns whether a server in the provided epoch, whose latest   *
+ * commit has the provided CSN, has commits that conflict with a *
+ * newer epoch (i.e. commits made by a primary that was replaced) */
+func hasStaleCommits(epoch Epoch, lastCSN int, other Epoch) bool {
+    return other.NewerThan(epoch) && lastCSN >= other.StartCSN
+}
+
+/* Returns whether the provided commit was made by a primary *
+ * after this epoch replaced it                              */
+func (epoch Epoch) replaced(entry LogEntry) bool {
+    return entry.Epoch < epoch.Number && entry.CSN >= epoch.StartCSN
+}
+
+/* Returns the provided commits that were made by a primary after *
+ * the provided epoch replaced it, as tentative writes (and their *
+ * undo entries)                                                  */
+func staleWrites(commits []LogEntry, epoch Epoch) ([]LogEntry,
+        []LogEntry) {
+    tentativeSet := make([]LogEntry, 0)
+    undoSet := make([]LogEntry, 0)
+    for _, entry := range commits {
+        if epoch.replaced(entry) {
+            tentEntry, undoEntry := uncommit(entry)
+            tentativeSet = append(tentativeSet, tentEntry)
+            undoSet = append(undoSet, undoEntry)
+        }
+    }
+    return tentativeSet, undoSet
+}
+
+/* Returns the provided commit as a tentative write, so it is  *
+ * committed again rather than lost, and an undo entry for it  *
+ * Its undo query is not kept in the commit, so the write is   *
+ * undone by reverting the changes captured when it is applied */
+func uncommit(entry LogEntry) (LogEntry, LogEntry) {
+    tentEntry := entry
+    tentEntry.Timestamp = entry.AcceptStamp.Copy()
+    tentEntry.CSN = UNCOMMITTED_CSN
+    tentEntry.Epoch = 0
+    undoEntry := NewLogEntry(entry.WriteID, entry.AcceptStamp, "",
+            getBoolQuery(true), getBoolQuery(false))
+    return tentEntry, undoEntry
+}
+
+/*******************************
+ *   PRIMARY SERVER METHODS    *
+ *******************************/
+
+/* Hands off primaryship from this server (which must be the primary) *
+ * to the provided server: commits any tentative writes, commits the  *
+ * designation of the new primary (after which this server stops      *
+ * committing), and transfers the commit log to the new primary, so   *
+ * it starts committing at the next CSN. If the transfer fails, the   *
+ * new primary learns of its designation through anti-entropy         *
+ * logLock is released during the transfer: writes accepted meanwhile *
+ * are only tentative, since this server no longer commits            */
+func (server *BayouServer) HandOffPrimary(newPrimaryID int) error {
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    if !server.isActive {
+        return server.inactiveError()
+    }
+    if !server.IsPrimary {
+        return errors.New(fmt.Sprintf("Server #%d is not the primary, so " +
+                "it cannot hand off primaryship", server.id))
+    }
+    if !server.commits() {
+        return errors.New(fmt.Sprintf("Server #%d is not committing " +
+                "writes, so it cannot hand off primaryship", server.id))
+    }
+    if newPrimaryID == server.id || newPrimaryID < 0 ||
+            newPrimaryID >= len(server.members) ||
+            server.members[newPrimaryID].Retired {
+        return errors.New(fmt.Sprintf("Server #%d cannot hand off " +
+                "primaryship to unknown server %d", server.id, newPrimaryID))
+    }
+
+    server.commitTentativeWrites()
+    server.writeMembership(Membership{MEMBER_PRIMARY, newPrimaryID, "",
+            server.epoch.Number + 1})
+    debugf("Server #%d handed off primaryship to %d (epoch %d)", server.id,
+            newPrimaryID, server.epoch.Number)
+
+    if !server.exchangeWith(newPrimaryID, false) {
+        debugf("Server #%d failed to transfer its commit log to %d",
+                server.id, newPrimaryID)
+    }
+    return nil
+}
+
+/* PromiseEpoch RPC Handler                                  *
+ * Promises the provided epoch to a server taking over        *
+ * primaryship, unless this server knows of that epoch (or a  *
+ * later one), or promised it to another server. Once it has  *
+ * promised, the primary stops committing until a new epoch   *
+ * starts, so the candidate can collect all of its commits    */
+func (server *BayouServer) PromiseEpoch(args *PromiseArgs,
+        reply *PromiseReply) error {
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    // Server may have been killed while waiting for the lock
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    promised := server.promised
+    if args.Number <= server.epoch.Number || args.Number < promised.Number ||
+            (args.Number == promised.Number &&
+            args.CandidateID != promised.PrimaryID) {
+        debugf("Server #%d refused to promise epoch %d to %d", server.id,
+                args.Number, args.CandidateID)
+        reply.Granted = false
+        return nil
+    }
+    server.promise(Epoch{args.Number, args.CandidateID, UNCOMMITTED_CSN})
+    reply.Granted = true
+    return nil
+}
+
+/* Makes this server the primary, for when the primary has failed  *
+ * Only an administrator takes over primaryship (never the servers *
+ * themselves): a majority of the servers that have not retired    *
+ * must promise it a new epoch (which each promises to one server  *
+ * only), and this server collects their commits through           *
+ * anti-entropy (or those of the old primary, which stops          *
+ * committing once it promises), so it has every commit, before    *
+ * it commits its own designation. Commits the replaced primary    *
+ * made that were not collected are committed again by this        *
+ * server, once that primary learns of the new epoch. Returns an   *
+ * error if too few servers took part, in which case the servers   *
+ * that promised the epoch commit nothing until a take over        *
+ * succeeds, so it should be retried. logLock is released while    *
+ * waiting for each peer, so the take over also fails if this      *
+ * server's epoch or promise changes in the meantime               */
+func (server *BayouServer) TakeOverPrimary() error {
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    if !server.isActive {
+        return server.inactiveError()
+    }
+    if server.IsPrimary {
+        return errors.New(fmt.Sprintf("Server #%d is already the primary",
+                server.id))
+    }
+    if server.retiring {
+        return server.retiringError()
+    }
+
+    // Promise the new epoch to this server first, so that it
+    // promises no other server the same epoch
+    number := server.epoch.Number
+    if server.promised.Number > number {
+        number = server.promised.Number
+    }
+    number++
+    candidacy := Epoch{number, server.id, UNCOMMITTED_CSN}
+    server.promise(candidacy)
+
+    numPromised := 1
+    numCollected := 1
+    collectedPrimary := false
+    for _, peerID := range server.activePeers() {
+        if !server.requestPromise(peerID, number) {
+            continue
+        }
+        numPromised++
+
+        // Note: the first exchange may only resolve the omit timestamps
+        collected := false
+        for attempt := 0; attempt < 2 && !collected; attempt++ {
+            collected = server.exchangeWith(peerID, false)
+        }
+        if collected {
+            numCollected++
+            collectedPrimary = collectedPrimary ||
+                    peerID == server.epoch.PrimaryID
+        }
+    }
+
+    // logLock was released while waiting for each peer, in which
+    // time this server may have been killed, learned of a newer
+    // epoch, promised one to another server, or begun retiring
+    if !server.isActive {
+        return server.inactiveError()
+    }
+    if server.epoch.Number >= number {
+        return errors.New(fmt.Sprintf("Server #%d learned of epoch %d " +
+                "while taking over primaryship", server.id,
+                server.epoch.Number))
+    }
+    if server.promised != candidacy {
+        return errors.New(fmt.Sprintf("Server #%d promised epoch %d to %d " +
+                "while taking over primaryship", server.id,
+                server.promised.Number, server.promised.PrimaryID))
+    }
+    if server.retiring {
+        return server.retiringError()
+    }
+
+    // Servers may have joined or retired in the meantime
+    quorum := server.takeOverQuorum()
+    if numPromised < quorum || (numCollected < quorum && !collectedPrimary) {
+        return errors.New(fmt.Sprintf("Server #%d cannot take over " +
+                "primaryship: %d of %d servers promised epoch %d, and %d " +
+                "sent their commits", server.id, numPromised, quorum,
+                number, numCollected))
+    }
+
+    // Start the new epoch before writing the designation,
+    // so that this server commits the designation itself
+    server.startEpoch(Epoch{number, server.id, server.nextCSN()})
+    server.writeMembership(Membership{MEMBER_PRIMARY, server.id, "",
+            server.epoch.Number})
+    server.commitTentativeWrites()
+    debugf("Server #%d took over primaryship (epoch %d)", server.id,
+            server.epoch.Number)
+    return nil
+}
+
+/* Applies a committed designation of a primary, unless *
+ * this server already knows of a newer epoch           */
+func (server *BayouServer) applyDesignation(entry LogEntry) {
+    epoch := Epoch{entry.Membership.Epoch, entry.Membership.ServerID,
+            entry.CSN}
+    if !server.epoch.NewerThan(epoch) {
+        server.startEpoch(epoch)
+    }
+}
+
+/* Adopts the provided epoch, becoming the primary *
+ * if and only if it designates this server        */
+func (server *BayouServer) startEpoch(epoch Epoch) {
+    server.epoch = epoch
+    server.IsPrimary = epoch.PrimaryID == server.id
+}
+
+/* Returns whether this server commits the writes it receives: if *
+ * it is the primary, is not recovering lost commits, and did not  *
+ * promise a newer epoch to a server taking over primaryship       */
+func (server *BayouServer) commits() bool {
+    return server.IsPrimary && !server.recovering() &&
+            server.promised.Number <= server.epoch.Number
+}
+
+/* Records that this server promised the provided epoch *
+ * (whose primary is the server it was promised to)     */
+func (server *BayouServer) promise(epoch Epoch) {
+    if server.IsPrimary {
+        debugf("Server #%d stops committing, after promising epoch %d " +
+                "to %d", server.id, epoch.Number, epoch.PrimaryID)
+    }
+    server.promised = epoch
+    server.persist(WALRecord{Rollback: NO_ROLLBACK,
+            State: server.persistState()})
+}
+
+/* Asks the provided peer to promise the provided epoch to this *
+ * server, returning whether it did                             *
+ * Must be called while holding logLock, which is released      *
+ * while connecting to the peer and waiting for its reply       */
+func (server *BayouServer) requestPromise(peerID int, number int) bool {
+    peer := server.connectPeer(peerID, false)
+    if peer == nil {
+        return false
+    }
+    args := PromiseArgs{server.id, number}
+    var reply PromiseReply
+    err := server.callPeerLocked(peer, peerID, "BayouServer.PromiseEpoch",
+            &args, &reply, false)
+    if err != nil {
+        debugf("PromiseEpoch %d => %d Failed: %s", server.id, peerID,
+                err.Error())
+        return false
+    }
+    return reply.Granted
+}
+
+/* Returns the number of servers (counting this one) that must *
+ * take part in a take over: a majority of the servers that    *
+ * have not retired                                            */
+func (server *BayouServer) takeOverQuorum() int {
+    numMembers := 0
+    for _, member := range server.members {
+        if !member.Retired {
+            numMembers++
+        }
+    }
+    return numMembers / 2 + 1
+}
+
+/* Returns the CSN of this server's latest commit */
+func (server *BayouServer) lastCSN() int {
+    return server.nextCSN() - 1
+}
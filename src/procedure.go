@@ -0,0 +1,220 @@
+package bayou
+
+import (
+    "errors"
+    "sync"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Names of the savepoints procedures run after, so *
+ * their writes can be discarded on their own       */
+const CHECK_SAVEPOINT string = "bayou_check"
+const MERGE_SAVEPOINT string = "bayou_merge"
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* A named Go procedure used as a write's dependency check or *
+ * merge procedure. It is run inside a transaction on the     *
+ * database the write is applied to, with the write's         *
+ * procedure arguments, and returns whether the check passed  *
+ * (or the conflict was resolved), or an error if its queries *
+ * failed. Since every replica runs it, a procedure must be   *
+ * deterministic: its result and any writes it performs may   *
+ * only depend on its arguments and the database's contents   */
+type Procedure func(tx *BayouTx, args []interface{}) (bool, error)
+
+/* Registered procedures, by name                    *
+ * Note: initialized at declaration (rather than in  *
+ * init) so that other files' init may register      */
+var procedures = make(map[string]Procedure)
+
+/* Guards the procedure registry */
+var procedureLock = &sync.Mutex{}
+
+/****************************
+ *   PROCEDURE REGISTRY     *
+ ****************************/
+
+/* Registers a procedure under the provided name, so log *
+ * entries can reference it. Every replica must register *
+ * the same procedures before applying any writes        */
+func RegisterProcedure(name string, proc Procedure) {
+    procedureLock.Lock()
+    defer procedureLock.Unlock()
+    if _, exists := procedures[name]; exists {
+        Log.Fatal("Procedure registered twice: " + name)
+    }
+    procedures[name] = proc
+}
+
+/* Returns the procedure registered under the provided name */
+func getProcedure(name string) (Procedure, error) {
+    procedureLock.Lock()
+    defer procedureLock.Unlock()
+    proc, exists := procedures[name]
+    if !exists {
+        return nil, errors.New("No procedure registered as: " + name)
+    }
+    return proc, nil
+}
+
+/**********************************
+ *   DATABASE PROCEDURE METHODS   *
+ **********************************/
+
+/* Applies the write to the database within a single transaction, *
+ * which also records the provided index as the position the      *
+ * database then reflects, and (if the database captures undos)   *
+ * the undo of the write's changes. If any of the write's         *
+ * statements fail, none of them (nor the index) take effect      */
+func (db *BayouDB) applyEntry(entry *LogEntry,
+        applied AppliedIndex) (hasConflict bool, resolved bool, err error) {
+    tx, err := db.BeginTx()
+    if err != nil {
+        return false, false, err
+    }
+    schema := db.undoSchema
+    if db.capturesUndo {
+        schema, err = tx.startUndoCapture(schema)
+    }
+    if err == nil {
+        hasConflict, resolved, err = tx.applyEntry(entry)
+    }
+
+    // The undo is only kept for writes added to the applied writes
+    // (undos and commits are captured too, but never undone)
+    undo, captured := "", false
+    if err == nil && db.capturesUndo {
+        undo, captured, err = tx.takeUndo(schema)
+    }
+    // Undoing a migration's changes would not revert the schema version
+    if entry.Migration != NO_MIGRATION {
+        captured = false
+    }
+    if err == nil {
+        err = tx.saveApplied(db.applied, applied)
+    }
+    if err == nil && db.capturesUndo &&
+            len(applied.Writes) > len(db.applied.Writes) {
+        err = tx.saveUndo(undo, captured)
+    }
+    if err != nil {
+        tx.Rollback()
+        return hasConflict, resolved, err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return hasConflict, resolved, queryError(err,
+                "Error committing write: ")
+    }
+    db.applied = applied
+    db.undoSchema = schema
+    return hasConflict, resolved, nil
+}
+
+/*************************************
+ *   TRANSACTION PROCEDURE METHODS   *
+ *************************************/
+
+/* Applies the write within the transaction: if there are no *
+ * dependency conflicts, applies its query, else tries its    *
+ * alternate writes, then its merge. Records which alternate  *
+ * (if any) was applied, and returns whether there was a      *
+ * conflict, and if so, whether it was resolved. Migrations   *
+ * are applied without checking dependencies                  */
+func (tx *BayouTx) applyEntry(entry *LogEntry) (hasConflict bool,
+        resolved bool, err error) {
+    if entry.Migration != NO_MIGRATION {
+        return false, true, tx.applyMigration(*entry)
+    }
+
+    passed, err := tx.checkDependencies(*entry)
+    if err != nil {
+        return false, false, err
+    }
+    if passed {
+        return false, true, tx.Execute(entry.Query, entry.QueryArgs...)
+    }
+
+    entry.Alternate, err = tx.applyAlternate(*entry)
+    if err != nil || entry.Alternate != NO_ALTERNATE {
+        return true, err == nil, err
+    }
+    resolved, err = tx.merge(*entry)
+    return true, resolved, err
+}
+
+/* Returns whether the write's dependency check passes, *
+ * using its check procedure if it has one, else its    *
+ * check query                                          */
+func (tx *BayouTx) checkDependencies(entry LogEntry) (bool, error) {
+    if entry.CheckProc == "" {
+        return tx.Check(entry.Check, entry.CheckArgs...)
+    }
+    proc, err := getProcedure(entry.CheckProc)
+    if err != nil {
+        return false, err
+    }
+
+    // Dependency checks may not change the database, so
+    // always rollback to before the procedure ran
+    err = tx.savepoint(CHECK_SAVEPOINT)
+    if err != nil {
+        return false, err
+    }
+    passed, err := proc(tx, entry.ProcArgs)
+    rollbackErr := tx.rollbackTo(CHECK_SAVEPOINT)
+    if err == nil {
+        err = rollbackErr
+    }
+    return passed, err
+}
+
+/* Applies the first of the write's alternate writes whose *
+ * dependency check passes, returning its index (or        *
+ * NO_ALTERNATE if none of them could be applied)          */
+func (tx *BayouTx) applyAlternate(entry LogEntry) (int, error) {
+    for idx, alternate := range entry.Alternates {
+        passed, err := tx.Check(alternate.Check, alternate.CheckArgs...)
+        if err != nil {
+            return NO_ALTERNATE, err
+        }
+        if passed {
+            return idx, tx.Execute(alternate.Query, alternate.QueryArgs...)
+        }
+    }
+    return NO_ALTERNATE, nil
+}
+
+/* Attempts to resolve the write's conflict, using its merge *
+ * procedure if it has one, else its merge query. Returns    *
+ * whether the conflict was resolved. A merge procedure's    *
+ * writes are only kept if it resolves the conflict          */
+func (tx *BayouTx) merge(entry LogEntry) (bool, error) {
+    if entry.MergeProc == "" {
+        return tx.Check(entry.Merge, entry.MergeArgs...)
+    }
+    proc, err := getProcedure(entry.MergeProc)
+    if err != nil {
+        return false, err
+    }
+
+    err = tx.savepoint(MERGE_SAVEPOINT)
+    if err != nil {
+        return false, err
+    }
+    resolved, err := proc(tx, entry.ProcArgs)
+    if err != nil || !resolved {
+        rollbackErr := tx.rollbackTo(MERGE_SAVEPOINT)
+        if err == nil {
+            err = rollbackErr
+        }
+        return false, err
+    }
+    return true, tx.release(MERGE_SAVEPOINT)
+}
@@ -0,0 +1,243 @@
+package bayou
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "time"
+    "github.com/mattn/go-sqlite3"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Key of the struct tags naming the column a field is scanned from *
+ * (e.g. `bayou:"StartTime"`), or "-" if it is never scanned        */
+const RESULT_FIELD_TAG string = "bayou"
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Typed result of a read query, as sent to clients: its columns,    *
+ * and each row's values, which are normalized to nil, int64,        *
+ * float64, string, []byte, or time.Time (whatever the SQLite driver *
+ * returned), so they can be decoded the same way on every client    */
+type ResultSet struct {
+    Columns []ResultColumn
+    Rows    [][]interface{}
+}
+
+/* Column of a read result: its name, and the type it was *
+ * declared with (empty if it is not a table's column,    *
+ * e.g. an expression)                                    */
+type ResultColumn struct {
+    Name string
+    Type string
+}
+
+/**************************
+ *   RESULT SET METHODS   *
+ **************************/
+
+/* Decodes the result's rows into the slice of structs (or pointers *
+ * to structs) that dest points to, replacing its contents. Each    *
+ * column is decoded into the field tagged with its name, else the  *
+ * untagged field with its name (ignoring case), and columns with   *
+ * no such field are skipped. NULL values are decoded as zero       *
+ * values (or nil pointers)                                         */
+func (result ResultSet) Scan(dest interface{}) error {
+    destValue := reflect.ValueOf(dest)
+    if destValue.Kind() != reflect.Ptr ||
+            destValue.Elem().Kind() != reflect.Slice {
+        return errors.New(fmt.Sprintf("Cannot scan rows into %T, which " +
+                "is not a pointer to a slice", dest))
+    }
+    slice := destValue.Elem()
+    elemType := slice.Type().Elem()
+    structType := elemType
+    if structType.Kind() == reflect.Ptr {
+        structType = structType.Elem()
+    }
+    if structType.Kind() != reflect.Struct {
+        return errors.New(fmt.Sprintf("Cannot scan rows into %T, which " +
+                "is not a slice of structs", dest))
+    }
+
+    fields := make([][]int, len(result.Columns))
+    for idx, column := range result.Columns {
+        fields[idx] = findField(structType, column.Name)
+    }
+    rows := reflect.MakeSlice(slice.Type(), 0, len(result.Rows))
+    for _, row := range result.Rows {
+        elem := reflect.New(structType)
+        for idx, value := range row {
+            if fields[idx] == nil {
+                continue
+            }
+            err := scanValue(value, elem.Elem().FieldByIndex(fields[idx]))
+            if err != nil {
+                return errors.New(fmt.Sprintf("Error scanning column %s: " +
+                        "%s", result.Columns[idx].Name, err.Error()))
+            }
+        }
+        if elemType.Kind() == reflect.Ptr {
+            rows = reflect.Append(rows, elem)
+        } else {
+            rows = reflect.Append(rows, elem.Elem())
+        }
+    }
+    slice.Set(rows)
+    return nil
+}
+
+/* Returns the result's rows as maps from column names to values */
+func (result ResultSet) maps() ReadResult {
+    var rows ReadResult
+    for _, row := range result.Rows {
+        rowMap := make(map[string]interface{})
+        for idx, column := range result.Columns {
+            rowMap[column.Name] = row[idx]
+        }
+        rows = append(rows, rowMap)
+    }
+    return rows
+}
+
+/************************
+ *   RESULT UTILITIES   *
+ ************************/
+
+/* Returns the provided value, read from a column with the provided *
+ * declared type, as one of the types of ResultSet values: text the *
+ * driver read as bytes is converted to a string (following         *
+ * SQLite's type affinity rules), and booleans to integers          */
+func normalizeValue(value interface{}, declType string) interface{} {
+    switch typed := value.(type) {
+    case []byte:
+        declType = strings.ToUpper(declType)
+        if !strings.Contains(declType, "INT") &&
+                (strings.Contains(declType, "CHAR") ||
+                strings.Contains(declType, "CLOB") ||
+                strings.Contains(declType, "TEXT")) {
+            return string(typed)
+        }
+    case bool:
+        if typed {
+            return int64(1)
+        }
+        return int64(0)
+    case int:
+        return int64(typed)
+    case float32:
+        return float64(typed)
+    }
+    return value
+}
+
+/* Returns the index of the field of the provided struct type *
+ * that the column with the provided name is scanned into     *
+ * (nil if there is none)                                     */
+func findField(structType reflect.Type, column string) []int {
+    var untagged []int
+    for idx := 0; idx < structType.NumField(); idx++ {
+        field := structType.Field(idx)
+        if field.PkgPath != "" {
+            continue
+        }
+        tag := field.Tag.Get(RESULT_FIELD_TAG)
+        if tag == column {
+            return field.Index
+        }
+        if tag == "" && untagged == nil &&
+                strings.EqualFold(field.Name, column) {
+            untagged = field.Index
+        }
+    }
+    return untagged
+}
+
+/* Decodes the provided (normalized) value into the provided field, *
+ * converting it to the field's type if it has a different one      */
+func scanValue(value interface{}, field reflect.Value) error {
+    if value == nil {
+        field.Set(reflect.Zero(field.Type()))
+        return nil
+    }
+    if field.Kind() == reflect.Ptr {
+        elem := reflect.New(field.Type().Elem())
+        err := scanValue(value, elem.Elem())
+        if err == nil {
+            field.Set(elem)
+        }
+        return err
+    }
+    if reflect.TypeOf(value).AssignableTo(field.Type()) {
+        field.Set(reflect.ValueOf(value))
+        return nil
+    }
+
+    switch typed := value.(type) {
+    case string:
+        if field.Type() == reflect.TypeOf(time.Time{}) {
+            return scanTime(typed, field)
+        }
+        if field.Kind() == reflect.String {
+            field.SetString(typed)
+            return nil
+        }
+        if field.Type() == reflect.TypeOf([]byte{}) {
+            field.SetBytes([]byte(typed))
+            return nil
+        }
+    case []byte:
+        if field.Kind() == reflect.String {
+            field.SetString(string(typed))
+            return nil
+        }
+    case int64:
+        switch field.Kind() {
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+                reflect.Int64:
+            if !field.OverflowInt(typed) {
+                field.SetInt(typed)
+                return nil
+            }
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+                reflect.Uint64:
+            if typed >= 0 && !field.OverflowUint(uint64(typed)) {
+                field.SetUint(uint64(typed))
+                return nil
+            }
+        case reflect.Float32, reflect.Float64:
+            field.SetFloat(float64(typed))
+            return nil
+        case reflect.Bool:
+            field.SetBool(typed != 0)
+            return nil
+        }
+    case float64:
+        if field.Kind() == reflect.Float32 || field.Kind() == reflect.Float64 {
+            field.SetFloat(typed)
+            return nil
+        }
+    }
+    return errors.New(fmt.Sprintf("cannot decode %T value %v into %s",
+            value, value, field.Type()))
+}
+
+/* Decodes the provided text (e.g. the result of SQLite's *
+ * dateTime function) into the provided time field        */
+func scanTime(text string, field reflect.Value) error {
+    for _, format := range sqlite3.SQLiteTimestampFormats {
+        parsed, err := time.ParseInLocation(format, text, time.UTC)
+        if err == nil {
+            field.Set(reflect.ValueOf(parsed))
+            return nil
+        }
+    }
+    return errors.New(fmt.Sprintf("cannot decode %q into %s", text,
+            field.Type()))
+}
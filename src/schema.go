@@ -0,0 +1,160 @@
+package bayou
+
+import (
+    "errors"
+    "fmt"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Migration version of log entries that are not migrations */
+const NO_MIGRATION int = 0
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Shape of an application's database, registered with each of its  *
+ * servers: the tables it starts with, and the migrations changing   *
+ * them since. Migrations are written to the log like any other      *
+ * write, so every replica migrates at the same point in the order   */
+type Schema struct {
+    // Statements creating the tables (at version 0)
+    Tables     string
+    // Migrations to each later version, in order
+    Migrations []Migration
+}
+
+/* Change to the schema of an application's database, *
+ * from the previous version to the provided one       */
+type Migration struct {
+    Version int
+    Query   string
+}
+
+/**********************
+ *   SCHEMA METHODS   *
+ **********************/
+
+/* Returns an error if the schema's migration versions *
+ * are not consecutive, starting at version 1           */
+func (schema Schema) validate() error {
+    for idx, migration := range schema.Migrations {
+        if migration.Version != idx + 1 {
+            return errors.New(fmt.Sprintf("Migration %d has version %d, " +
+                    "expected version %d", idx, migration.Version, idx + 1))
+        }
+    }
+    return nil
+}
+
+/*******************************
+ *   DATABASE SCHEMA METHODS   *
+ *******************************/
+
+/* Returns the version of the application's schema *
+ * the database reflects                           */
+func (db *BayouDB) SchemaVersion() (int, error) {
+    return schemaVersion(db)
+}
+
+/**********************************
+ *   TRANSACTION SCHEMA METHODS   *
+ **********************************/
+
+/* Creates the provided schema's tables within the transaction, *
+ * and records that the database is at its first version        */
+func (tx *BayouTx) createTables(schema Schema) error {
+    err := tx.Execute(schema.Tables)
+    if err != nil {
+        return err
+    }
+    return tx.setSchemaVersion(0)
+}
+
+/* Applies the provided migration write within the transaction,  *
+ * if the database is at the version before it. Migrations the   *
+ * database already reflects (e.g. the same migration, written   *
+ * by another server) have no effect                             */
+func (tx *BayouTx) applyMigration(entry LogEntry) error {
+    version, err := schemaVersion(tx)
+    if err != nil || version >= entry.Migration {
+        return err
+    }
+    if version != entry.Migration - 1 {
+        return errors.New(fmt.Sprintf("Cannot migrate schema from " +
+                "version %d to version %d", version, entry.Migration))
+    }
+    err = tx.Execute(entry.Query, entry.QueryArgs...)
+    if err != nil {
+        return err
+    }
+    return tx.setSchemaVersion(entry.Migration)
+}
+
+/* Records the provided schema version within the transaction   *
+ * Note: SQLite's user version is stored in the database header, *
+ * so it is rolled back (and copied) along with the tables       */
+func (tx *BayouTx) setSchemaVersion(version int) error {
+    return tx.Execute(fmt.Sprintf("PRAGMA user_version = %d", version))
+}
+
+/*****************************
+ *   SERVER SCHEMA METHODS   *
+ *****************************/
+
+/* Writes the registered migrations the full view has not applied *
+ * to the log. Migrations it lacks because they are only in the    *
+ * log of another server are written again, but only the first     *
+ * write of each version changes the schema. Returns an error if   *
+ * the full view's schema version cannot be read                   *
+ * Must be called while holding logLock                            */
+func (server *BayouServer) writeMigrations() error {
+    server.dbLock.Lock()
+    version, err := server.fullDB.SchemaVersion()
+    server.dbLock.Unlock()
+    if err != nil {
+        return queryError(err, "Error reading schema version: ")
+    }
+
+    for _, migration := range server.schema.Migrations {
+        if migration.Version > version {
+            server.writeMigration(migration)
+        }
+    }
+    return nil
+}
+
+/* Writes a migration to the log as this server *
+ * Must be called while holding logLock         */
+func (server *BayouServer) writeMigration(migration Migration) {
+    server.tentativeClock.Inc(server.id)
+    debugf("Server #%d migrating schema to version %d", server.id,
+            migration.Version)
+
+    // Migrations have no undo (the full view is rebuilt
+    // to roll them back), and are applied unconditionally
+    writeEntry := NewLogEntry(randomInt(), server.tentativeClock,
+            migration.Query, getBoolQuery(true), getBoolQuery(false))
+    writeEntry.Migration = migration.Version
+    writeEntry.HLC = server.hlc.Now()
+    undoEntry := NewLogEntry(writeEntry.WriteID, server.tentativeClock, "",
+            getBoolQuery(true), getBoolQuery(false))
+    server.applyWrite(writeEntry, undoEntry)
+}
+
+/************************
+ *   SCHEMA UTILITIES   *
+ ************************/
+
+/* Returns the schema version recorded in the *
+ * database or transaction                    */
+func schemaVersion(executor sqlExecutor) (int, error) {
+    result, err := read(executor, "PRAGMA user_version", nil)
+    if err != nil {
+        return NO_MIGRATION, err
+    }
+    return int(result[0]["user_version"].(int64)), nil
+}
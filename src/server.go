@@ -5,9 +5,11 @@ import (
     "encoding/gob"
     "errors"
     "fmt"
+    "io"
     "net"
     "net/http"
     "net/rpc"
+    "sort"
     "sync"
     "time"
 )
@@ -20,16 +22,47 @@ import (
  * between sending AntiEntropy RPCs */
 const ANTI_ENTROPY_TIMEOUT_MIN int = 150
 
+/* Commit sequence number of writes *
+ * that have not been committed yet */
+const UNCOMMITTED_CSN int = 0
+
+/* Index of the applied alternate write of a log *
+ * entry whose alternates were not applied       */
+const NO_ALTERNATE int = -1
+
+/* Default minimum number of acknowledged commits *
+ * before they are truncated from the commit log  */
+const TRUNCATION_THRESHOLD int = 64
+
+/* Errors RPC handlers reply when the server is not active, and *
+ * when it cannot meet a session's guarantees, which clients     *
+ * recognize by their text (the only part of them sent back)     */
+const INACTIVE_ERROR string = "is not active"
+const SESSION_ERROR string = "cannot meet session guarantees"
+
+/* Strategies for rolling back the full view */
+const (
+    // Undo the rolled back writes, in reverse order
+    ROLLBACK_UNDO RollbackMode = iota
+    // Copy the commit view, and reapply the writes that are kept
+    ROLLBACK_REBUILD
+)
+
 /************************
  *   TYPE DEFINITIONS   *
  ************************/
 
+/* How a server rolls back its full view */
+type RollbackMode int
+
 /* Go object representing a Bayou Server */
 type BayouServer struct {
     // Unique index into peers array
     id    int
     // Represents the other bayou servers
     peers []*rpc.Client
+    // All servers that joined the network, by ID
+    members []Member
 
     // Whether this server is active
     isActive bool
@@ -38,6 +71,8 @@ type BayouServer struct {
     commitDB *BayouDB
     // Holds all (committed and tentative) server state
     fullDB   *BayouDB
+    // Schema of the application's tables in both databases
+    schema   Schema
 
     // Listener for shutting down the RPC server
     rpcListener net.Listener
@@ -46,6 +81,9 @@ type BayouServer struct {
     commitClock    VectorClock
     // Timestamp of last tentative write
     tentativeClock VectorClock
+    // Stamps the writes this server accepts, after
+    // all the writes it has seen
+    hlc            *HybridClock
 
     // Inter-server Anti-Entropy timer
     antiEntropyTimer *time.Timer
@@ -55,8 +93,17 @@ type BayouServer struct {
     logLock     *sync.Mutex
     persistLock *sync.Mutex
 
-    // Whether this server is the primary
+    // Whether this server is the primary: set on a single server when
+    // creating the network, then only changed by committed designations
     IsPrimary bool
+    // Epoch of the latest committed designation of the primary
+    epoch     Epoch
+    // Latest epoch this server promised to a server taking over
+    // primaryship (which it promises to no other server)
+    promised  Epoch
+    // Whether this server is handing off its writes before retiring
+    // (meanwhile it accepts no writes, from clients or peers)
+    retiring  bool
 
     // Stores committed ops: lower timestamps closer to head
     CommitLog    []LogEntry
@@ -66,9 +113,37 @@ type BayouServer struct {
     UndoLog      []LogEntry
     // Operations that conflict and fail to merge are stored here
     ErrorLog     []LogEntry
+    // How the full view is rolled back before tentative writes are
+    // re-executed (undoing many writes may be slower than rebuilding)
+    RollbackMode RollbackMode
 
     // Maintains timestamp of latest commit agreed upon by each server
     Omitted []VectorClock
+
+    // Commits acknowledged by all peers are truncated from the commit
+    // log (and only reflected in the databases) once there are at
+    // least this many of them
+    TruncationThreshold int
+    // Timestamp of latest commit each server is known to have
+    acked           []VectorClock
+    // Timestamp and CSN of the last truncated commit
+    omitClock       VectorClock
+    omitCSN         int
+    // Covers the accept stamps of all truncated commits
+    omitAcceptClock VectorClock
+    // Peer to request a snapshot from (or NO_PEER), when this
+    // server is missing commits that peer already truncated
+    snapshotPeer    int
+    // CSN of the latest commit the views reflected that the log
+    // lost (if any), and the peers that sent this server their
+    // commits since it started (see recovering)
+    recoveryCSN     int
+    recoveredFrom   map[int]bool
+
+    // Persist files (locked while the server is alive), and
+    // write-ahead log of changes to the persistent state
+    store *PersistStore
+    wal   *WAL
 }
 
 /* Represents an entry in a Bayou server log */
@@ -78,6 +153,63 @@ type LogEntry struct {
     Query     string
     Check     string
     Merge     string
+    // Arguments bound to the placeholders of the Query, Check,
+    // and Merge queries (rather than being formatted into them)
+    QueryArgs []interface{}
+    CheckArgs []interface{}
+    MergeArgs []interface{}
+    // Position in the global commit order, assigned by the
+    // primary (UNCOMMITTED_CSN if the write is tentative)
+    CSN       int
+    // Timestamp assigned by the server that accepted the write
+    // (unlike Timestamp, it is kept when the write is committed)
+    AcceptStamp VectorClock
+    // Names of registered Go procedures used instead of the
+    // Check and Merge queries (if set), and their arguments
+    CheckProc string
+    MergeProc string
+    ProcArgs  []interface{}
+    // Alternative writes tried in order if the dependency check
+    // fails, and the index of the one applied to the database
+    // (NO_ALTERNATE if the write or none of them was applied)
+    Alternates []Alternate
+    Alternate  int
+    // Error that occurred applying the write (empty if none), in
+    // which case it had no effect on the database. Like Alternate,
+    // it is recorded each time the write is applied, so replicas
+    // applying the write to the same view agree on it
+    Error      string
+    // Whether the write (or an alternate write, or its merge)
+    // changed the database when it was last applied: writes whose
+    // conflicts were not resolved (or that failed) changed nothing
+    Resolved   bool
+    // Whether the write's merge resolved its conflict, in which
+    // case its own query (which its undo reverts) did not run
+    Merged     bool
+    // Change to the set of servers made by the write (if any)
+    Membership Membership
+    // Schema version the write migrates the database to
+    // (NO_MIGRATION if the write is not a migration)
+    Migration  int
+    // Epoch of the primary that committed the write
+    Epoch      int
+    // Hybrid logical clock stamp taken by the server that
+    // accepted the write, which orders tentative writes
+    HLC        HLCStamp
+}
+
+/* Alternative write applied in place of a log *
+ * entry's write if its dependency check fails *
+ * and the alternate's own check passes        */
+type Alternate struct {
+    Query string
+    // Optional, as is the write's own undo
+    Undo  string
+    Check string
+    // Arguments bound to the placeholders of each query
+    QueryArgs []interface{}
+    UndoArgs  []interface{}
+    CheckArgs []interface{}
 }
 
 /* AntiEntropy RPC arguments structure */
@@ -87,6 +219,22 @@ type AntiEntropyArgs struct {
     TentativeSet  []LogEntry
     UndoSet       []LogEntry
     OmitTimestamp VectorClock
+    // Sender's latest commit, and last truncated commit
+    CommitClock   VectorClock
+    OmitClock     VectorClock
+    // Sender's epoch, and the CSN of its latest commit
+    Epoch         Epoch
+    CommitCSN     int
+    // IDs of all of the sender's tentative writes, in order (the
+    // TentativeSet only holds those the receiver has not seen), and
+    // the timestamp of the last one (empty if there are none)
+    TentativeIDs   []int
+    TentativeClock VectorClock
+    // Sender's version vector: the receiver only replies the tentative
+    // writes it does not cover (or all of them, if it is empty)
+    ViewClock      VectorClock
+    // IDs of the retired servers the sender dropped from its clocks
+    Dropped        map[int]bool
 }
 
 /* AntiEntropy RPC reply structure */
@@ -96,6 +244,27 @@ type AntiEntropyReply struct {
     TentativeSet  []LogEntry
     UndoSet       []LogEntry
     OmitTimestamp VectorClock
+    // Receiver's last truncated commit, and epoch
+    OmitClock     VectorClock
+    Epoch         Epoch
+    // IDs of all of the receiver's tentative writes, in order
+    // (the TentativeSet only holds those the sender has not seen)
+    TentativeIDs  []int
+    // Whether the receiver lacks tentative writes it was not sent,
+    // so the sender must send its whole tentative log instead
+    MissingWrites bool
+    // IDs of the retired servers the receiver dropped from its clocks
+    Dropped       map[int]bool
+}
+
+/* VersionVector RPC arguments structure */
+type VersionVectorArgs struct {
+    SenderID int
+}
+
+/* VersionVector RPC reply structure */
+type VersionVectorReply struct {
+    ViewClock VectorClock
 }
 
 /* Ping RPC arguments structure */
@@ -112,41 +281,81 @@ type PingReply struct {
 type ReadArgs struct {
     Query      string
     FromCommit bool
+    Session    Session
+    // Arguments bound to the query's placeholders
+    QueryArgs  []interface{}
 }
 
 /* Bayou Read RPC reply structure */
 type ReadReply struct {
-    Data ReadResult
+    Data ResultSet
+    // Covers all writes reflected in the data that was read
+    ViewClock VectorClock
 }
 
 /* Bayou Write RPC arguments structure */
 type WriteArgs struct {
     WriteID int
     Query   string
+    // Optional: if empty, the write is undone by reverting
+    // the changes the server captured when applying it
     Undo    string
     Check   string
     Merge   string
+    Session Session
+    // Arguments bound to the placeholders of each query
+    QueryArgs []interface{}
+    UndoArgs  []interface{}
+    CheckArgs []interface{}
+    MergeArgs []interface{}
+    // Names of registered Go procedures to use instead
+    // of the Check and Merge queries, and their arguments
+    CheckProc string
+    MergeProc string
+    ProcArgs  []interface{}
+    // Alternative writes to try in order on conflict
+    Alternates []Alternate
 }
 
 /* Bayou Write RPC reply structure */
 type WriteReply struct {
     HasConflict bool
     WasResolved bool
+    // Index of the alternate write that was applied
+    Alternate   int
+    // Accept stamp the server assigned to the write
+    AcceptStamp VectorClock
 }
 
 /****************************
  *   BAYOU SERVER METHODS   *
  ****************************/
 
-/* Returns a new Bayou Server                *
- * Loads initial data and starts RPC handler */
+/* Returns a new Bayou Server, whose databases hold the provided *
+ * application schema. Loads initial data from (and locks) the   *
+ * persist files in dataDir, writes the schema's migrations the  *
+ * databases lack to the log, and starts RPC handler. Returns an *
+ * error if the schema is invalid, the port cannot be listened   *
+ * on, or the persist files or the databases cannot be loaded    */
 func NewBayouServer(id int, peers []*rpc.Client, commitDB *BayouDB,
-        fullDB *BayouDB, port int) *BayouServer {
+        fullDB *BayouDB, schema Schema, dataDir string,
+        port int) (*BayouServer, error) {
+    err := schema.validate()
+    if err != nil {
+        return nil, errors.New("Invalid schema: " + err.Error())
+    }
+    listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+    if err != nil {
+        return nil, errors.New("Listen Failed: " + err.Error())
+    }
     server := &BayouServer{}
     server.id = id
+    server.rpcListener = listener
     server.peers = peers
     server.commitDB = commitDB
     server.fullDB = fullDB
+    server.fullDB.capturesUndo = true
+    server.schema = schema
 
     // Set Initial State
     server.isActive = true
@@ -161,29 +370,77 @@ func NewBayouServer(id int, peers []*rpc.Client, commitDB *BayouDB,
     server.TentativeLog = make([]LogEntry, 0)
     server.UndoLog = make([]LogEntry, 0)
     server.ErrorLog = make([]LogEntry, 0)
+    server.RollbackMode = ROLLBACK_UNDO
     server.Omitted = make([]VectorClock, len(peers))
     for i, _ := range server.Omitted {
         server.Omitted[i] = NewVectorClock(len(peers))
     }
-
-    // Load persistent data (if there is any)
-    server.loadPersist()
-
-    // Replay all writes to their respective database
-    for _, entry := range server.CommitLog {
-        server.applyToDB(true, entry.Query, entry.Check, entry.Merge)
-        server.applyToDB(false, entry.Query, entry.Check, entry.Merge)
+    server.TruncationThreshold = TRUNCATION_THRESHOLD
+    server.acked = make([]VectorClock, len(peers))
+    for i, _ := range server.acked {
+        server.acked[i] = NewVectorClock(len(peers))
     }
-    for _, entry := range server.TentativeLog {
-        server.applyToDB(false, entry.Query, entry.Check, entry.Merge)
+    server.omitClock = NewVectorClock(len(peers))
+    server.omitCSN = UNCOMMITTED_CSN
+    server.omitAcceptClock = NewVectorClock(len(peers))
+    server.snapshotPeer = NO_PEER
+    server.recoveryCSN = UNCOMMITTED_CSN
+    server.recoveredFrom = make(map[int]bool)
+    server.members = make([]Member, len(peers))
+    server.epoch = Epoch{0, NO_PEER, UNCOMMITTED_CSN}
+    server.promised = Epoch{0, NO_PEER, UNCOMMITTED_CSN}
+
+    // Load persistent data (if there is any), which
+    // may include servers that joined since
+    store, err := OpenPersistStore(dataDir, id)
+    if err != nil {
+        listener.Close()
+        return nil, errors.New("Error opening persist files: " +
+                err.Error())
+    }
+    server.store = store
+    server.wal = NewWAL(server.store)
+    err = server.loadPersist()
+    if err != nil {
+        listener.Close()
+        server.store.Close()
+        return nil, err
+    }
+    server.growMembers(len(server.members))
+
+    server.hlc = NewHybridClock(id, systemTime)
+    err = server.replayLogs()
+    if err == nil {
+        server.updateClocks()
+        server.projectClocks()
+        server.logLock.Lock()
+        err = server.writeMigrations()
+        server.logLock.Unlock()
+    }
+    if err != nil {
+        listener.Close()
+        server.wal.Close()
+        server.store.Close()
+        return nil, err
     }
-    server.updateClocks()
 
     // Start RPC server
-    server.startRPCServer(port)
+    server.startRPCServer()
 
     debugf("Initialized Bayou Server #%d", server.id)
-    return server
+    return server, nil
+}
+
+/* Returns the error RPC handlers reply when this server is not active */
+func (server *BayouServer) inactiveError() error {
+    return errors.New(fmt.Sprintf("Server #%d %s", server.id, INACTIVE_ERROR))
+}
+
+/* Returns the error the Write and AntiEntropy handlers reply while *
+ * this server retires (which clients treat like an inactive one)   */
+func (server *BayouServer) retiringError() error {
+    return errors.New(fmt.Sprintf("Server #%d is retiring, so it %s",
+            server.id, INACTIVE_ERROR))
 }
 
 /* Formally "starts" a Bayou Server                  *
@@ -211,6 +468,22 @@ func (server *BayouServer) Kill() {
         server.antiEntropyTimer.Stop()
     }
     server.rpcListener.Close()
+
+    // Wait for any in-progress operation on the logs to finish,
+    // since later ones see this server is no longer active
+    server.logLock.Lock()
+    server.wal.Close()
+    server.store.Close()
+    server.logLock.Unlock()
+}
+
+/* Replaces the source of physical time of the clock stamping *
+ * the writes this server accepts (e.g. to simulate a clock   *
+ * that is not synchronized with the other servers' clocks)   */
+func (server *BayouServer) SetPhysicalClock(physical PhysicalClock) {
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+    server.hlc.SetPhysicalClock(physical)
 }
 
 /* Anti-Entropy RPC Handler                   *
@@ -219,35 +492,121 @@ func (server *BayouServer) Kill() {
 func (server *BayouServer) AntiEntropy(args *AntiEntropyArgs,
         reply *AntiEntropyReply) error {
     if !server.isActive {
-        return errors.New(fmt.Sprintf("Server #%d is not active", server.id))
+        return server.inactiveError()
+    }
+
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    // Server may have been killed while waiting for the lock, and
+    // writes received while it retires might not be handed off
+    if !server.isActive {
+        return server.inactiveError()
+    }
+    if server.retiring {
+        return server.retiringError()
     }
 
     var useMyLog bool
     var otherCommitClock VectorClock
     var otherTentativeClock VectorClock
 
-    var minOmitTimestamp VectorClock
-    timestampsDiffer := false
+    // The sender may have joined since this server last heard of it
+    server.growMembers(args.SenderID + 1)
+
+    // Both servers must leave the same servers out of the clocks they
+    // compare: drop the servers the sender dropped (or catch up from
+    // its snapshot, if this server cannot yet), and leave the servers
+    // this one dropped out of the sender's log and clocks
+    if server.dropMembers(args.Dropped) != nil {
+        server.snapshotPeer = args.SenderID
+        reply.Succeeded = false
+        reply.OmitTimestamp = args.OmitTimestamp
+        return nil
+    }
+    args.project(server.droppedIDs())
+    reply.Dropped = server.droppedIDs()
+
+    // If either server has commits made by a replaced primary, fail
+    // immediately: that server must install the other's snapshot
+    reply.Epoch = server.epoch
+    if hasStaleCommits(server.epoch, server.lastCSN(), args.Epoch) {
+        debugf("Server #%d has commits from a replaced primary (epoch " +
+                "%d < %d)", server.id, server.epoch.Number,
+                args.Epoch.Number)
+        server.snapshotPeer = args.SenderID
+        reply.Succeeded = false
+        reply.OmitTimestamp = args.OmitTimestamp
+        return nil
+    }
+    if hasStaleCommits(args.Epoch, args.CommitCSN, server.epoch) {
+        debugf("Server #%d has commits from a replaced primary (epoch " +
+                "%d < %d)", args.SenderID, args.Epoch.Number,
+                server.epoch.Number)
+        reply.Succeeded = false
+        reply.OmitTimestamp = args.OmitTimestamp
+        return nil
+    }
+
+    // If either server is missing commits the other already truncated,
+    // fail immediately: that server must first install a snapshot
+    reply.OmitClock = server.omitClock
+    if server.commitClock.LessThan(args.OmitClock) ||
+            args.CommitClock.LessThan(server.omitClock) {
+        debugf("Servers %d and %d cannot replay truncated commits!\n" +
+                "Receiver: %s\nSender: %s", server.id, args.SenderID,
+                server.commitClock.String(), args.CommitClock.String())
+        if server.commitClock.LessThan(args.OmitClock) {
+            server.snapshotPeer = args.SenderID
+        }
+        reply.Succeeded = false
+        reply.OmitTimestamp = args.OmitTimestamp
+        return nil
+    }
+
     myOmitTimestamp := server.Omitted[args.SenderID]
 
     // If the omit timestamps are not the same, fail
-    // immediately and send back the lower timestamp
-    if myOmitTimestamp.LessThan(args.OmitTimestamp) {
-        timestampsDiffer = true
-        minOmitTimestamp = myOmitTimestamp
-    } else if args.OmitTimestamp.LessThan(myOmitTimestamp) {
-        timestampsDiffer = true
-        minOmitTimestamp = args.OmitTimestamp
-    }
-    if timestampsDiffer {
+    // immediately and send back the resolved timestamp
+    if !myOmitTimestamp.Equal(args.OmitTimestamp) {
         debugf("Omit timestamps for servers %d and %d do not match!\n" +
                 "Receiver: %s\nSender: %s", server.id, args.SenderID,
                 myOmitTimestamp.String(), args.OmitTimestamp.String())
+
+        // The sender only adopts omit timestamps both servers have
+        // reached, so resume from its timestamp (or from this server's
+        // truncation point, which all servers have acknowledged), but
+        // never past this server's latest commit, since it may have
+        // restarted from a snapshot
+        resolvedTimestamp := laterCommit(args.OmitTimestamp,
+                server.omitClock)
+        if server.commitClock.LessThan(resolvedTimestamp) {
+            resolvedTimestamp = server.commitClock.Copy()
+        }
+        server.Omitted[args.SenderID] = resolvedTimestamp
         reply.Succeeded = false
         reply.CommitSet = nil
         reply.TentativeSet = nil
         reply.UndoSet = nil
-        reply.OmitTimestamp = minOmitTimestamp
+        reply.OmitTimestamp = resolvedTimestamp
+        return nil
+    }
+
+    // Rebuild the sender's tentative log from the writes it sent, and
+    // the ones it did not send because this server had seen them
+    err := checkWriteSets(args.TentativeSet, args.UndoSet)
+    if err != nil {
+        return err
+    }
+    var complete bool
+    args.TentativeSet, args.UndoSet, complete = server.expandTentativeSet(
+            args.TentativeIDs, args.TentativeSet, args.UndoSet)
+    if !complete {
+        debugf("Server #%d lacks tentative writes %d did not send",
+                server.id, args.SenderID)
+        reply.Succeeded = false
+        reply.MissingWrites = true
+        reply.OmitTimestamp = args.OmitTimestamp
         return nil
     }
 
@@ -257,25 +616,26 @@ func (server *BayouServer) AntiEntropy(args *AntiEntropyArgs,
     } else {
         otherCommitClock = args.CommitSet[len(args.CommitSet) - 1].Timestamp
     }
-    if len(args.TentativeSet) == 0 {
+    if len(args.TentativeClock) == 0 {
         otherTentativeClock = otherCommitClock
     } else {
-        otherTentativeClock =
-                args.TentativeSet[len(args.TentativeSet) - 1].Timestamp
+        otherTentativeClock = args.TentativeClock
     }
 
-    server.logLock.Lock()
-    defer server.logLock.Unlock()
-
     // Determine which server's log to follow:
     // Use the log with the greater commit timestamp, or the
     // log with the greater tentative timestamp as a tiebreaker
-    if otherCommitClock.LessThan(server.commitClock) {
+    // (concurrent timestamps are ordered by their total order)
+    switch otherCommitClock.Compare(server.commitClock) {
+    case CLOCK_BEFORE:
         useMyLog = true
-    } else if server.commitClock.LessThan(otherCommitClock) {
+    case CLOCK_AFTER:
         useMyLog = false
-    } else {
-        useMyLog = otherTentativeClock.LessThan(server.tentativeClock)
+    case CLOCK_CONCURRENT:
+        useMyLog = otherCommitClock.TotalCompare(server.commitClock) < 0
+    default:
+        useMyLog = otherTentativeClock.TotalCompare(
+                server.tentativeClock) < 0
     }
 
     // Save tentative writes/undos from the unchosen log
@@ -297,26 +657,40 @@ func (server *BayouServer) AntiEntropy(args *AntiEntropyArgs,
         sharedEndIndex = targetIndex + len(args.CommitSet)
     }
 
-    // Ensure all shared commits are the same
+    if sharedEndIndex > len(server.CommitLog) {
+        sharedEndIndex = len(server.CommitLog)
+    }
+    if sharedEndIndex - targetIndex > len(args.CommitSet) {
+        sharedEndIndex = targetIndex + len(args.CommitSet)
+    }
+
+    // Ensure all shared commits are the same, rejecting the
+    // sender's log (without changing this server's) if not
     var myEntry LogEntry
     var otherEntry LogEntry
     for i := targetIndex; i < sharedEndIndex; i++ {
         myEntry = server.CommitLog[i]
         otherEntry = args.CommitSet[i - targetIndex]
         if myEntry.WriteID != otherEntry.WriteID {
-            Log.Fatalf("The commit logs of server %d and %d have diverged!\n" +
+            debugf("The commit logs of server %d and %d have diverged!\n" +
                     "Receiver: %s\nSender: %s", server.id, args.SenderID,
                     logToString(server.CommitLog[targetIndex:]),
                     logToString(args.CommitSet))
+            return errors.New(fmt.Sprintf("The commit logs of server %d " +
+                    "and %d have diverged at CSN %d", server.id,
+                    args.SenderID, myEntry.CSN))
         }
     }
 
     // Update server state as necessary
     if !useMyLog {
-        server.matchLog(args.CommitSet, args.TentativeSet, args.UndoSet,
-                args.OmitTimestamp)
+        err := server.matchLog(args.CommitSet, args.TentativeSet,
+                args.UndoSet)
+        if err != nil {
+            return err
+        }
     }
-    server.Omitted[args.SenderID] = server.commitClock
+    server.commitTentativeWrites()
 
     seenWritesMap := make(map[int]bool)
     for _, entry := range server.CommitLog {
@@ -327,23 +701,31 @@ func (server *BayouServer) AntiEntropy(args *AntiEntropyArgs,
     }
 
     // Apply all unseen tentative writes from the unchosen log
+    // Note: the primary commits these writes as it applies them
     for idx, entry := range tentativeSet {
-        if _, seenWrite := seenWritesMap[entry.WriteID]; !seenWrite {
+        _, seenWrite := seenWritesMap[entry.WriteID]
+        if !seenWrite && !server.isOmitted(entry) {
             server.applyWrite(tentativeSet[idx], undoSet[idx])
         }
     }
+    server.Omitted[args.SenderID] = server.commitClock.Copy()
+    server.acked[args.SenderID] = laterCommit(server.acked[args.SenderID],
+            otherCommitClock)
 
-    // Respond with the chosen results
+    // Respond with the chosen results, only including
+    // the tentative writes the sender has not seen
     reply.CommitSet = make([]LogEntry, len(server.CommitLog) - targetIndex)
     copy(reply.CommitSet, server.CommitLog[targetIndex:])
-    reply.TentativeSet = make([]LogEntry, len(server.TentativeLog))
-    copy(reply.TentativeSet, server.TentativeLog)
-    reply.UndoSet = make([]LogEntry, len(server.UndoLog))
-    copy(reply.UndoSet, server.UndoLog)
+    reply.TentativeIDs = writeIDs(server.TentativeLog)
+    reply.TentativeSet, reply.UndoSet = unseenWrites(server.TentativeLog,
+            server.UndoLog, args.ViewClock)
 
     reply.Succeeded = true
-    reply.OmitTimestamp = server.commitClock
-    return nil
+    reply.OmitTimestamp = server.Omitted[args.SenderID]
+    server.truncateCommitLog()
+
+    // The sender retries if this server's changes were not persisted
+    return server.persistError()
 }
 
 /* Ping RPC Handler                             *
@@ -351,25 +733,64 @@ func (server *BayouServer) AntiEntropy(args *AntiEntropyArgs,
  * Sets Alive to yes is RPC was received        */
 func (server *BayouServer) Ping(args *PingArgs, reply *PingReply) error {
     if !server.isActive {
-        return errors.New(fmt.Sprintf("Server #%d is not active", server.id))
+        return server.inactiveError()
     }
     debugf("Server #%d received ping from %d", server.id, args.SenderID)
     reply.Alive = true
     return nil
 }
 
+/* VersionVector RPC Handler                              *
+ * Replies the version vector of the server's full view,  *
+ * so the sender only sends the writes it has not seen    */
+func (server *BayouServer) VersionVector(args *VersionVectorArgs,
+        reply *VersionVectorReply) error {
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    // Server may have been killed while waiting for the lock
+    if !server.isActive {
+        return server.inactiveError()
+    }
+    reply.ViewClock = server.viewClock(false)
+    return nil
+}
+
 /* Bayou Read RPC Handler                        *
  * Replies result of the user-defined read query *
  * on either the committed or full database      */
 func (server *BayouServer) Read(args *ReadArgs, reply *ReadReply) error {
     if !server.isActive {
-        return errors.New(fmt.Sprintf("Server #%d is not active", server.id))
+        return server.inactiveError()
+    }
+
+    // Reject arguments that cannot be bound to the query
+    err := checkQueryArgs(args.QueryArgs)
+    if err != nil {
+        return err
     }
 
     server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    // Server may have been killed while waiting for the lock
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    // Ensure this server's view satisfies the session's guarantees
+    err = server.awaitSession(args.Session.readDependencies(),
+            args.FromCommit)
+    if err != nil {
+        return err
+    }
+
     server.dbLock.Lock()
     defer server.dbLock.Unlock()
-    defer server.logLock.Unlock()
 
     var db *BayouDB
     if (args.FromCommit) {
@@ -377,9 +798,13 @@ func (server *BayouServer) Read(args *ReadArgs, reply *ReadReply) error {
     } else {
         db = server.fullDB
     }
-    data := db.Read(args.Query)
+    data, err := db.ReadTyped(args.Query, args.QueryArgs...)
+    if err != nil {
+        return err
+    }
 
     reply.Data = data
+    reply.ViewClock = server.viewClock(args.FromCommit)
     return nil
 }
 
@@ -388,29 +813,93 @@ func (server *BayouServer) Read(args *ReadArgs, reply *ReadReply) error {
  * if so, whether it was successfully resolved   */
 func (server *BayouServer) Write(args *WriteArgs, reply *WriteReply) error {
     if !server.isActive {
-        return errors.New(fmt.Sprintf("Server #%d is not active", server.id))
+        return server.inactiveError()
+    }
+
+    // Reject arguments other replicas could not bind, before
+    // the write is logged (and propagated to them)
+    err := args.checkQueryArgs()
+    if err != nil {
+        return errors.New(fmt.Sprintf("Write %d rejected by server #%d: %s",
+                args.WriteID, server.id, err.Error()))
     }
 
     server.logLock.Lock()
     defer server.logLock.Unlock()
 
-    // Update appropiate vector clock(s)
+    // Server may have been killed while waiting for the lock
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    // Ensure this server's view satisfies the session's guarantees
+    err = server.awaitSession(args.Session.writeDependencies(), false)
+    if err != nil {
+        return err
+    }
+
+    // Writes accepted while this server retires (which may have
+    // started while waiting) might not be handed off to its peers
+    if server.retiring {
+        return server.retiringError()
+    }
+
+    // Update tentative vector clock (if this server is the
+    // primary, the write is restamped when it is committed)
     server.tentativeClock.Inc(server.id)
     writeClock := server.tentativeClock
-    if server.IsPrimary {
-        server.commitClock.Inc(server.id)
-        writeClock = server.commitClock
-    }
 
     // Create entries for each of the logs
     writeEntry := NewLogEntry(args.WriteID, writeClock, args.Query,
             args.Check, args.Merge)
+    writeEntry.QueryArgs = args.QueryArgs
+    writeEntry.CheckArgs = args.CheckArgs
+    writeEntry.MergeArgs = args.MergeArgs
+    writeEntry.CheckProc = args.CheckProc
+    writeEntry.MergeProc = args.MergeProc
+    writeEntry.ProcArgs = args.ProcArgs
+    writeEntry.Alternates = args.Alternates
+    writeEntry.HLC = server.hlc.Now()
     undoEntry := NewLogEntry(args.WriteID, writeClock, args.Undo,
             getBoolQuery(true), getBoolQuery(false))
+    undoEntry.QueryArgs = args.UndoArgs
 
-    hasConflict, resolved := server.applyWrite(writeEntry, undoEntry)
+    hasConflict, resolved, alternate, err := server.applyWrite(writeEntry,
+            undoEntry)
+    if err != nil {
+        return errors.New(fmt.Sprintf("Write %d failed on server #%d: %s",
+                args.WriteID, server.id, err.Error()))
+    }
+
+    // The write was applied, but may be lost if this
+    // server crashes before its changes are persisted
+    err = server.persistError()
+    if err != nil {
+        return err
+    }
     reply.HasConflict = hasConflict
     reply.WasResolved = resolved
+    reply.Alternate = alternate
+    reply.AcceptStamp = writeEntry.AcceptStamp
+    return nil
+}
+
+/* Returns an error if any query of the write *
+ * (or of its alternates) or its procedures    *
+ * have arguments of unsupported types         */
+func (args *WriteArgs) checkQueryArgs() error {
+    argLists := [][]interface{}{args.QueryArgs, args.UndoArgs,
+            args.CheckArgs, args.MergeArgs, args.ProcArgs}
+    for _, alternate := range args.Alternates {
+        argLists = append(argLists, alternate.QueryArgs, alternate.UndoArgs,
+                alternate.CheckArgs)
+    }
+    for _, argList := range argLists {
+        err := checkQueryArgs(argList)
+        if err != nil {
+            return err
+        }
+    }
     return nil
 }
 
@@ -420,10 +909,18 @@ func (server *BayouServer) SendPing(peerID int) bool {
     pingArgs := PingArgs{server.id}
     var pingReply PingReply
 
+    server.logLock.Lock()
+    peer := server.connectPeer(peerID, false)
+    server.logLock.Unlock()
+    if peer == nil {
+        debugf("Ping %d => %d Failed: Unknown peer", server.id, peerID)
+        return false
+    }
+
     // Ensure RPC went through
-    err := server.peers[peerID].Call("BayouServer.Ping", &pingArgs, &pingReply)
+    err := server.callPeer(peer, peerID, "BayouServer.Ping", &pingArgs,
+            &pingReply)
     if err != nil {
-        debugf("Ping %d => %d Failed: %s", server.id, peerID, err.Error())
         return false
     }
 
@@ -436,8 +933,8 @@ func (server *BayouServer) SendPing(peerID int) bool {
     return true
 }
 
-/* Starts serving RPCs on the provided port */
-func (server *BayouServer) startRPCServer(port int) {
+/* Starts serving RPCs on the server's listener */
+func (server *BayouServer) startRPCServer() {
     rpcServer := rpc.NewServer()
 
     // Register the server RPCs, temporarily disabling the standard log
@@ -456,144 +953,668 @@ func (server *BayouServer) startRPCServer(port int) {
     rpcServer.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
     http.DefaultServeMux = oldMux
 
-    // Listen and serve on the specified port
-    var err error
-    server.rpcListener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
-    if err != nil {
-        Log.Fatal("Listen Failed: ", err)
-    }
+    // Serve on the port the server listens on
     go http.Serve(server.rpcListener, newMux)
 
-    debugf("Server #%d listening on port %d", server.id, port)
+    debugf("Server #%d listening on %s", server.id,
+            server.rpcListener.Addr().String())
 }
 
-/* Sends an AntiEntropy RPC and handles the reply */
+/* Sends an AntiEntropy RPC to a random peer and handles the  *
+ * reply, releasing logLock while waiting for the peer, so the *
+ * server keeps serving reads and writes in the meantime       */
 func (server *BayouServer) performAntiEntropy() {
-    // Choose server to send AntiEntropy RPC to
-    targetID := server.id
-    for ; targetID == server.id; targetID = randomIntn(len(server.peers)){}
-
     server.logLock.Lock()
     defer server.logLock.Unlock()
 
-    // Get the log entries to send to target server
-    omitTimestamp := server.Omitted[targetID]
+    // Server may have been killed while waiting for the lock
+    if !server.isActive {
+        return
+    }
+
+    // If a peer found this server is missing commits it
+    // already truncated, catch up from its snapshot instead
+    if server.snapshotPeer != NO_PEER {
+        if server.pullSnapshot(server.snapshotPeer, false) == nil {
+            server.snapshotPeer = NO_PEER
+        }
+        return
+    }
+
+    // Choose server to send AntiEntropy RPC to
+    targetID := server.randomPeer()
+    if targetID == NO_PEER {
+        return
+    }
+    server.exchangeWith(targetID, false)
+}
+
+/* Sends an AntiEntropy RPC to the provided peer and handles *
+ * the reply, returning whether the logs were exchanged      *
+ * Must be called while holding logLock, which is held for   *
+ * the whole exchange, so no writes are accepted meanwhile   */
+func (server *BayouServer) antiEntropyWith(targetID int) bool {
+    return server.exchangeWith(targetID, true)
+}
+
+/* Sends an AntiEntropy RPC to the provided peer and handles the   *
+ * reply, returning whether the logs were exchanged. Unless        *
+ * holdLock is set, logLock is released while waiting for the peer *
+ * Must be called while holding logLock                            */
+func (server *BayouServer) exchangeWith(targetID int, holdLock bool) bool {
+    target := server.connectPeer(targetID, holdLock)
+    if target == nil {
+        return false
+    }
+
+    // Only send the tentative writes the target's version vector does
+    // not cover, unless it lacks some it was not sent: then both
+    // servers send their whole tentative logs
+    var versionReply VersionVectorReply
+    err := server.callPeerLocked(target, targetID,
+            "BayouServer.VersionVector", &VersionVectorArgs{server.id},
+            &versionReply, holdLock)
+    if err != nil {
+        return false
+    }
+    exchanged, complete := server.exchangeLogs(target, targetID,
+            versionReply.ViewClock, holdLock)
+    if !complete {
+        debugf("Server #%d sending its whole log to %d", server.id,
+                targetID)
+        exchanged, _ = server.exchangeLogs(target, targetID, nil, holdLock)
+    }
+    return exchanged
+}
+
+/* Sends an AntiEntropy RPC to the provided peer, with the tentative *
+ * writes the provided version vector of the peer does not cover     *
+ * (or all of them, if it is nil), and handles the reply. Returns    *
+ * whether the logs were exchanged, and false if either server       *
+ * lacked tentative writes it was not sent (so nothing was changed)  *
+ * Unless holdLock is set, logLock is released while waiting for the *
+ * reply, which is then reconciled with the writes this server       *
+ * accepted (or received from other peers) in the meantime           *
+ * Must be called while holding logLock                              */
+func (server *BayouServer) exchangeLogs(target *rpc.Client, targetID int,
+        targetClock VectorClock, holdLock bool) (exchanged bool,
+        complete bool) {
+    // Get the log entries to send to target server (copying
+    // anything the logs share, since they may change before
+    // the arguments are sent)
+    omitTimestamp := server.Omitted[targetID].Copy()
     commitStartIndex := getLengthAtTime(server.CommitLog, omitTimestamp)
     commitSet := make([]LogEntry, len(server.CommitLog) - commitStartIndex)
     copy(commitSet, server.CommitLog[commitStartIndex:])
-    tentativeSet := make([]LogEntry, len(server.TentativeLog))
-    copy(tentativeSet, server.TentativeLog)
-    undoSet := make([]LogEntry, len(server.UndoLog))
-    copy(undoSet, server.UndoLog)
+    tentativeSet, undoSet := unseenWrites(server.TentativeLog,
+            server.UndoLog, targetClock)
+    var tentativeClock VectorClock
+    lastTentativeIdx := len(server.TentativeLog) - 1
+    if lastTentativeIdx >= 0 {
+        tentativeClock =
+                server.TentativeLog[lastTentativeIdx].Timestamp.Copy()
+    }
+    var viewClock VectorClock
+    if targetClock != nil {
+        viewClock = server.viewClock(false)
+    }
+
+    commitClock := server.commitClock.Copy()
 
     antiEntropyArgs := AntiEntropyArgs{server.id, commitSet,
-            tentativeSet, undoSet, omitTimestamp}
+            tentativeSet, undoSet, omitTimestamp, commitClock,
+            server.omitClock.Copy(), server.epoch, server.lastCSN(),
+            writeIDs(server.TentativeLog), tentativeClock, viewClock,
+            server.droppedIDs()}
     var antiEntropyReply AntiEntropyReply
 
     // Actually send AntiEntropy RPC with timeout
-    timeout := time.Duration(ANTI_ENTROPY_TIMEOUT_MIN * 2) * time.Millisecond
-    errchan := make(chan error, 1)
-    go func() {
-        errchan <- server.peers[targetID].Call("BayouServer.AntiEntropy",
-                &antiEntropyArgs, &antiEntropyReply)
-    }()
-    select {
-    case err := <-errchan:
-        if err != nil {
-            debugf("AntiEntropy %d => %d Failed: %s", server.id,
-                    targetID, err.Error())
-            return
-        }
-    case <-time.After(timeout):
-        debugf("AntiEntropy %d => %d Failed: Timeout", server.id, targetID)
-        return
+    err := server.callPeerLocked(target, targetID, "BayouServer.AntiEntropy",
+            &antiEntropyArgs, &antiEntropyReply, holdLock)
+    if err != nil {
+        return false, true
+    }
+
+    // Drop the servers the target dropped (or catch up from its
+    // snapshot, if this server cannot yet), and leave the servers
+    // this one dropped out of the target's log and clocks
+    if server.dropMembers(antiEntropyReply.Dropped) != nil {
+        server.pullSnapshot(targetID, holdLock)
+        return false, true
+    }
+    antiEntropyReply.project(server.droppedIDs())
+
+    // If this server has commits made by a replaced primary, or the
+    // target already truncated commits this server is missing, catch
+    // up from the target's snapshot instead
+    if hasStaleCommits(server.epoch, server.lastCSN(),
+            antiEntropyReply.Epoch) ||
+            server.commitClock.LessThan(antiEntropyReply.OmitClock) {
+        server.pullSnapshot(targetID, holdLock)
+        return false, true
+    }
+    if antiEntropyReply.MissingWrites {
+        return false, false
     }
 
     // If AntiEntropy failed, set omit vector to the resolved timestamp
     if !antiEntropyReply.Succeeded {
         debugf("Server #%d: Omit timestamps mismatched. Setting to " +
-                "resolved minimum: %s", server.id,
+                "resolved timestamp: %s", server.id,
                 antiEntropyReply.OmitTimestamp.String())
         server.Omitted[targetID] = antiEntropyReply.OmitTimestamp
-        return
+        return false, true
+    }
+
+    // Rebuild the target's tentative log, and resolve logs
+    // according to reply, if necessary
+    err = checkWriteSets(antiEntropyReply.TentativeSet,
+            antiEntropyReply.UndoSet)
+    if err != nil {
+        debugf("Server #%d rejected %d's log: %s", server.id, targetID,
+                err.Error())
+        return false, true
+    }
+    tentativeSet, undoSet, complete = server.expandTentativeSet(
+            antiEntropyReply.TentativeIDs, antiEntropyReply.TentativeSet,
+            antiEntropyReply.UndoSet)
+    if !complete {
+        debugf("Server #%d lacks tentative writes %d did not send",
+                server.id, targetID)
+        return false, false
     }
 
-    // Resolve logs according to reply, if necessary
-    server.matchLog(antiEntropyReply.CommitSet,
-            antiEntropyReply.TentativeSet, antiEntropyReply.UndoSet,
+    // Keep the tentative writes that arrived after the arguments were
+    // sent (which the target has not seen), and never move the omit
+    // timestamp back past one the target agreed to in the meantime
+    tentativeSet, undoSet = server.keepNewWrites(antiEntropyArgs.TentativeIDs,
+            tentativeSet, undoSet)
+    err = server.matchLog(antiEntropyReply.CommitSet, tentativeSet, undoSet)
+    if err != nil {
+        debugf("Server #%d failed to match %d's log: %s", server.id,
+                targetID, err.Error())
+        return false, false
+    }
+    server.recoveredFrom[targetID] = true
+    server.commitTentativeWrites()
+    server.Omitted[targetID] = laterCommit(server.Omitted[targetID],
+            antiEntropyReply.OmitTimestamp)
+    server.acked[targetID] = laterCommit(server.acked[targetID],
             antiEntropyReply.OmitTimestamp)
-    server.Omitted[targetID] = antiEntropyReply.OmitTimestamp
+    server.truncateCommitLog()
+    return true, true
 }
 
-/* Adds the write to the appropiate log(s), and applies it *
- * to the appropiate database(s), returning whether there  *
- * was a conflict, and if so, if it was resolved          */
+/* Returns how long to wait for a peer to connect or reply: *
+ * twice the minimum time between AntiEntropy RPCs          */
+func peerTimeout() time.Duration {
+    return time.Duration(ANTI_ENTROPY_TIMEOUT_MIN * 2) * time.Millisecond
+}
+
+/* Calls the provided method of the provided peer, returning *
+ * an error if the call fails, or the peer does not reply    *
+ * within the peer timeout                                   */
+func (server *BayouServer) callPeer(peer *rpc.Client, peerID int,
+        method string, args interface{}, reply interface{}) error {
+    timeout := peerTimeout()
+    errchan := make(chan error, 1)
+    go func() {
+        errchan <- peer.Call(method, args, reply)
+    }()
+
+    var err error
+    select {
+    case err = <-errchan:
+    case <-time.After(timeout):
+        err = errors.New("Timeout")
+    }
+    if err != nil {
+        debugf("%s %d => %d Failed: %s", method, server.id, peerID,
+                err.Error())
+    }
+    return err
+}
+
+/* Calls the provided method of the provided peer like callPeer, *
+ * releasing logLock while waiting for the reply (unless holdLock *
+ * is set). Fails if the server was killed in the meantime        *
+ * Must be called while holding logLock                           */
+func (server *BayouServer) callPeerLocked(peer *rpc.Client, peerID int,
+        method string, args interface{}, reply interface{},
+        holdLock bool) error {
+    if holdLock {
+        return server.callPeer(peer, peerID, method, args, reply)
+    }
+    server.logLock.Unlock()
+    err := server.callPeer(peer, peerID, method, args, reply)
+    server.logLock.Lock()
+    if err == nil && !server.isActive {
+        err = server.inactiveError()
+    }
+    return err
+}
+
+/* Adds the write to the appropiate log(s), and applies it  *
+ * to the appropiate database(s), returning whether there   *
+ * was a conflict, if so, if it was resolved, the index of  *
+ * the alternate write that was applied (if any), and the   *
+ * error applying it (if any). Failed writes are still kept *
+ * in the log(s), so every replica treats them the same way *
+ * Tentative writes are inserted in accept order, so the    *
+ * writes ordered after them are rolled back and redone     */
 func (server *BayouServer) applyWrite(writeEntry LogEntry,
-        undoEntry LogEntry) (hasConflict bool, resolved bool) {
+        undoEntry LogEntry) (hasConflict bool, resolved bool,
+        alternate int, err error) {
     // If this server is the primary, commit the write immediately,
     // else add it as a tentative write and its undo operation to the undo log
-    if server.IsPrimary {
-        server.CommitLog = append(server.CommitLog, writeEntry)
+    // Note: the write may designate another primary, so this is only
+    // checked once
+    isPrimary := server.commits()
+    server.hlc.Observe(writeEntry.HLC)
+    var entry *LogEntry
+    var redoSet []LogEntry
+    var redoUndoSet []LogEntry
+    position := len(server.TentativeLog)
+    if isPrimary {
+        server.commitEntry(writeEntry)
+        entry = &server.CommitLog[len(server.CommitLog) - 1]
     } else {
+        // Roll back the writes ordered after this one (if it
+        // arrived out of order), to redo them once it is applied
+        position = server.tentativePosition(writeEntry)
+        if position < len(server.TentativeLog) {
+            debugf("Server #%d inserting write %d at %d of %d", server.id,
+                    writeEntry.WriteID, position, len(server.TentativeLog))
+            redoSet = make([]LogEntry, len(server.TentativeLog) - position)
+            copy(redoSet, server.TentativeLog[position:])
+            redoUndoSet = make([]LogEntry, len(redoSet))
+            copy(redoUndoSet, server.UndoLog[position:])
+            err = server.rollbackDB(position)
+            if err != nil {
+                return
+            }
+        }
         server.TentativeLog = append(server.TentativeLog, writeEntry)
         server.UndoLog = append(server.UndoLog, undoEntry)
+        entry = &server.TentativeLog[len(server.TentativeLog) - 1]
     }
 
     // Apply write to database(s) and send unresolved conflicts to error log
-    hasConflict, resolved = server.applyToDB(false, writeEntry.Query,
-            writeEntry.Check, writeEntry.Merge)
-    if hasConflict && !resolved {
-        server.ErrorLog = append(server.ErrorLog, writeEntry)
+    record := WALRecord{Rollback: NO_ROLLBACK}
+    hasConflict, resolved, err = server.applyToDB(false, entry)
+    if err == nil && hasConflict && !resolved {
+        server.ErrorLog = append(server.ErrorLog, *entry)
+        record.Errors = []LogEntry{*entry}
+    }
+    if isPrimary {
+        server.applyToDB(true, entry)
+        record.Commits = []LogEntry{*entry}
+    }
+
+    // Membership changes also change this server's state
+    if entry.Membership.Change != NO_MEMBER_CHANGE {
+        record.State = server.persistState()
+    }
+    alternate = entry.Alternate
+
+    // Redo the writes ordered after this one, sending those whose
+    // conflicts it left unresolved to the error log (once each)
+    logged := make(map[int]bool)
+    if len(redoSet) > 0 {
+        for _, errorEntry := range server.ErrorLog {
+            logged[errorEntry.WriteID] = true
+        }
     }
-    if server.IsPrimary {
-        server.applyToDB(true, writeEntry.Query, writeEntry.Check,
-                writeEntry.Merge)
+    for idx, _ := range redoSet {
+        server.TentativeLog = append(server.TentativeLog, redoSet[idx])
+        server.UndoLog = append(server.UndoLog, redoUndoSet[idx])
+        redoEntry := &server.TentativeLog[len(server.TentativeLog) - 1]
+        redoConflict, redoResolved, redoErr := server.applyToDB(false,
+                redoEntry)
+        if redoErr == nil && redoConflict && !redoResolved &&
+                !logged[redoEntry.WriteID] {
+            server.ErrorLog = append(server.ErrorLog, *redoEntry)
+            record.Errors = append(record.Errors, *redoEntry)
+        }
+    }
+    if !isPrimary {
+        record.Tentative = server.TentativeLog[position:]
+        record.Undo = server.UndoLog[position:]
     }
-    server.savePersist()
+    server.persist(record)
     return
 }
 
-/* Rollsback the database, and applies log entries so that *
- * this server's log matches the provided write sets       */
-func (server *BayouServer) matchLog(commitSet []LogEntry,
-        tentativeSet []LogEntry, undoSet []LogEntry,
-        rollbackTime VectorClock) {
-    // Rollback the database to the specified time
-    server.rollbackDB(rollbackTime)
-    server.updateClocks()
+/* Returns the position in the tentative log the provided write *
+ * is ordered at: after all the writes accepted before it       */
+func (server *BayouServer) tentativePosition(entry LogEntry) int {
+    position := len(server.TentativeLog)
+    for position > 0 &&
+            entry.acceptedBefore(server.TentativeLog[position - 1]) {
+        position--
+    }
+    return position
+}
 
+/* Rollsback the full view, and applies log entries so that *
+ * this server's log matches the provided write sets         *
+ * New commits are applied (in CSN order) to both views      *
+ * before the remaining tentative writes are re-executed     *
+ * Returns an error if the full view cannot be rolled back   */
+func (server *BayouServer) matchLog(commitSet []LogEntry,
+        tentativeSet []LogEntry, undoSet []LogEntry) error {
     // Ensure the length of the tentative and undo sets are the same
-    if len(tentativeSet) != len(undoSet) {
-        Log.Fatalf("Length of tentative and undo sets do not match!\n" +
-                "Tentative Set: %s\nUndo Set: %s\n",
-                logToString(tentativeSet), logToString(undoSet))
+    err := checkWriteSets(tentativeSet, undoSet)
+    if err != nil {
+        return err
+    }
+
+    // Rollback all tentative writes, since any new
+    // commits must be applied to the full view first
+    err = server.rollbackDB(0)
+    if err != nil {
+        return err
     }
 
-    // Add all entries to the appropiate log, and apply to database
+    numCommits := len(server.CommitLog)
+    seenWrites := make(map[int]bool)
+    for _, entry := range server.CommitLog {
+        seenWrites[entry.WriteID] = true
+    }
+
+    // Add all unseen commits to the commit log, and apply to both views
+    // (re-executing any made by a primary after it was replaced as
+    // tentative writes, so the new primary commits them again)
+    var staleSet []LogEntry
+    var staleUndoSet []LogEntry
     for _, entry := range commitSet {
+        if seenWrites[entry.WriteID] || server.isOmitted(entry) {
+            continue
+        }
+        if server.epoch.replaced(entry) {
+            debugf("Server #%d uncommitted commit %d from epoch %d",
+                    server.id, entry.CSN, entry.Epoch)
+            staleEntry, staleUndo := uncommit(entry)
+            staleSet = append(staleSet, staleEntry)
+            staleUndoSet = append(staleUndoSet, staleUndo)
+            continue
+        }
+
+        // Commits after ones this server lacks (e.g. sent by a peer
+        // that thinks it has commits its log lost) wait for those
+        if entry.CSN > server.nextCSN() {
+            continue
+        }
+        seenWrites[entry.WriteID] = true
         server.CommitLog = append(server.CommitLog, entry)
-        server.applyToDB(true, entry.Query, entry.Check, entry.Merge)
+        lastCommit := &server.CommitLog[len(server.CommitLog) - 1]
+        server.applyToDB(true, lastCommit)
+        server.applyToDB(false, lastCommit)
+    }
+
+    // Re-execute all tentative writes that have not since been
+    // committed, in accept order (whatever order the sets are in),
+    // and once each (an uncommitted write may also be in the set)
+    // Note: the sets are copied, since they may be the caller's
+    tentativeSet = append(append([]LogEntry{}, tentativeSet...), staleSet...)
+    undoSet = append(append([]LogEntry{}, undoSet...), staleUndoSet...)
+    order := make([]int, len(tentativeSet))
+    for i, _ := range order {
+        order[i] = i
     }
+    sort.SliceStable(order, func(i int, j int) bool {
+        return tentativeSet[order[i]].acceptedBefore(tentativeSet[order[j]])
+    })
     var tentEntry LogEntry
     var undoEntry LogEntry
-    for i, _ := range tentativeSet {
+    for _, i := range order {
         tentEntry = tentativeSet[i]
         undoEntry = undoSet[i]
+        if seenWrites[tentEntry.WriteID] || server.isOmitted(tentEntry) {
+            continue
+        }
+        seenWrites[tentEntry.WriteID] = true
         server.TentativeLog = append(server.TentativeLog, tentEntry)
         server.UndoLog = append(server.UndoLog, undoEntry)
-        server.applyToDB(false, tentEntry.Query, tentEntry.Check,
-                tentEntry.Merge)
+        server.applyToDB(false,
+                &server.TentativeLog[len(server.TentativeLog) - 1])
     }
     server.updateClocks()
+
+    // The rollback was already recorded, so the tentative
+    // log now only holds the re-executed writes
+    record := WALRecord{Rollback: NO_ROLLBACK, State: server.persistState()}
+    record.Commits = server.CommitLog[numCommits:]
+    record.Tentative = server.TentativeLog
+    record.Undo = server.UndoLog
+    server.persist(record)
+    return nil
+}
+
+/* Returns a peer's tentative log (and undo log), given the IDs of  *
+ * its writes in order, and the ones it sent: the others are copied *
+ * from this server's tentative log, and those this server already  *
+ * committed are left out. Returns false if any others are missing  */
+func (server *BayouServer) expandTentativeSet(writeIDs []int,
+        tentativeSet []LogEntry, undoSet []LogEntry) ([]LogEntry,
+        []LogEntry, bool) {
+    sent := make(map[int]int)
+    for idx, entry := range tentativeSet {
+        sent[entry.WriteID] = idx
+    }
+    tentative := make(map[int]int)
+    for idx, entry := range server.TentativeLog {
+        tentative[entry.WriteID] = idx
+    }
+    committed := make(map[int]bool)
+    for _, entry := range server.CommitLog {
+        committed[entry.WriteID] = true
+    }
+
+    expandedSet := make([]LogEntry, 0, len(writeIDs))
+    expandedUndoSet := make([]LogEntry, 0, len(writeIDs))
+    for _, writeID := range writeIDs {
+        if idx, ok := sent[writeID]; ok {
+            expandedSet = append(expandedSet, tentativeSet[idx])
+            expandedUndoSet = append(expandedUndoSet, undoSet[idx])
+        } else if idx, ok := tentative[writeID]; ok {
+            expandedSet = append(expandedSet, server.TentativeLog[idx])
+            expandedUndoSet = append(expandedUndoSet, server.UndoLog[idx])
+        } else if !committed[writeID] {
+            return nil, nil, false
+        }
+    }
+    return expandedSet, expandedUndoSet, true
+}
+
+/* Returns an error if the provided tentative set and undo set *
+ * (e.g. sent by a peer) do not have the same length            */
+func checkWriteSets(tentativeSet []LogEntry, undoSet []LogEntry) error {
+    if len(tentativeSet) != len(undoSet) {
+        return errors.New(fmt.Sprintf("Length of tentative and undo " +
+                "sets do not match (%d != %d)", len(tentativeSet),
+                len(undoSet)))
+    }
+    return nil
+}
+
+/* Returns the provided tentative set (and undo set), followed by   *
+ * this server's tentative writes that are neither in it nor in the *
+ * provided IDs of the writes that were sent to the peer it came    *
+ * from: those this server accepted or received since then          */
+func (server *BayouServer) keepNewWrites(sentIDs []int,
+        tentativeSet []LogEntry, undoSet []LogEntry) ([]LogEntry,
+        []LogEntry) {
+    known := make(map[int]bool)
+    for _, writeID := range sentIDs {
+        known[writeID] = true
+    }
+    for _, entry := range tentativeSet {
+        known[entry.WriteID] = true
+    }
+    for idx, entry := range server.TentativeLog {
+        if !known[entry.WriteID] {
+            tentativeSet = append(tentativeSet, entry)
+            undoSet = append(undoSet, server.UndoLog[idx])
+        }
+    }
+    return tentativeSet, undoSet
+}
+
+/* Commits all of this server's tentative writes, keeping *
+ * their tentative order. Only the primary commits writes *
+ * Since the full view already reflects the writes in     *
+ * this order, only the commit view needs to be updated   */
+func (server *BayouServer) commitTentativeWrites() {
+    if !server.commits() || len(server.TentativeLog) == 0 {
+        return
+    }
+
+    numCommits := len(server.CommitLog)
+    for _, entry := range server.TentativeLog {
+        server.commitEntry(entry)
+        server.applyToDB(true, &server.CommitLog[len(server.CommitLog) - 1])
+    }
+
+    // The full view's tentative writes are now commits
+    // (if it does not reflect them, it is rebuilt on restart)
+    server.dbLock.Lock()
+    applied, ok := server.fullDB.applied.commit(
+            server.CommitLog[numCommits:])
+    if ok {
+        err := server.fullDB.saveCommitted(applied)
+        if err != nil {
+            debugf("Server #%d failed to record commits on its full " +
+                    "view: %s", server.id, err.Error())
+        }
+    }
+    server.dbLock.Unlock()
+    server.TentativeLog = make([]LogEntry, 0)
+    server.UndoLog = make([]LogEntry, 0)
+    server.persist(WALRecord{Rollback: 0,
+            Commits: server.CommitLog[numCommits:]})
+}
+
+/* Assigns the next commit sequence number and commit *
+ * timestamp to the provided write, and appends it to *
+ * the commit log. Returns the committed entry        */
+func (server *BayouServer) commitEntry(entry LogEntry) LogEntry {
+    server.commitClock.Inc(server.id)
+    committed := entry
+    committed.Timestamp = server.commitClock.Copy()
+    committed.CSN = server.nextCSN()
+    committed.Epoch = server.epoch.Number
+    server.CommitLog = append(server.CommitLog, committed)
+    return committed
+}
+
+/* Returns the commit sequence number *
+ * to assign to the next commit       */
+func (server *BayouServer) nextCSN() int {
+    if len(server.CommitLog) == 0 {
+        return server.omitCSN + 1
+    }
+    return server.CommitLog[len(server.CommitLog) - 1].CSN + 1
+}
+
+/* Truncates the commits every peer is known to have from the *
+ * commit log, once there are at least TruncationThreshold of  *
+ * them. Truncated commits are only reflected in the databases *
+ * and the omit clocks. Drops the retired servers whose        *
+ * retirement every peer is known to have committed            */
+func (server *BayouServer) truncateCommitLog() {
+    truncateLength := len(server.CommitLog)
+    for peerID, ackedTimestamp := range server.acked {
+        if peerID == server.id || server.members[peerID].Retired {
+            continue
+        }
+        peerLength := getLengthAtTime(server.CommitLog, ackedTimestamp)
+        if peerLength < truncateLength {
+            truncateLength = peerLength
+        }
+    }
+    stableCSN := server.omitCSN
+    if truncateLength > 0 {
+        stableCSN = server.CommitLog[truncateLength - 1].CSN
+    }
+    if truncateLength > 0 && truncateLength >= server.TruncationThreshold {
+        server.truncateTo(truncateLength)
+    }
+
+    retired := make(map[int]bool)
+    for id, member := range server.members {
+        if member.Retired && !member.Dropped && id != server.id &&
+                member.RetiredCSN != UNCOMMITTED_CSN &&
+                member.RetiredCSN <= stableCSN {
+            retired[id] = true
+        }
+    }
+    if len(retired) > 0 {
+        err := server.dropMembers(retired)
+        if err != nil {
+            debugf("Server #%d failed to drop retired servers: %s",
+                    server.id, err.Error())
+        }
+    }
+}
+
+/* Truncates the provided number of commits from the commit log */
+func (server *BayouServer) truncateTo(truncateLength int) {
+    // Record the truncation point, and copy the remaining commits
+    // so the truncated ones can be garbage collected
+    lastTruncated := server.CommitLog[truncateLength - 1]
+    server.omitClock = lastTruncated.Timestamp.Copy()
+    server.omitCSN = lastTruncated.CSN
+    for _, entry := range server.CommitLog[:truncateLength] {
+        server.omitAcceptClock = mergeClocks(server.omitAcceptClock,
+                entry.AcceptStamp)
+    }
+    remaining := make([]LogEntry, len(server.CommitLog) - truncateLength)
+    copy(remaining, server.CommitLog[truncateLength:])
+    server.CommitLog = remaining
+
+    // Truncated commits can no longer be sent, so they must be
+    // omitted from all future anti-entropy sessions
+    for peerID, omitTimestamp := range server.Omitted {
+        if omitTimestamp != nil {
+            server.Omitted[peerID] = laterCommit(omitTimestamp,
+                    server.omitClock)
+        }
+    }
+
+    debugf("Server #%d truncated its commit log up to CSN %d",
+            server.id, server.omitCSN)
+    server.persist(WALRecord{Rollback: NO_ROLLBACK,
+            Truncated: truncateLength, State: server.persistState()})
+}
+
+/* Returns whether the write was committed *
+ * and truncated from the commit log       */
+func (server *BayouServer) isOmitted(entry LogEntry) bool {
+    return server.omitCSN != UNCOMMITTED_CSN &&
+            server.omitAcceptClock.Dominates(entry.AcceptStamp)
+}
+
+/* Returns the later of two commit timestamps *
+ * (commits are totally ordered by timestamp)  */
+func laterCommit(timestamp VectorClock, other VectorClock) VectorClock {
+    if timestamp.TotalCompare(other) < 0 {
+        return other
+    }
+    return timestamp
 }
 
 /* Applies an operation to the server's database      *
  * If toCommit is true, it is applied to the server's *
  * commit view, else it is applied to the full view   *
- * Returns whether there was a conflict, and if so,   *
- * whether it was resolved                            */
-func (server *BayouServer) applyToDB(toCommit bool, query string,
-        depcheck string, merge string) (hasConflict bool, resolved bool) {
+ * The operation is applied within a transaction, so  *
+ * if any of its statements fail, none take effect    *
+ * Records which alternate write (if any) was applied *
+ * and any error on the entry, and returns whether    *
+ * there was a conflict, if so, whether it was        *
+ * resolved, and the error (if any)                   */
+func (server *BayouServer) applyToDB(toCommit bool,
+        entry *LogEntry) (hasConflict bool, resolved bool, err error) {
     // Get the database to apply the operation on
     db := server.fullDB
     if toCommit {
@@ -603,65 +1624,183 @@ func (server *BayouServer) applyToDB(toCommit bool, query string,
     server.dbLock.Lock()
     defer server.dbLock.Unlock()
 
-    // If there are no dependency conflicts, apply the operation to
-    // the database. If there is, try to apply the merge function
-    if (db.Check(depcheck)) {
-        db.Execute(query)
-        hasConflict = false
-        resolved = true
-    } else {
-        hasConflict = true
-        if (db.Check(merge)) {
-            resolved = true
-        } else {
-            resolved = false
+    // Commits the view already reflects are not applied again (e.g. if
+    // its database was saved after applying one, but the log was not)
+    if entry.CSN != UNCOMMITTED_CSN && entry.CSN <= db.applied.CSN {
+        return
+    }
+
+    entry.Alternate = NO_ALTERNATE
+    entry.Error = ""
+    entry.Resolved = false
+    entry.Merged = false
+    applied := db.applied.apply(*entry)
+    hasConflict, resolved, err = db.applyEntry(entry, applied)
+
+    // Failed writes are kept in the log, but have no effect
+    // (though they are still recorded as applied to the view)
+    if err != nil {
+        debugf("Server #%d failed to apply write %d: %s", server.id,
+                entry.WriteID, err.Error())
+        entry.Alternate = NO_ALTERNATE
+        entry.Error = err.Error()
+        resolved = false
+        saveErr := db.saveApplied(applied)
+        if saveErr != nil {
+            debugf("Server #%d failed to record write %d as applied: %s",
+                    server.id, entry.WriteID, saveErr.Error())
         }
+        return
     }
+    entry.Resolved = resolved
+    entry.Merged = hasConflict && resolved &&
+            entry.Alternate == NO_ALTERNATE
 
+    // Membership changes also update this server's view of the network
+    if entry.Membership.Change != NO_MEMBER_CHANGE {
+        server.applyMembership(*entry)
+    }
     return
 }
 
-/* Rolls back the full view to the state  *
- * it possessed at the provided timestamp */
-func (server *BayouServer) rollbackDB(rollbackTime VectorClock) {
-    // Apply undo operations until we find the target
-    targetIndex := -1
-    for i := len(server.TentativeLog) - 1; i >= 0; i-- {
-        if !rollbackTime.LessThan(server.TentativeLog[i].Timestamp) {
-            targetIndex = i
-            break
+/* Rolls back the full view to the state it possessed *
+ * when the tentative log had the provided length, by  *
+ * undoing the writes after it, or rebuilding the view *
+ * and reapplying the writes before it (depending on   *
+ * the rollback mode, or if a write cannot be undone)  *
+ * Returns an error if the view cannot be rebuilt, in  *
+ * which case the logs are left as they were           */
+func (server *BayouServer) rollbackDB(targetLength int) error {
+    if server.RollbackMode == ROLLBACK_REBUILD ||
+            !server.undoWrites(targetLength) {
+        debugf("Server #%d rebuilding its full view to roll it back",
+                server.id)
+        err := server.rebuildFullView()
+        if err != nil {
+            return err
+        }
+        for idx := 0; idx < targetLength; idx++ {
+            server.applyToDB(false, &server.TentativeLog[idx])
         }
-        server.applyToDB(false, server.UndoLog[i].Query,
-                server.UndoLog[i].Check, server.UndoLog[i].Merge)
     }
 
-    // If all tentative writes occurred after the target time, and
-    // the latest commit entry also occurred after the target time,
-    // we are trying to rollback committed entries, which is not allowed
-    if targetIndex == -1 && len(server.CommitLog) > 0 &&
-            !rollbackTime.LessThan(
-                    server.CommitLog[len(server.CommitLog) - 1].Timestamp) {
-        errMsg := fmt.Sprintf("Programmer Error: Attempted to rollback " +
-        "committed entries (Rollback Time: %s)", rollbackTime.String())
-        Log.Fatal(errMsg)
+    // Truncate the write and undo logs, then record the rollback
+    server.TentativeLog = server.TentativeLog[:targetLength]
+    server.UndoLog = server.UndoLog[:targetLength]
+    server.persist(WALRecord{Rollback: targetLength})
+    return nil
+}
+
+/* Undoes the writes of the tentative log after the provided length *
+ * in the full view, returning false if any of them failed (or had  *
+ * no undo), in which case the writes after it remain undone        *
+ * Only the writes the view's applied index reflects are undone, so *
+ * a rollback that failed part way through can be retried           */
+func (server *BayouServer) undoWrites(targetLength int) bool {
+    applied := server.fullDB.applied
+    numApplied := applied.numApplied(server.TentativeLog)
+    if numApplied < targetLength ||
+            applied.CSN != server.commitDB.applied.CSN {
+        return false
     }
 
-    // Truncate the write and undo logs, then save to stable storage
-    server.TentativeLog = server.TentativeLog[:targetIndex+1]
-    server.UndoLog = server.UndoLog[:targetIndex+1]
-    server.savePersist()
+    // Apply undo operations in reverse order until we reach the target
+    // (using the undo of the entry's alternate write, if one was applied,
+    // and reverting the captured changes of its merge, if it ran instead)
+    // Note: writes that failed, or whose conflicts were not resolved,
+    // had no effect, so they are not undone
+    for i := numApplied - 1; i >= targetLength; i-- {
+        undoEntry := server.UndoLog[i]
+        tentEntry := server.TentativeLog[i]
+        if !tentEntry.Resolved {
+            continue
+        }
+        if tentEntry.Alternate != NO_ALTERNATE {
+            alternate := tentEntry.Alternates[tentEntry.Alternate]
+            undoEntry.Query = alternate.Undo
+            undoEntry.QueryArgs = alternate.UndoArgs
+        }
+        if tentEntry.Merged {
+            undoEntry.Query = ""
+        }
+
+        // Writes without an undo are undone by reverting the
+        // changes captured when they were last applied
+        if undoEntry.Query == "" {
+            server.dbLock.Lock()
+            undo, captured, err := server.fullDB.loadUndo(i,
+                    tentEntry.WriteID)
+            server.dbLock.Unlock()
+            if err != nil || !captured {
+                debugf("Server #%d has no undo for write %d", server.id,
+                        tentEntry.WriteID)
+                return false
+            }
+            undoEntry.Query = undo
+            undoEntry.QueryArgs = nil
+        }
+
+        err := server.undoInDB(&undoEntry, applied.undo(numApplied - i))
+        if err != nil {
+            return false
+        }
+    }
+
+    // Record the removal of failed writes that were not undone last
+    applied = applied.undo(numApplied - targetLength)
+    if len(server.fullDB.applied.Writes) != len(applied.Writes) {
+        server.dbLock.Lock()
+        err := server.fullDB.saveApplied(applied)
+        server.dbLock.Unlock()
+        if err != nil {
+            debugf("Server #%d failed to record rollback: %s", server.id,
+                    err.Error())
+        }
+    }
+    return true
+}
+
+/* Applies a write's undo operation to the full view, recording *
+ * the provided index as the position the view then reflects    */
+func (server *BayouServer) undoInDB(undoEntry *LogEntry,
+        applied AppliedIndex) error {
+    server.dbLock.Lock()
+    defer server.dbLock.Unlock()
+    _, _, err := server.fullDB.applyEntry(undoEntry, applied)
+    if err != nil {
+        debugf("Server #%d failed to undo write %d: %s", server.id,
+                undoEntry.WriteID, err.Error())
+    }
+    return err
 }
 
 /* Updates commit and tentative clocks to the        *
  * appropiate values, based on their respective logs */
 func (server *BayouServer) updateClocks() {
+    // Note: clock is copied, since it is incremented in place
+    // (if all commits were truncated, the last truncated one is used)
+    lastCommit := server.omitClock
     lastCommitIdx := len(server.CommitLog) - 1
-    lastTentativeIdx := len(server.TentativeLog) - 1
     if lastCommitIdx >= 0 {
-        server.commitClock = server.CommitLog[lastCommitIdx].Timestamp
+        lastCommit = server.CommitLog[lastCommitIdx].Timestamp
     }
-    if lastTentativeIdx >= 0 {
-        server.tentativeClock = server.TentativeLog[lastTentativeIdx].Timestamp
+    server.commitClock = lastCommit.Copy()
+
+    // The tentative clock never moves backwards, so that this server
+    // never reuses an accept stamp (which session guarantees rely on)
+    server.tentativeClock = mergeClocks(server.tentativeClock,
+            server.omitAcceptClock)
+    // Writes this server accepts next are also stamped after
+    // all the writes in its logs
+    for _, entry := range server.CommitLog {
+        server.tentativeClock = mergeClocks(server.tentativeClock,
+                entry.AcceptStamp)
+        server.hlc.Observe(entry.HLC)
+    }
+    for _, entry := range server.TentativeLog {
+        server.tentativeClock = mergeClocks(server.tentativeClock,
+                entry.AcceptStamp)
+        server.hlc.Observe(entry.HLC)
     }
 }
 
@@ -671,8 +1810,10 @@ func (server *BayouServer) resetAntiEntropyTimer() {
     server.antiEntropyTimer.Reset(getRandomTimeout(ANTI_ENTROPY_TIMEOUT_MIN))
 }
 
-/* Saves server data to stable storage */
-func (server *BayouServer) savePersist() {
+/* Saves a checkpoint of all server data to stable storage, *
+ * along with the WAL segment its replay resumes from        *
+ * Returns an error if the checkpoint could not be saved     */
+func (server *BayouServer) savePersist() error {
     var data bytes.Buffer
     enc := gob.NewEncoder(&data)
 
@@ -691,23 +1832,67 @@ func (server *BayouServer) savePersist() {
     err = enc.Encode(server.ErrorLog)
     check(err, "Error encoding: ")
 
+    err = enc.Encode(server.Omitted)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.acked)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.omitClock)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.omitCSN)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.omitAcceptClock)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.members)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.epoch)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.wal.segment)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.recoveryCSN)
+    check(err, "Error encoding: ")
+
+    err = enc.Encode(server.promised)
+    check(err, "Error encoding: ")
+
     // Save data to persistent file
-    save(data.Bytes(), server.id)
+    return server.store.save(data.Bytes())
+}
+
+/* Loads server data from stable storage: the latest checkpoint, *
+ * then the WAL records appended since. Records are appended to  *
+ * a new segment, since the last one may end with a torn record  *
+ * Returns an error if the WAL cannot be replayed or reopened    */
+func (server *BayouServer) loadPersist() error {
+    fromSegment := server.loadCheckpoint()
+    lastSegment, err := server.wal.Replay(fromSegment, server.replayRecord)
+    if err != nil {
+        return err
+    }
+    return server.wal.Open(lastSegment + 1)
 }
 
-/* Loads server data from stable storage */
-func (server *BayouServer) loadPersist() {
+/* Loads the latest checkpoint of server data (if there is any), *
+ * and returns the WAL segment its replay resumes from           */
+func (server *BayouServer) loadCheckpoint() int {
     var data bytes.Buffer
     var b  []byte
 
     // Load the data from persistent file as byte array
-    b, err := load(server.id)
+    b, err := server.store.load()
     if err != nil {
         if err.Error() != FILE_NOT_FOUND_ERROR {
             debugf("Server #%d: Error loading persistent database file: %s",
                     server.id, err)
         }
-        return
+        return 0
     }
     data.Write(b)
 
@@ -727,5 +1912,45 @@ func (server *BayouServer) loadPersist() {
 
     err = dec.Decode(&server.ErrorLog)
     check(err, "Error decoding: ")
+
+    // Files saved before commit log truncation end here
+    err = dec.Decode(&server.Omitted)
+    if err == io.EOF {
+        return 0
+    }
+    check(err, "Error decoding: ")
+
+    err = dec.Decode(&server.acked)
+    check(err, "Error decoding: ")
+
+    err = dec.Decode(&server.omitClock)
+    check(err, "Error decoding: ")
+
+    err = dec.Decode(&server.omitCSN)
+    check(err, "Error decoding: ")
+
+    err = dec.Decode(&server.omitAcceptClock)
+    check(err, "Error decoding: ")
+
+    err = dec.Decode(&server.members)
+    check(err, "Error decoding: ")
+
+    err = dec.Decode(&server.epoch)
+    check(err, "Error decoding: ")
+
+    var segment int
+    err = dec.Decode(&segment)
+    check(err, "Error decoding: ")
+
+    // Files saved before lost commits were recovered end here
+    err = dec.Decode(&server.recoveryCSN)
+    if err == io.EOF {
+        return segment
+    }
+    check(err, "Error decoding: ")
+
+    err = dec.Decode(&server.promised)
+    check(err, "Error decoding: ")
+    return segment
 }
 
@@ -0,0 +1,159 @@
+package bayou
+
+import (
+    "errors"
+    "fmt"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Maximum time (in ms) a server waits for its view *
+ * to satisfy a session's guarantees before failing */
+const SESSION_WAIT_TIMEOUT int = ANTI_ENTROPY_TIMEOUT_MIN * 4
+
+/* Time (in ms) to wait between checks of *
+ * whether a session's guarantees are met */
+const SESSION_POLL_INTERVAL int = 10
+
+/* Bayou session guarantees (may be combined with |) */
+const (
+    // Reads reflect all previous writes of the session
+    READ_YOUR_WRITES SessionGuarantee = 1 << iota
+    // Reads never see an older view than previous reads
+    MONOTONIC_READS
+    // Writes are ordered after all writes previously read
+    WRITES_FOLLOW_READS
+    // Writes are ordered after all previous writes of the session
+    MONOTONIC_WRITES
+)
+
+/* Session providing no guarantees */
+const NO_GUARANTEES SessionGuarantee = 0
+
+/* Session providing all four guarantees */
+const ALL_GUARANTEES SessionGuarantee = READ_YOUR_WRITES |
+        MONOTONIC_READS | WRITES_FOLLOW_READS | MONOTONIC_WRITES
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Set of guarantees selected for a session */
+type SessionGuarantee int
+
+/* State of a client session: the guarantees selected, and *
+ * vector clocks summarizing the writes the session has    *
+ * read (ReadClock) and issued (WriteClock)                */
+type Session struct {
+    Guarantees SessionGuarantee
+    ReadClock  VectorClock
+    WriteClock VectorClock
+}
+
+/***********************
+ *   SESSION METHODS   *
+ ***********************/
+
+/* Returns a new session providing the provided guarantees */
+func NewSession(guarantees SessionGuarantee) *Session {
+    return &Session{guarantees, NewVectorClock(0), NewVectorClock(0)}
+}
+
+/* Returns whether the session provides the provided guarantee */
+func (session Session) Has(guarantee SessionGuarantee) bool {
+    return session.Guarantees & guarantee != 0
+}
+
+/* Returns the clock a server's view must dominate *
+ * before it may serve a read for this session     */
+func (session Session) readDependencies() VectorClock {
+    deps := NewVectorClock(0)
+    if session.Has(READ_YOUR_WRITES) {
+        deps = mergeClocks(deps, session.WriteClock)
+    }
+    if session.Has(MONOTONIC_READS) {
+        deps = mergeClocks(deps, session.ReadClock)
+    }
+    return deps
+}
+
+/* Returns the clock a server's view must dominate *
+ * before it may accept a write for this session   */
+func (session Session) writeDependencies() VectorClock {
+    deps := NewVectorClock(0)
+    if session.Has(WRITES_FOLLOW_READS) {
+        deps = mergeClocks(deps, session.ReadClock)
+    }
+    if session.Has(MONOTONIC_WRITES) {
+        deps = mergeClocks(deps, session.WriteClock)
+    }
+    return deps
+}
+
+/* Records that the session read a view with the provided clock */
+func (session *Session) observeRead(viewClock VectorClock) {
+    session.ReadClock = mergeClocks(session.ReadClock, viewClock)
+}
+
+/* Records that the session issued a write with the provided stamp */
+func (session *Session) observeWrite(acceptStamp VectorClock) {
+    session.WriteClock = mergeClocks(session.WriteClock, acceptStamp)
+}
+
+/*********************************
+ *   SERVER SESSION UTILITIES    *
+ *********************************/
+
+/* Waits until the server's commit or full view includes all    *
+ * writes covered by the provided dependency clock. Must be     *
+ * called while holding logLock, which is released while        *
+ * waiting. Returns an error if the view does not catch up      *
+ * within SESSION_WAIT_TIMEOUT                                  */
+func (server *BayouServer) awaitSession(deps VectorClock,
+        fromCommit bool) error {
+    // Dropped servers' writes were all committed before they were
+    // dropped, so every view includes them
+    waited := 0
+    for !server.viewClock(fromCommit).Dominates(
+            deps.without(server.droppedIDs())) {
+        if waited >= SESSION_WAIT_TIMEOUT {
+            return errors.New(fmt.Sprintf("Server #%d %s: view %s does " +
+                    "not include %s", server.id, SESSION_ERROR,
+                    server.viewClock(fromCommit).String(), deps.String()))
+        }
+        server.logLock.Unlock()
+        sleep(SESSION_POLL_INTERVAL, false)
+        waited += SESSION_POLL_INTERVAL
+        server.logLock.Lock()
+        if !server.isActive {
+            return server.inactiveError()
+        }
+    }
+    return nil
+}
+
+/* Returns a clock covering the accept stamps of all writes    *
+ * reflected in the commit view (if fromCommit is true), or    *
+ * the full view (otherwise), including truncated commits      */
+func (server *BayouServer) viewClock(fromCommit bool) VectorClock {
+    clock := mergeClocks(NewVectorClock(0), server.omitAcceptClock)
+    for _, entry := range server.CommitLog {
+        clock = mergeClocks(clock, entry.AcceptStamp)
+    }
+    if !fromCommit {
+        for _, entry := range server.TentativeLog {
+            clock = mergeClocks(clock, entry.AcceptStamp)
+        }
+    }
+    return clock
+}
+
+/* Returns a new vector clock holding the max of the logical *
+ * times of both clocks, which may cover different servers   */
+func mergeClocks(vc VectorClock, other VectorClock) VectorClock {
+    merged := vc.Copy()
+    merged.Max(other)
+    return merged
+}
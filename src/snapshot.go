@@ -0,0 +1,507 @@
+package bayou
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "github.com/mattn/go-sqlite3"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Peer ID used when no peer is selected */
+const NO_PEER int = -1
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* Consistent copy of a server's commit view, used to *
+ * catch up servers missing commits that were already *
+ * truncated from the commit log (or new servers)     */
+type Snapshot struct {
+    // Contents of the commit database
+    Database        DatabaseSnapshot
+    // Commits that were not truncated yet
+    // (which are already reflected in Database)
+    CommitLog       []LogEntry
+    // Timestamp, CSN, and accept stamps of the truncated commits
+    OmitClock       VectorClock
+    OmitCSN         int
+    OmitAcceptClock VectorClock
+    // All servers that joined the network
+    Members         []Member
+    // Epoch of the latest committed designation of the primary
+    Epoch           Epoch
+}
+
+/* Contents of a database: its tables, the statements creating *
+ * its other schema objects (indexes, views, and triggers), and *
+ * the version of the application's schema it is at             */
+type DatabaseSnapshot struct {
+    Tables        []TableSnapshot
+    Objects       []string
+    SchemaVersion int
+}
+
+/* Contents of a database table: its schema, column *
+ * names, and each row's values as SQL literals     */
+type TableSnapshot struct {
+    Name    string
+    Schema  string
+    Columns []string
+    Rows    [][]string
+}
+
+/* GetSnapshot RPC arguments structure */
+type SnapshotArgs struct {
+    SenderID int
+}
+
+/* GetSnapshot RPC reply structure */
+type SnapshotReply struct {
+    Snapshot Snapshot
+}
+
+/*********************************
+ *   DATABASE SNAPSHOT METHODS   *
+ *********************************/
+
+/* Returns the contents of the database (besides Bayou's *
+ * own tables), read within a single transaction          */
+func (db *BayouDB) Snapshot() (DatabaseSnapshot, error) {
+    var snapshot DatabaseSnapshot
+    tx, err := db.BeginTx()
+    if err != nil {
+        return snapshot, err
+    }
+    defer tx.Rollback()
+    snapshot.SchemaVersion, err = schemaVersion(tx)
+    if err != nil {
+        return snapshot, err
+    }
+
+    // Find all (non-internal) tables and their schema
+    rows, err := tx.Query(`
+        SELECT name, sql
+        FROM sqlite_master
+        WHERE type == "table" AND name NOT LIKE "sqlite_%"
+            AND substr(name, 1, ?) != ?
+        ORDER BY name
+    `, len(INTERNAL_TABLE_PREFIX), INTERNAL_TABLE_PREFIX)
+    if err != nil {
+        return snapshot, queryError(err, "Error listing tables for " +
+                "snapshot: ")
+    }
+    tables := make([]TableSnapshot, 0)
+    for rows.Next() {
+        var table TableSnapshot
+        err = rows.Scan(&table.Name, &table.Schema)
+        if err != nil {
+            rows.Close()
+            return snapshot, queryError(err, "Error scanning tables for " +
+                    "snapshot: ")
+        }
+        tables = append(tables, table)
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+        return snapshot, queryError(err, "Error listing tables for " +
+                "snapshot: ")
+    }
+
+    for idx, _ := range tables {
+        err = tx.snapshotTable(&tables[idx])
+        if err != nil {
+            return snapshot, err
+        }
+    }
+    snapshot.Tables = tables
+    snapshot.Objects, err = tx.schemaObjects()
+    return snapshot, err
+}
+
+/* Replaces the database's tables (and other schema objects) with  *
+ * the snapshot's, which may have a different schema if it is at   *
+ * a different version, and records the provided index as the      *
+ * position the database now reflects, within a single transaction *
+ * (which is rolled back on error)                                 */
+func (db *BayouDB) Restore(snapshot DatabaseSnapshot,
+        applied AppliedIndex) error {
+    tx, err := db.BeginTx()
+    if err != nil {
+        return err
+    }
+    err = tx.dropTables()
+    for idx := 0; err == nil && idx < len(snapshot.Tables); idx++ {
+        err = tx.restoreTable(snapshot.Tables[idx])
+    }
+    for idx := 0; err == nil && idx < len(snapshot.Objects); idx++ {
+        err = tx.Execute(snapshot.Objects[idx])
+    }
+    if err == nil {
+        err = tx.setSchemaVersion(snapshot.SchemaVersion)
+    }
+    if err == nil {
+        err = tx.resetApplied(applied)
+    }
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+    err = tx.Commit()
+    if err != nil {
+        return queryError(err, "Error restoring snapshot: ")
+    }
+    db.applied = applied
+    return nil
+}
+
+/* Replaces the database with a copy of the provided one (including *
+ * its applied index), using SQLite's online backup API, which       *
+ * copies the provided database's pages rather than its rows         */
+func (db *BayouDB) CopyFrom(src *BayouDB) error {
+    ctx := context.Background()
+    dstConn, err := db.Conn(ctx)
+    if err != nil {
+        return queryError(err, "Error copying database: ")
+    }
+    defer dstConn.Close()
+    srcConn, err := src.Conn(ctx)
+    if err != nil {
+        return queryError(err, "Error copying database: ")
+    }
+    defer srcConn.Close()
+
+    err = dstConn.Raw(func(dstDriverConn interface{}) error {
+        return srcConn.Raw(func(srcDriverConn interface{}) error {
+            backup, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main",
+                    srcDriverConn.(*sqlite3.SQLiteConn), "main")
+            if err != nil {
+                return err
+            }
+            _, err = backup.Step(-1)
+            if err != nil {
+                backup.Finish()
+                return err
+            }
+            return backup.Finish()
+        })
+    })
+    if err != nil {
+        return queryError(err, "Error copying database: ")
+    }
+
+    // The copy has none of the database's undo triggers
+    db.undoSchema = NO_UNDO_SCHEMA
+    _, err = db.loadApplied()
+    return err
+}
+
+/* Creates the provided table, and inserts the snapshot's rows */
+func (tx *BayouTx) restoreTable(table TableSnapshot) error {
+    err := tx.Execute(table.Schema)
+    if err != nil {
+        return err
+    }
+    columns := `"` + strings.Join(table.Columns, `", "`) + `"`
+    for _, row := range table.Rows {
+        err = tx.Execute(fmt.Sprintf(`INSERT INTO "%s"(%s) VALUES(%s)`,
+                table.Name, columns, strings.Join(row, ", ")))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Returns the statements creating the database's indexes, views, *
+ * and triggers (in the order they were created), besides those    *
+ * of SQLite and Bayou                                             */
+func (tx *BayouTx) schemaObjects() ([]string, error) {
+    result, err := tx.Read(`
+        SELECT sql
+        FROM sqlite_master
+        WHERE type != "table" AND sql IS NOT NULL
+            AND substr(name, 1, ?) != ?
+        ORDER BY rowid
+    `, len(INTERNAL_TABLE_PREFIX), INTERNAL_TABLE_PREFIX)
+    if err != nil {
+        return nil, err
+    }
+    statements := make([]string, len(result))
+    for idx, row := range result {
+        statements[idx] = row["sql"].(string)
+    }
+    return statements, nil
+}
+
+/* Reads the columns and rows of the provided table   *
+ * Values are read as SQL literals (using quote), so  *
+ * they are restored exactly as they are stored       */
+func (tx *BayouTx) snapshotTable(table *TableSnapshot) error {
+    errPrefix := "Error reading " + table.Name + " for snapshot: "
+    rows, err := tx.Query(fmt.Sprintf(`SELECT * FROM "%s" LIMIT 0`,
+            table.Name))
+    if err != nil {
+        return queryError(err, errPrefix)
+    }
+    table.Columns, err = rows.Columns()
+    rows.Close()
+    if err != nil {
+        return queryError(err, errPrefix)
+    }
+
+    quotedColumns := make([]string, len(table.Columns))
+    for idx, column := range table.Columns {
+        quotedColumns[idx] = fmt.Sprintf(`quote("%s")`, column)
+    }
+    rows, err = tx.Query(fmt.Sprintf(`SELECT %s FROM "%s"`,
+            strings.Join(quotedColumns, ", "), table.Name))
+    if err != nil {
+        return queryError(err, errPrefix)
+    }
+    defer rows.Close()
+
+    table.Rows = make([][]string, 0)
+    for rows.Next() {
+        row := make([]string, len(table.Columns))
+        rowPtrs := make([]interface{}, len(table.Columns))
+        for idx, _ := range row {
+            rowPtrs[idx] = &row[idx]
+        }
+        err = rows.Scan(rowPtrs...)
+        if err != nil {
+            return queryError(err, errPrefix)
+        }
+        table.Rows = append(table.Rows, row)
+    }
+    return queryError(rows.Err(), errPrefix)
+}
+
+/*******************************
+ *   SERVER SNAPSHOT METHODS   *
+ *******************************/
+
+/* GetSnapshot RPC Handler                    *
+ * Replies a snapshot of this server's commit *
+ * view and its remaining commit log          */
+func (server *BayouServer) GetSnapshot(args *SnapshotArgs,
+        reply *SnapshotReply) error {
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+
+    // Server may have been killed while waiting for the lock
+    if !server.isActive {
+        return server.inactiveError()
+    }
+
+    debugf("Server #%d sending snapshot to %d", server.id, args.SenderID)
+    snapshot, err := server.takeSnapshot()
+    if err != nil {
+        return err
+    }
+    reply.Snapshot = snapshot
+    return nil
+}
+
+/* Replaces this server's commit view with a snapshot of the *
+ * provided peer's, so that a new server (or one that lost   *
+ * its state) can start from it instead of replaying every   *
+ * write. Should be called before the server is started      */
+func (server *BayouServer) Bootstrap(peerID int) error {
+    server.logLock.Lock()
+    defer server.logLock.Unlock()
+    return server.pullSnapshot(peerID, true)
+}
+
+/* Returns a snapshot of this server's commit view */
+func (server *BayouServer) takeSnapshot() (Snapshot, error) {
+    var snapshot Snapshot
+
+    server.dbLock.Lock()
+    database, err := server.commitDB.Snapshot()
+    server.dbLock.Unlock()
+    if err != nil {
+        return snapshot, err
+    }
+    snapshot.Database = database
+
+    snapshot.CommitLog = make([]LogEntry, len(server.CommitLog))
+    copy(snapshot.CommitLog, server.CommitLog)
+    snapshot.OmitClock = server.omitClock
+    snapshot.OmitCSN = server.omitCSN
+    snapshot.OmitAcceptClock = server.omitAcceptClock
+    snapshot.Members = make([]Member, len(server.members))
+    copy(snapshot.Members, server.members)
+    snapshot.Epoch = server.epoch
+    return snapshot, nil
+}
+
+/* Requests a snapshot from the provided peer, and installs it *
+ * Unless holdLock is set, logLock is released while waiting   *
+ * for the peer, and a snapshot this server has since moved    *
+ * past is not installed                                       *
+ * Must be called while holding logLock                        */
+func (server *BayouServer) pullSnapshot(peerID int, holdLock bool) error {
+    args := SnapshotArgs{server.id}
+    var reply SnapshotReply
+
+    peer := server.connectPeer(peerID, holdLock)
+    if peer == nil {
+        return errors.New(fmt.Sprintf("Server #%d cannot reach server %d",
+                server.id, peerID))
+    }
+    err := server.callPeerLocked(peer, peerID, "BayouServer.GetSnapshot",
+            &args, &reply, holdLock)
+    if err != nil {
+        return err
+    }
+
+    // Commits received while waiting for the snapshot must not be
+    // rolled back, unless they were made by a replaced primary
+    snapshotCSN := reply.Snapshot.OmitCSN
+    if numCommits := len(reply.Snapshot.CommitLog); numCommits > 0 {
+        snapshotCSN = reply.Snapshot.CommitLog[numCommits - 1].CSN
+    }
+    if snapshotCSN < server.lastCSN() && !hasStaleCommits(server.epoch,
+            server.lastCSN(), reply.Snapshot.Epoch) {
+        return errors.New(fmt.Sprintf("Server #%d is past the snapshot " +
+                "from %d (CSN %d < %d)", server.id, peerID, snapshotCSN,
+                server.lastCSN()))
+    }
+
+    err = server.installSnapshot(reply.Snapshot)
+    if err != nil {
+        debugf("Server #%d failed to install snapshot from %d: %s",
+                server.id, peerID, err.Error())
+        return err
+    }
+    debugf("Server #%d installed snapshot from %d up to CSN %d",
+            server.id, peerID, server.nextCSN() - 1)
+    return nil
+}
+
+/* Replaces both views with the snapshot's commit view, adopts *
+ * its commit log and truncation point, and re-executes the    *
+ * tentative writes that the snapshot does not include (and    *
+ * the commits of a primary the snapshot's epoch replaced)     *
+ * Returns an error if the snapshot cannot be restored, in     *
+ * which case the views and logs are left as they were         */
+func (server *BayouServer) installSnapshot(snapshot Snapshot) error {
+    // Commits made by a replaced primary are committed again, so no
+    // omit timestamp past the snapshot's truncation point holds
+    stale := hasStaleCommits(server.epoch, server.lastCSN(), snapshot.Epoch)
+
+    // Both views reflect the snapshot's commits
+    applied := AppliedIndex{snapshot.OmitCSN, nil}
+    if len(snapshot.CommitLog) > 0 {
+        applied.CSN = snapshot.CommitLog[len(snapshot.CommitLog) - 1].CSN
+    }
+    err := server.swapViews(snapshot.Database, applied)
+    if err != nil {
+        return err
+    }
+
+    tentativeSet := server.TentativeLog
+    undoSet := server.UndoLog
+    if stale {
+        staleSet, staleUndoSet := staleWrites(server.CommitLog,
+                snapshot.Epoch)
+        tentativeSet = append(append([]LogEntry{}, tentativeSet...),
+                staleSet...)
+        undoSet = append(append([]LogEntry{}, undoSet...), staleUndoSet...)
+    }
+    server.TentativeLog = make([]LogEntry, 0)
+    server.UndoLog = make([]LogEntry, 0)
+    server.CommitLog = make([]LogEntry, len(snapshot.CommitLog))
+    copy(server.CommitLog, snapshot.CommitLog)
+    server.omitClock = snapshot.OmitClock
+    server.omitCSN = snapshot.OmitCSN
+    server.omitAcceptClock = snapshot.OmitAcceptClock
+    server.mergeMembers(snapshot.Members)
+    if snapshot.Epoch.NewerThan(server.epoch) {
+        server.startEpoch(snapshot.Epoch)
+    }
+
+    // Drop the servers the snapshot's server dropped, and leave
+    // the servers this one dropped out of the snapshot's stamps
+    err = server.dropMembers(droppedMembers(snapshot.Members))
+    if err != nil {
+        return err
+    }
+    server.projectClocks()
+    tentativeSet = projectEntries(tentativeSet, server.droppedIDs())
+    undoSet = projectEntries(undoSet, server.droppedIDs())
+
+    // Commits before the new truncation point can no longer be sent
+    for peerID, omitTimestamp := range server.Omitted {
+        if omitTimestamp == nil {
+            continue
+        }
+        if stale {
+            omitTimestamp = server.memberClock()
+            server.acked[peerID] = server.memberClock()
+        }
+        server.Omitted[peerID] = laterCommit(omitTimestamp, server.omitClock)
+    }
+
+    // Re-execute the tentative writes on the new full view, and
+    // checkpoint, since the new commit log was not recorded
+    // Note: this also updates the clocks
+    err = server.matchLog(nil, tentativeSet, undoSet)
+    if err != nil {
+        return err
+    }
+    server.checkpoint()
+    return nil
+}
+
+/* Replaces both views with the provided snapshot, which is    *
+ * staged in a separate database first, so either both views   *
+ * are replaced or neither is: a copy replaces a database in a *
+ * single transaction, so if the commit view's copy fails, the *
+ * full view is rebuilt from the (unchanged) commit view       */
+func (server *BayouServer) swapViews(snapshot DatabaseSnapshot,
+        applied AppliedIndex) error {
+    staging, err := newStagingDB()
+    if err != nil {
+        return queryError(err, "Error staging snapshot: ")
+    }
+    defer staging.Close()
+
+    server.dbLock.Lock()
+    err = staging.Restore(snapshot, applied)
+    if err != nil {
+        server.dbLock.Unlock()
+        return queryError(err, "Error staging snapshot: ")
+    }
+    err = server.fullDB.CopyFrom(staging)
+    if err == nil {
+        err = server.commitDB.CopyFrom(staging)
+    }
+    server.dbLock.Unlock()
+    if err == nil {
+        return nil
+    }
+
+    debugf("Server #%d failed to install snapshot, restoring its full " +
+            "view: %s", server.id, err.Error())
+    rebuildErr := server.rebuildFullView()
+    if rebuildErr != nil {
+        return errors.New(fmt.Sprintf("Error installing snapshot: %s " +
+                "(%s)", err.Error(), rebuildErr.Error()))
+    }
+    for idx, _ := range server.TentativeLog {
+        server.applyToDB(false, &server.TentativeLog[idx])
+    }
+    return queryError(err, "Error installing snapshot: ")
+}
@@ -0,0 +1,241 @@
+package bayou
+
+import (
+    "fmt"
+    "strings"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Table the changes made by a write are captured in, as the    *
+ * statements reverting them (NULL for changes that cannot be)  */
+const UNDO_CAPTURE_TABLE string = INTERNAL_TABLE_PREFIX + "undo_capture"
+
+/* Prefix of the names of the triggers capturing changes */
+const UNDO_TRIGGER_PREFIX string = INTERNAL_TABLE_PREFIX + "undo_"
+
+/* Schema cookie of databases whose undo triggers were never created */
+const NO_UNDO_SCHEMA int = -1
+
+/*****************************
+ *   DATABASE UNDO METHODS   *
+ *****************************/
+
+/* Creates the table changes are captured in, if needed */
+func (db *BayouDB) createUndoCaptureTable() error {
+    _, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS ` + UNDO_CAPTURE_TABLE + `(
+        Seq INTEGER PRIMARY KEY,
+        Statement TEXT
+    );
+    `)
+    return err
+}
+
+/* Returns the undo captured when the provided write was applied at  *
+ * the provided position after the applied CSN, and whether there is *
+ * one (there is none if the write's changes could not be captured,  *
+ * or the database did not apply it at that position)                */
+func (db *BayouDB) loadUndo(position int, writeID int) (string, bool,
+        error) {
+    result, err := db.Read(`
+        SELECT WriteID, Undo
+        FROM ` + APPLIED_WRITES_TABLE + `
+        ORDER BY Seq LIMIT 1 OFFSET ?
+    `, position)
+    if err != nil || len(result) == 0 {
+        return "", false, err
+    }
+    undo, captured := result[0]["Undo"].(string)
+    if int(result[0]["WriteID"].(int64)) != writeID || !captured {
+        return "", false, nil
+    }
+    return undo, true, nil
+}
+
+/********************************
+ *   TRANSACTION UNDO METHODS   *
+ ********************************/
+
+/* Prepares the transaction to capture the changes made by a write, *
+ * creating the triggers capturing them if the schema changed since *
+ * the provided cookie. Returns the schema cookie captured with     */
+func (tx *BayouTx) startUndoCapture(schema int) (int, error) {
+    // Rows deleted by a REPLACE only fire triggers if they are recursive
+    err := tx.Execute("PRAGMA recursive_triggers = ON")
+    if err != nil {
+        return schema, err
+    }
+    current, err := tx.schemaCookie()
+    if err != nil || current == schema {
+        return current, err
+    }
+    err = tx.createUndoTriggers()
+    if err != nil {
+        return schema, err
+    }
+    return tx.schemaCookie()
+}
+
+/* Returns the statements undoing the changes captured since the   *
+ * capture started (in reverse order), and clears them. Returns    *
+ * false if some of them cannot be undone, or the write changed    *
+ * the schema (e.g. created a table) since the provided cookie     */
+func (tx *BayouTx) takeUndo(schema int) (string, bool, error) {
+    result, err := tx.Read(`SELECT Statement FROM ` + UNDO_CAPTURE_TABLE +
+            ` ORDER BY Seq DESC`)
+    if err != nil {
+        return "", false, err
+    }
+    err = tx.Execute(`DELETE FROM ` + UNDO_CAPTURE_TABLE)
+    if err != nil {
+        return "", false, err
+    }
+    current, err := tx.schemaCookie()
+    if err != nil {
+        return "", false, err
+    }
+
+    captured := current == schema
+    statements := make([]string, 0, len(result))
+    for _, row := range result {
+        statement, ok := row["Statement"].(string)
+        if !ok {
+            captured = false
+            break
+        }
+        statements = append(statements, statement)
+    }
+    if !captured {
+        return "", false, nil
+    }
+    return strings.Join(statements, ";\n"), true, nil
+}
+
+/* Records the provided undo for the last applied write *
+ * (or that it has none, if it was not captured)         */
+func (tx *BayouTx) saveUndo(undo string, captured bool) error {
+    var undoArg interface{} = nil
+    if captured {
+        undoArg = undo
+    }
+    return tx.Execute(`
+        UPDATE ` + APPLIED_WRITES_TABLE + ` SET Undo = ?
+        WHERE Seq == (SELECT max(Seq) FROM ` + APPLIED_WRITES_TABLE + `)
+    `, undoArg)
+}
+
+/* Replaces the triggers capturing changes with ones for the current *
+ * tables (whose columns may have changed since they were created)   */
+func (tx *BayouTx) createUndoTriggers() error {
+    result, err := tx.Read(`
+        SELECT name
+        FROM sqlite_master
+        WHERE type == "trigger" AND substr(name, 1, ?) == ?
+    `, len(UNDO_TRIGGER_PREFIX), UNDO_TRIGGER_PREFIX)
+    if err != nil {
+        return err
+    }
+    for _, row := range result {
+        err = tx.Execute(fmt.Sprintf(`DROP TRIGGER "%s"`, row["name"]))
+        if err != nil {
+            return err
+        }
+    }
+
+    names, err := tx.tableNames()
+    if err != nil {
+        return err
+    }
+    for _, name := range names {
+        columns, hasRowID, err := tx.tableColumns(name)
+        if err != nil {
+            return err
+        }
+        err = tx.Execute(getUndoTriggers(name, columns, hasRowID))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Returns the column names of the provided table, and whether its *
+ * rows have a rowid (which undo statements identify them by)      */
+func (tx *BayouTx) tableColumns(name string) ([]string, bool, error) {
+    errPrefix := "Error reading columns of " + name + ": "
+    rows, err := tx.Query(fmt.Sprintf(`SELECT * FROM "%s" LIMIT 0`, name))
+    if err != nil {
+        return nil, false, queryError(err, errPrefix)
+    }
+    columns, err := rows.Columns()
+    rows.Close()
+    if err != nil {
+        return nil, false, queryError(err, errPrefix)
+    }
+
+    // Tables created WITHOUT ROWID have no rowid column
+    rows, err = tx.Query(fmt.Sprintf(`SELECT rowid FROM "%s" LIMIT 0`, name))
+    if err != nil {
+        return columns, false, nil
+    }
+    rows.Close()
+    return columns, true, nil
+}
+
+/* Returns SQLite's schema cookie for the database, *
+ * which changes whenever a table (or trigger) does *
+ * (unlike the application's schema version)        */
+func (tx *BayouTx) schemaCookie() (int, error) {
+    result, err := tx.Read("PRAGMA schema_version")
+    if err != nil {
+        return NO_UNDO_SCHEMA, err
+    }
+    return int(result[0]["schema_version"].(int64)), nil
+}
+
+/**********************
+ *   UNDO UTILITIES   *
+ **********************/
+
+/* Returns the statements creating the triggers that capture the     *
+ * changes to the provided table, as statements restoring the rows'  *
+ * previous values. Changes to tables without a rowid are captured   *
+ * as changes that cannot be undone                                  */
+func getUndoTriggers(table string, columns []string, hasRowID bool) string {
+    capture := func(event string, statement string) string {
+        return fmt.Sprintf(`
+        CREATE TRIGGER "%s%s_%s" AFTER %s ON "%s" BEGIN
+            INSERT INTO %s(Statement) VALUES(%s);
+        END;`, UNDO_TRIGGER_PREFIX, strings.ToLower(event), table, event,
+                table, UNDO_CAPTURE_TABLE, statement)
+    }
+    if !hasRowID {
+        return capture("INSERT", "NULL") + capture("DELETE", "NULL") +
+                capture("UPDATE", "NULL")
+    }
+
+    // Inserted rows are deleted, deleted rows inserted again,
+    // and updated rows set back to their old values
+    names := make([]string, len(columns))
+    oldValues := make([]string, len(columns))
+    assignments := make([]string, len(columns))
+    for idx, column := range columns {
+        names[idx] = fmt.Sprintf(`"%s"`, column)
+        oldValues[idx] = fmt.Sprintf(`quote(OLD."%s")`, column)
+        assignments[idx] = fmt.Sprintf(`', "%s" = ' || quote(OLD."%s")`,
+                column, column)
+    }
+    undoInsert := fmt.Sprintf(`'DELETE FROM "%s" WHERE rowid = ' ||
+            NEW.rowid`, table)
+    undoDelete := fmt.Sprintf(`'INSERT INTO "%s"(rowid, %s) VALUES(' ||
+            OLD.rowid || ', ' || %s || ')'`, table, strings.Join(names, ", "),
+            strings.Join(oldValues, ` || ', ' || `))
+    undoUpdate := fmt.Sprintf(`'UPDATE "%s" SET rowid = ' || OLD.rowid ||
+            %s || ' WHERE rowid = ' || NEW.rowid`, table,
+            strings.Join(assignments, " || "))
+    return capture("INSERT", undoInsert) + capture("DELETE", undoDelete) +
+            capture("UPDATE", undoUpdate)
+}
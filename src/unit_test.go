@@ -1,12 +1,22 @@
 package bayou
 
 import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/gob"
     "fmt"
+    "hash/crc32"
+    "net"
     "net/rpc"
     "os"
     "path/filepath"
+    "reflect"
+    "strings"
     "sync"
     "testing"
+    "testing/quick"
+    "time"
 )
 
 /*************************
@@ -46,7 +56,15 @@ func getDB(filename string, reset bool) *BayouDB {
     if reset {
         os.RemoveAll(dbFilepath)
     }
-    return InitDB(dbFilepath)
+    db, err := InitDB(dbFilepath)
+    check(err, "Error opening test database: ")
+    return db
+}
+
+/* Returns the directory the persist files of the *
+ * provided test's servers are stored in           */
+func getDataDir(testName string) string {
+    return filepath.Join("db", testName + "_data")
 }
 
 /* Fails provided test if rooms are not equal */
@@ -60,12 +78,22 @@ func assertRoomsEqual(t *testing.T, room Room, exp Room) {
     }
 }
 
+/* Decodes the provided read result into a slice of Rooms, *
+ * failing the provided test if it cannot be decoded        */
+func scanRooms(t *testing.T, result ResultSet) []Room {
+    var rooms []Room
+    ensureNoError(t, result.Scan(&rooms), "Decoding rooms failed: ")
+    return rooms
+}
+
 /* Tests basic database functionality */
 func TestUnitDBBasic(t *testing.T) {
     // Open the Database
     const dbpath = "dbbasic.db"
     db := getDB(dbpath, true)
     defer db.Close()
+    err := db.Execute(ROOMS_SCHEMA.Tables)
+    ensureNoError(t, err, "Creating tables failed: ")
 
     name := "Fine"
     startDate := createDate(0, 0)
@@ -81,17 +109,19 @@ func TestUnitDBBasic(t *testing.T) {
         EndTime
     ) values("%s", dateTime("%s"), dateTime("%s"))
     `, name, startTxt, endTxt)
-    db.Execute(query)
+    err = db.Execute(query)
+    ensureNoError(t, err, "Insertion query failed: ")
 
     // Execute read query
     readQuery := `
         SELECT Name, StartTime, EndTime
         FROM rooms
     `
-    result := db.Read(readQuery)
+    result, err := db.ReadTyped(readQuery)
+    ensureNoError(t, err, "Read query failed: ")
 
     // Ensure results are as expected
-    rooms := deserializeRooms(result)
+    rooms := scanRooms(t, result)
     assertEqual(t, len(rooms), 1, "Read query returned wrong number of rooms.")
     assertRoomsEqual(t, rooms[0], Room{name, startDate, endDate})
 
@@ -105,13 +135,99 @@ func TestUnitDBBasic(t *testing.T) {
     THEN CAST(1 AS BIT)
     ELSE CAST(0 AS BIT) END
     `, startTxt, endTxt);
-    assert(t, db.Check(check), "Dependency check failed.")
+    passed, err := db.Check(check)
+    ensureNoError(t, err, "Dependency check query failed: ")
+    assert(t, passed, "Dependency check failed.")
 
     // Execute a merge check query
     merge := `
     SELECT 0
     `
-    assert(t, !db.Check(merge), "Merge check failed.")
+    passed, err = db.Check(merge)
+    ensureNoError(t, err, "Merge check query failed: ")
+    assert(t, !passed, "Merge check failed.")
+
+    // Ensure malformed queries return errors
+    err = db.Execute("INSERT INTO nowhere VALUES(1)")
+    assert(t, err != nil, "Malformed query did not return an error")
+    _, err = db.Read("SELEC * FROM rooms")
+    assert(t, err != nil, "Malformed read did not return an error")
+    _, err = db.Check("SELECT 1 WHERE 0")
+    assert(t, err != nil, "Check without a result did not return an error")
+}
+
+/* Tests that read results hold the same types whatever the *
+ * columns' declared types (even once sent over the wire),   *
+ * and that they are decoded into structs by field tag       */
+func TestUnitDBTypedRead(t *testing.T) {
+    db := getDB("dbtyped.db", true)
+    defer db.Close()
+    err := db.Execute(`
+        CREATE TABLE typed(Count INTEGER, Ratio REAL, Label VARCHAR(16),
+                Data BLOB, Created DATETIME, Done BOOLEAN, Note TEXT);
+        INSERT INTO typed VALUES(3, 0.5, 'first', x'0102',
+                '2000-01-01 10:00:00', 1, NULL);
+    `)
+    ensureNoError(t, err, "Creating typed table failed: ")
+    result, err := db.ReadTyped(`SELECT *, dateTime(Created, '+1 hour') ` +
+            `AS Later FROM typed`)
+    ensureNoError(t, err, "Typed read failed: ")
+
+    // Ensure values are normalized, and survive encoding
+    var buffer bytes.Buffer
+    err = gob.NewEncoder(&buffer).Encode(result)
+    ensureNoError(t, err, "Encoding read result failed: ")
+    var decoded ResultSet
+    err = gob.NewDecoder(&buffer).Decode(&decoded)
+    ensureNoError(t, err, "Decoding read result failed: ")
+    assertEqual(t, len(decoded.Columns), 8, "Read wrong number of columns")
+    assertEqual(t, decoded.Columns[2], ResultColumn{"Label", "VARCHAR(16)"},
+            "Read wrong column name or type")
+    assertEqual(t, len(decoded.Rows), 1, "Read wrong number of rows")
+    exp := []interface{}{int64(3), float64(0.5), "first", []byte{1, 2},
+            createDate(1, 10), int64(1), nil, "2000-01-01 11:00:00"}
+    for idx, value := range decoded.Rows[0] {
+        failMsg := fmt.Sprintf("Column %s read as %T %v",
+                decoded.Columns[idx].Name, value, value)
+        if expTime, isTime := exp[idx].(time.Time); isTime {
+            readTime, ok := value.(time.Time)
+            assert(t, ok && timesEqual(readTime, expTime), failMsg)
+        } else {
+            assert(t, reflect.DeepEqual(value, exp[idx]), failMsg)
+        }
+    }
+
+    // Ensure rows are decoded into tagged (or same-named) fields,
+    // converting values to the fields' types
+    type row struct {
+        Count   int
+        Ratio   float32
+        Name    string    `bayou:"Label"`
+        Data    []byte
+        Created time.Time
+        Done    bool
+        Note    *string
+        Later   time.Time
+        Label   string    `bayou:"-"`
+    }
+    var rows []*row
+    err = decoded.Scan(&rows)
+    ensureNoError(t, err, "Scanning read result failed: ")
+    assertEqual(t, len(rows), 1, "Scanned wrong number of rows")
+    scanned := *rows[0]
+    assert(t, scanned.Count == 3 && scanned.Ratio == 0.5 &&
+            scanned.Name == "first" && reflect.DeepEqual(scanned.Data,
+            []byte{1, 2}) && scanned.Done && scanned.Note == nil &&
+            scanned.Label == "", fmt.Sprintf("Scanned wrong values: %+v",
+            scanned))
+    assert(t, timesEqual(scanned.Created, createDate(1, 10)) &&
+            timesEqual(scanned.Later, createDate(1, 11)), "Scanned wrong " +
+            "times")
+
+    // Ensure values are not decoded into incompatible fields
+    var labels []struct{ Label int }
+    assert(t, decoded.Scan(&labels) != nil, "Scanned text into an integer")
+    assert(t, decoded.Scan(rows) != nil, "Scanned rows into a non-pointer")
 }
 
 /*****************************
@@ -124,23 +240,34 @@ func assertVCsEqual(t *testing.T, vc VectorClock, exp VectorClock) {
     if len(vc) != len(exp) {
         t.Fatal(failMsg)
     }
-    for idx, _ := range vc {
-        if vc[idx] != exp[idx] {
+    for idx, time := range vc {
+        expTime, exists := exp[idx]
+        if !exists || time != expTime {
             t.Fatal(failMsg)
         }
     }
 }
 
+/* Returns a vector clock with the provided logical times *
+ * for the servers with IDs 0 through len(times) - 1       */
+func clockOf(times ...int) VectorClock {
+    vc := NewVectorClock(len(times))
+    for idx, time := range times {
+        vc[idx] = time
+    }
+    return vc
+}
+
 /* Unit tests vector clock */
 func TestUnitVectorClock(t *testing.T) {
     vc := NewVectorClock(4)
-    assertVCsEqual(t, vc, VectorClock{0, 0, 0, 0})
+    assertVCsEqual(t, vc, clockOf(0, 0, 0, 0))
 
     // Ensure Inc works as expected
     vc.Inc(1)
     vc.Inc(3)
     vc.Inc(3)
-    assertVCsEqual(t, vc, VectorClock{0, 1, 0, 2})
+    assertVCsEqual(t, vc, clockOf(0, 1, 0, 2))
 
     // Ensure Set works as expected
     err := vc.SetTime(0, 6)
@@ -149,7 +276,7 @@ func TestUnitVectorClock(t *testing.T) {
     ensureNoError(t, err, "SetTime returned an error: ")
     err = vc.SetTime(2, 0)
     ensureNoError(t, err, "SetTime returned an error: ")
-    assertVCsEqual(t, vc, VectorClock{6, 4, 0, 2})
+    assertVCsEqual(t, vc, clockOf(6, 4, 0, 2))
 
     // Ensure Set returns error when trying to
     // set time less than what is already stored
@@ -157,26 +284,177 @@ func TestUnitVectorClock(t *testing.T) {
     if err == nil {
         t.Fatal("SetTime did not return an error when rewinding time.")
     }
-    assertVCsEqual(t, vc, VectorClock{6, 4, 0, 2})
+    assertVCsEqual(t, vc, clockOf(6, 4, 0, 2))
 
     // Ensure LessThan works as expected
-    wrongSize := VectorClock{0, 0, 0}
-    greater := VectorClock{6, 5, 0, 2}
-    equal := VectorClock{6, 4, 0, 2}
-    less := VectorClock{6, 3, 0, 2}
+    greater := clockOf(6, 5, 0, 2)
+    equal := clockOf(6, 4, 0, 2)
+    less := clockOf(6, 3, 0, 2)
 
-    assert(t, !wrongSize.LessThan(vc), "LessThan returned true for VC of " +
-        "different size")
     assert(t, !greater.LessThan(vc), "LessThan returned true for greater VC")
     assert(t, !equal.LessThan(vc), "LessThan returned true for equal VC")
     assert(t, less.LessThan(vc), "LessThan returned false for lesser VC")
 
+    // Ensure missing entries of shorter VCs are treated as zero
+    shorter := clockOf(6, 4, 0)
+    longer := clockOf(6, 4, 0, 2, 0)
+    assert(t, shorter.LessThan(vc), "LessThan returned false for shorter " +
+        "lesser VC")
+    assert(t, !vc.LessThan(shorter), "LessThan returned true for VC " +
+        "greater than shorter VC")
+    assert(t, !longer.LessThan(vc) && !vc.LessThan(longer), "LessThan " +
+        "returned true for equal VC of different size")
+
+    // Ensure Compare tells concurrent clocks apart from equal ones
+    concurrent := clockOf(7, 3, 0, 2)
+    assertEqual(t, less.Compare(vc), CLOCK_BEFORE, "Compare did not " +
+        "return before for lesser VC")
+    assertEqual(t, greater.Compare(vc), CLOCK_AFTER, "Compare did not " +
+        "return after for greater VC")
+    assertEqual(t, longer.Compare(vc), CLOCK_EQUAL, "Compare did not " +
+        "return equal for equal VC of different size")
+    assertEqual(t, concurrent.Compare(vc), CLOCK_CONCURRENT, "Compare " +
+        "did not return concurrent for concurrent VC")
+    assert(t, !concurrent.LessThan(vc) && !vc.LessThan(concurrent),
+        "LessThan returned true for concurrent VC")
+    assertEqual(t, concurrent.TotalCompare(vc), -1, "TotalCompare did " +
+        "not order concurrent VCs with equal sums by server ID")
+
     // Ensure Max works as expected
-    other := VectorClock{5, 5, 2, 2}
+    other := clockOf(5, 5, 2, 2)
     vc.Max(other)
-    assertVCsEqual(t, vc, VectorClock{6, 5, 2, 2})
+    assertVCsEqual(t, vc, clockOf(6, 5, 2, 2))
     // Ensure other wasn't affected
-    assertVCsEqual(t, other, VectorClock{5, 5, 2, 2})
+    assertVCsEqual(t, other, clockOf(5, 5, 2, 2))
+
+    // Ensure Max grows the VC to the length of a longer VC
+    vc.Max(clockOf(0, 0, 0, 0, 3))
+    assertVCsEqual(t, vc, clockOf(6, 5, 2, 2, 3))
+
+    // Ensure without drops the entries of the provided
+    // servers, and leaves the original VC unchanged
+    dropped := vc.without(map[int]bool{1: true, 4: true})
+    assertVCsEqual(t, dropped, VectorClock{0: 6, 2: 2, 3: 2})
+    assertVCsEqual(t, vc, clockOf(6, 5, 2, 2, 3))
+    assert(t, dropped.Equal(clockOf(6, 0, 2, 2)), "Equal returned false " +
+        "for VC equal to one without dropped servers")
+}
+
+/* Returns a vector clock with the provided logical times (at      *
+ * most 4, each taken modulo 3), so that randomly generated clocks *
+ * are often equal, or ordered                                     */
+func smallClock(times []uint8) VectorClock {
+    if len(times) > 4 {
+        times = times[:4]
+    }
+    vc := NewVectorClock(len(times))
+    for idx, time := range times {
+        vc[idx] = int(time % 3)
+    }
+    return vc
+}
+
+/* Property tests the comparisons and total order of vector clocks */
+func TestUnitVectorClockOrder(t *testing.T) {
+    reversed := map[ClockOrder]ClockOrder{CLOCK_BEFORE: CLOCK_AFTER,
+        CLOCK_AFTER: CLOCK_BEFORE, CLOCK_EQUAL: CLOCK_EQUAL,
+        CLOCK_CONCURRENT: CLOCK_CONCURRENT}
+    properties := []struct {
+        name     string
+        property interface{}
+    }{
+        {"Compare is antisymmetric", func(a []uint8, b []uint8) bool {
+            x, y := smallClock(a), smallClock(b)
+            return y.Compare(x) == reversed[x.Compare(y)]
+        }},
+        {"Compare agrees with LessThan, Dominates, and Equal",
+                func(a []uint8, b []uint8) bool {
+            x, y := smallClock(a), smallClock(b)
+            order := x.Compare(y)
+            return x.LessThan(y) == (order == CLOCK_BEFORE) &&
+                x.Dominates(y) == (order == CLOCK_AFTER ||
+                order == CLOCK_EQUAL) &&
+                x.Equal(y) == (order == CLOCK_EQUAL)
+        }},
+        {"TotalCompare is antisymmetric, and only ties equal clocks",
+                func(a []uint8, b []uint8) bool {
+            x, y := smallClock(a), smallClock(b)
+            return x.TotalCompare(y) == -y.TotalCompare(x) &&
+                (x.TotalCompare(y) == 0) == x.Equal(y)
+        }},
+        {"TotalCompare is transitive",
+                func(a []uint8, b []uint8, c []uint8) bool {
+            x, y, z := smallClock(a), smallClock(b), smallClock(c)
+            if x.TotalCompare(y) <= 0 && y.TotalCompare(z) <= 0 {
+                return x.TotalCompare(z) <= 0
+            }
+            return true
+        }},
+        {"TotalCompare orders clocks after those that happened before",
+                func(a []uint8, b []uint8) bool {
+            x, y := smallClock(a), smallClock(b)
+            switch x.Compare(y) {
+            case CLOCK_BEFORE:
+                return x.TotalCompare(y) < 0
+            case CLOCK_AFTER:
+                return x.TotalCompare(y) > 0
+            }
+            return true
+        }},
+        {"Copy is equal, and independent", func(a []uint8) bool {
+            x := smallClock(a)
+            copied := x.Copy()
+            if len(copied) != len(x) || !copied.Equal(x) {
+                return false
+            }
+            if len(x) > 0 {
+                copied.Inc(0)
+                return x.LessThan(copied)
+            }
+            return true
+        }},
+    }
+    for _, property := range properties {
+        err := quick.Check(property.property, nil)
+        if err != nil {
+            t.Fatalf("%s: %s", property.name, err.Error())
+        }
+    }
+}
+
+/* Unit tests hybrid logical clock */
+func TestUnitHybridClock(t *testing.T) {
+    physical := int64(100)
+    clock := NewHybridClock(1, func() int64 { return physical })
+
+    // Stamps taken at the same physical time are ordered by logical time,
+    // and stamps never move backwards when physical time does
+    assertEqual(t, clock.Now(), HLCStamp{100, 0, 1}, "Unexpected stamp")
+    assertEqual(t, clock.Now(), HLCStamp{100, 1, 1}, "Stamp with the " +
+        "same physical time did not increase its logical time")
+    physical = 90
+    assertEqual(t, clock.Now(), HLCStamp{100, 2, 1}, "Stamp moved " +
+        "backwards with physical time")
+    physical = 150
+    assertEqual(t, clock.Now(), HLCStamp{150, 0, 1}, "Stamp did not " +
+        "follow physical time")
+
+    // Stamps follow the later stamps the clock observed
+    clock.Observe(HLCStamp{300, 4, 2})
+    clock.Observe(HLCStamp{200, 7, 0})
+    assertEqual(t, clock.Now(), HLCStamp{300, 5, 1}, "Stamp did not " +
+        "follow observed stamp")
+
+    // Ensure stamps are ordered by physical, then logical time, then ID
+    stamp := HLCStamp{300, 5, 1}
+    assertEqual(t, stamp.Compare(HLCStamp{300, 5, 1}), 0, "Compare did " +
+        "not return 0 for equal stamps")
+    assertEqual(t, stamp.Compare(HLCStamp{299, 9, 2}), 1, "Compare did " +
+        "not order stamps by physical time")
+    assertEqual(t, stamp.Compare(HLCStamp{300, 6, 0}), -1, "Compare did " +
+        "not order stamps by logical time")
+    assertEqual(t, stamp.Compare(HLCStamp{300, 5, 2}), -1, "Compare did " +
+        "not order stamps by server ID")
 }
 
 /*****************************
@@ -238,8 +516,9 @@ func assertDBContentsEqual(t *testing.T, lock *sync.Mutex,
         db *BayouDB, exp []Room) {
     lock.Lock()
     defer lock.Unlock()
-    result := db.Read(getReadAllQuery())
-    rooms := deserializeRooms(result)
+    result, err := db.ReadTyped(getReadAllQuery())
+    ensureNoError(t, err, "Reading database contents failed: ")
+    rooms := scanRooms(t, result)
     assertRoomListsEqual(t, rooms, exp, "Database does not contain " +
         "expected contents")
 }
@@ -250,14 +529,17 @@ func cleanupServers(servers []*BayouServer) {
         server.Kill()
         server.commitDB.Close()
         server.fullDB.Close()
-        DeletePersist(server.id)
+        DeletePersist(server.store.dir, server.id)
     }
 }
 
-/* Closes each of the provided RPC clients */
+/* Closes each of the provided RPC clients (servers  *
+ * sharing the list may have closed and removed some) */
 func cleanupRPCClients(clients []*rpc.Client) {
     for _, client := range clients {
-        client.Close()
+        if client != nil {
+            client.Close()
+        }
     }
 }
 
@@ -272,7 +554,10 @@ func createNetwork(testName string, serverPorts []int,
         id := fmt.Sprintf("%d", i)
         commitDB := getDB(testName + "_" + id + "_commit.db", true)
         fullDB := getDB(testName + "_" + id + "_full.db", true)
-        serverList[i] = NewBayouServer(i, rpcClients, commitDB, fullDB, port)
+        server, err := NewBayouServer(i, rpcClients, commitDB, fullDB,
+                ROOMS_SCHEMA, getDataDir(testName), port)
+        check(err, "Error creating server: ")
+        serverList[i] = server
     }
     for i, port := range clientPorts {
         rpcClients[i] = startRPCClient(port)
@@ -293,6 +578,16 @@ func startNetworkComm(servers []*BayouServer) {
     }
 }
 
+/* Returns the arguments of a write inserting the *
+ * provided room (which its undo deletes)         */
+func getRoomWriteArgs(writeID int, room Room, check string,
+        merge string) *WriteArgs {
+    writeArgs := &WriteArgs{WriteID: writeID, Check: check, Merge: merge}
+    writeArgs.Query, writeArgs.QueryArgs = getInsertQuery(room)
+    writeArgs.Undo, writeArgs.UndoArgs = getDeleteQuery(room)
+    return writeArgs
+}
+
 /* Tests server RPC functionality */
 func TestUnitServerRPC(t *testing.T) {
     numClients := 10
@@ -373,19 +668,23 @@ func TestUnitServerReadWrite(t *testing.T) {
     room := Room{"RW0", createDate(0, 0), createDate(0, 1)}
     rooms := []Room{room}
 
-    query := getInsertQuery(room)
-    undo := getDeleteQuery(room)
+    query, queryArgs := getInsertQuery(room)
+    undo, undoArgs := getDeleteQuery(room)
     check := getBoolQuery(true)
     merge := getBoolQuery(false)
 
     vclock := NewVectorClock(numClients)
     vclock.Inc(server.id)
     writeEntry := NewLogEntry(0, vclock, query, check, merge)
+    writeEntry.QueryArgs = queryArgs
     undoEntry := NewLogEntry(0, vclock, undo, getBoolQuery(true),
             getBoolQuery(false))
+    undoEntry.QueryArgs = undoArgs
 
     // Test a single uncommitted write
-    writeArgs := &WriteArgs{0, query, undo, check, merge}
+    writeArgs := &WriteArgs{WriteID: 0, Query: query, Undo: undo,
+            Check: check, Merge: merge, QueryArgs: queryArgs,
+            UndoArgs: undoArgs}
     var writeReply WriteReply
     err := clients[server.id].Call("BayouServer.Write", writeArgs, &writeReply)
     ensureNoError(t, err, "Single Write RPC failed: ")
@@ -403,16 +702,20 @@ func TestUnitServerReadWrite(t *testing.T) {
 
     // Test a conflicting, uncomitted write
     room = Room{"RW1", createDate(1, 0), createDate(1, 1)}
-    query = getInsertQuery(room)
-    undo = getDeleteQuery(room)
+    query, queryArgs = getInsertQuery(room)
+    undo, undoArgs = getDeleteQuery(room)
     check = getBoolQuery(false)
     merge = getBoolQuery(true)
     vclock.Inc(server.id)
     writeEntry2 := NewLogEntry(1, vclock, query, check, merge)
+    writeEntry2.QueryArgs = queryArgs
     undoEntry2 := NewLogEntry(1, vclock, undo, getBoolQuery(true),
             getBoolQuery(false))
+    undoEntry2.QueryArgs = undoArgs
 
-    writeArgs = &WriteArgs{1, query, undo, check, merge}
+    writeArgs = &WriteArgs{WriteID: 1, Query: query, Undo: undo,
+            Check: check, Merge: merge, QueryArgs: queryArgs,
+            UndoArgs: undoArgs}
     writeReply = WriteReply{}
     err = clients[server.id].Call("BayouServer.Write", writeArgs, &writeReply)
     ensureNoError(t, err, "Conflicting Write RPC failed: ")
@@ -434,15 +737,19 @@ func TestUnitServerReadWrite(t *testing.T) {
 
     // Test a conflicting, unresolvable uncomitted write
     room = Room{"RW2", createDate(2, 0), createDate(2, 1)}
-    query = getInsertQuery(room)
-    undo = getDeleteQuery(room)
+    query, queryArgs = getInsertQuery(room)
+    undo, undoArgs = getDeleteQuery(room)
     merge = getBoolQuery(false)
     vclock.Inc(server.id)
     writeEntry3 := NewLogEntry(2, vclock, query, check, merge)
+    writeEntry3.QueryArgs = queryArgs
     undoEntry3 := NewLogEntry(2, vclock, undo, getBoolQuery(true),
             getBoolQuery(false))
+    undoEntry3.QueryArgs = undoArgs
 
-    writeArgs = &WriteArgs{2, query, undo, check, merge}
+    writeArgs = &WriteArgs{WriteID: 2, Query: query, Undo: undo,
+            Check: check, Merge: merge, QueryArgs: queryArgs,
+            UndoArgs: undoArgs}
     writeReply = WriteReply{}
     err = clients[server.id].Call("BayouServer.Write", writeArgs, &writeReply)
     ensureNoError(t, err, "Unresolveable Write RPC failed: ")
@@ -465,15 +772,18 @@ func TestUnitServerReadWrite(t *testing.T) {
     // Test a committed write
     room = Room{"RW3", createDate(3, 0), createDate(3, 1)}
     rooms = append(rooms, room)
-    query = getInsertQuery(room)
-    undo = getDeleteQuery(room)
+    query, queryArgs = getInsertQuery(room)
+    undo, undoArgs = getDeleteQuery(room)
     check = getBoolQuery(true)
     vclock = NewVectorClock(numClients)
     vclock.Inc(server.id)
     writeEntry4 := NewLogEntry(3, vclock, query, check, merge)
+    writeEntry4.QueryArgs = queryArgs
 
     server.IsPrimary = true
-    writeArgs = &WriteArgs{3, query, undo, check, merge}
+    writeArgs = &WriteArgs{WriteID: 3, Query: query, Undo: undo,
+            Check: check, Merge: merge, QueryArgs: queryArgs,
+            UndoArgs: undoArgs}
     writeReply = WriteReply{}
     err = clients[server.id].Call("BayouServer.Write", writeArgs, &writeReply)
     ensureNoError(t, err, "Comitted Write RPC failed: ")
@@ -495,53 +805,56 @@ func TestUnitServerReadWrite(t *testing.T) {
 
     // Test a no-op read query
     query = getBoolQuery(true)
-    readArgs := &ReadArgs{query, true}
+    readArgs := &ReadArgs{Query: query, FromCommit: true}
     var readReply ReadReply
     err = clients[server.id].Call("BayouServer.Read", readArgs, &readReply)
     ensureNoError(t, err, "No-op Read RPC failed: ")
 
-    assertEqual(t, len(readReply.Data), 1, "No-op query returned map " +
-            "of wrong size")
-    value, hasKey := readReply.Data[0]["1"]
-    assert(t, hasKey, "No-op query returned map with wrong keys")
-    assertEqual(t, value, int64(1), "No-op query returned map with wrong value")
+    assertEqual(t, len(readReply.Data.Rows), 1, "No-op query returned " +
+            "wrong number of rows")
+    assertEqual(t, readReply.Data.Columns[0].Name, "1", "No-op query " +
+            "returned wrong column")
+    assertEqual(t, readReply.Data.Rows[0][0], int64(1), "No-op query " +
+            "returned wrong value")
 
     // Test a read-all query from full DB
     query = getReadAllQuery()
-    readArgs = &ReadArgs{query, false}
+    readArgs = &ReadArgs{Query: query, FromCommit: false}
     readReply = ReadReply{}
     err = clients[server.id].Call("BayouServer.Read", readArgs, &readReply)
     ensureNoError(t, err, "Read all RPC failed: ")
-    readRooms := deserializeRooms(readReply.Data)
+    readRooms := scanRooms(t, readReply.Data)
     assertRoomListsEqual(t, readRooms, rooms, "Incorrect Read All result: ")
 
     // Test a specific read query from full DB
-    query = getReadQuery(rooms[0])
-    readArgs = &ReadArgs{query, false}
+    query, queryArgs = getReadQuery(rooms[0])
+    readArgs = &ReadArgs{Query: query, FromCommit: false,
+            QueryArgs: queryArgs}
     readReply = ReadReply{}
     err = clients[server.id].Call("BayouServer.Read", readArgs, &readReply)
     ensureNoError(t, err, "Specific Read RPC failed: ")
-    readRooms = deserializeRooms(readReply.Data)
+    readRooms = scanRooms(t, readReply.Data)
     assertRoomListsEqual(t, readRooms, []Room{rooms[0]}, "Incorrect " +
             "specific Read result: ")
 
     // Test a read query from commit DB
     query = getReadAllQuery()
-    readArgs = &ReadArgs{query, true}
+    readArgs = &ReadArgs{Query: query, FromCommit: true}
     readReply = ReadReply{}
     err = clients[server.id].Call("BayouServer.Read", readArgs, &readReply)
     ensureNoError(t, err, "Read all committed RPC failed: ")
-    readRooms = deserializeRooms(readReply.Data)
+    readRooms = scanRooms(t, readReply.Data)
     assertRoomListsEqual(t, readRooms, []Room{room}, "Incorrect " +
             "Read all comitted result: ")
 
     // Test that query for non-existent item returns nothing
-    query = getReadQuery(rooms[0])
-    readArgs = &ReadArgs{query, true}
+    query, queryArgs = getReadQuery(rooms[0])
+    readArgs = &ReadArgs{Query: query, FromCommit: true,
+            QueryArgs: queryArgs}
     readReply = ReadReply{}
     err = clients[server.id].Call("BayouServer.Read", readArgs, &readReply)
     ensureNoError(t, err, "Read non-existent RPC failed: ")
-    assertEqual(t, len(readReply.Data), 0, "Read of non-existent item " +
+    assertEqual(t, len(readReply.Data.Rows), 0, "Read of non-existent item " +
             "returned non-empty result")
 
     // PART 3: CONCURRENT READS / WRITES
@@ -558,9 +871,11 @@ func TestUnitServerReadWrite(t *testing.T) {
             // debugf("Client #%d sending write!", id)
             roomName := fmt.Sprintf("ZRW%d", id)
             croom := Room{roomName, createDate(id, 0), createDate(id, 1)}
-            cquery := getInsertQuery(croom)
-            cundo := getDeleteQuery(croom)
-            writeArgArr[id] = WriteArgs{10+id, cquery, cundo, check, merge}
+            cquery, cqueryArgs := getInsertQuery(croom)
+            cundo, cundoArgs := getDeleteQuery(croom)
+            writeArgArr[id] = WriteArgs{WriteID: 10+id, Query: cquery,
+                    Undo: cundo, Check: check, Merge: merge,
+                    QueryArgs: cqueryArgs, UndoArgs: cundoArgs}
             cerr := clients[server.id].Call("BayouServer.Write",
                     &writeArgArr[id], &writeReplyArr[id])
             ensureNoError(t, cerr, "Concurrent Write RPC failed: ")
@@ -587,12 +902,12 @@ func TestUnitServerReadWrite(t *testing.T) {
     for i := 0; i < numClients; i++ {
         go func(id int) {
             // debugf("Client #%d sending read!", id)
-            readArgArr[id] = ReadArgs{query, false}
+            readArgArr[id] = ReadArgs{Query: query, FromCommit: false}
             rerr := clients[server.id].Call("BayouServer.Read",
                     &readArgArr[id], &readReplyArr[id])
             ensureNoError(t, rerr, "Concurrent Read RPC failed: ")
             // Ensure results are correct
-            crooms := deserializeRooms(readReplyArr[id].Data)
+            crooms := scanRooms(t, readReplyArr[id].Data)
             assertRoomListsEqual(t, crooms, rooms, "Concurrent R/W " +
                     "returned incorrect result: ")
             wg.Done()
@@ -636,9 +951,11 @@ func TestUnitServerAntiEntropy(t *testing.T) {
         room := Room{fmt.Sprintf("AEU%d", i), createDate(i, 0),
                 createDate(i, 1)}
         rooms = append(rooms, room)
-        query := getInsertQuery(room)
-        undo := getDeleteQuery(room)
-        writeArgs := &WriteArgs{i, query, undo, check, merge}
+        query, queryArgs := getInsertQuery(room)
+        undo, undoArgs := getDeleteQuery(room)
+        writeArgs := &WriteArgs{WriteID: i, Query: query, Undo: undo,
+                Check: check, Merge: merge, QueryArgs: queryArgs,
+                UndoArgs: undoArgs}
         var writeReply WriteReply
         serverID := (startID + i) % numClients
         err := clients[serverID].Call("BayouServer.Write",
@@ -660,14 +977,1601 @@ func TestUnitServerAntiEntropy(t *testing.T) {
     }
 }
 
+/* Tests that anti-entropy only sends the tentative writes *
+ * the other server has not seen, and sends whole logs     *
+ * when a server lacks writes it was not sent              */
+func TestUnitServerIncrementalAntiEntropy(t *testing.T) {
+    serverPorts := []int{1152, 1153}
+    servers, clients := createNetwork("test_incremental_antientropy",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    rooms := make([]Room, 3)
+    write := func(serverID int, writeID int) {
+        rooms[writeID] = Room{fmt.Sprintf("INC%d", writeID),
+                createDate(writeID, 0), createDate(writeID, 1)}
+        var writeReply WriteReply
+        err := clients[serverID].Call("BayouServer.Write",
+                getRoomWriteArgs(writeID, rooms[writeID], check, merge),
+                &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    assertIDsEqual := func(ids []int, exp []int, message string) {
+        assert(t, reflect.DeepEqual(ids, exp), fmt.Sprintf("%s: %v, " +
+                "expected %v", message, ids, exp))
+    }
+    unseenIDs := func(from int, to int) []int {
+        servers[to].logLock.Lock()
+        clock := servers[to].viewClock(false)
+        servers[to].logLock.Unlock()
+        unseen, _ := unseenWrites(servers[from].TentativeLog,
+                servers[from].UndoLog, clock)
+        return writeIDs(unseen)
+    }
+    antiEntropy := func(targetClock VectorClock) (bool, bool) {
+        servers[0].logLock.Lock()
+        defer servers[0].logLock.Unlock()
+        if targetClock == nil {
+            return servers[0].antiEntropyWith(1), true
+        }
+        return servers[0].exchangeLogs(servers[0].getPeer(1), 1,
+                targetClock, true)
+    }
+
+    // Each server only has its own write to send
+    write(0, 0)
+    write(1, 1)
+    assertIDsEqual(unseenIDs(0, 1), []int{0}, "Unexpected writes unseen " +
+            "by the second server")
+    assertIDsEqual(unseenIDs(1, 0), []int{1}, "Unexpected writes unseen " +
+            "by the first server")
+    synced, _ := antiEntropy(nil)
+    assert(t, synced, "Anti-entropy failed")
+    assertIDsEqual(writeIDs(servers[0].TentativeLog),
+            writeIDs(servers[1].TentativeLog), "Servers' tentative logs " +
+            "differ after anti-entropy")
+    assertIDsEqual(unseenIDs(0, 1), []int{}, "Servers have unseen " +
+            "writes after anti-entropy")
+
+    // Writes the other server has seen are not sent again
+    write(0, 2)
+    assertIDsEqual(unseenIDs(0, 1), []int{2}, "Unexpected writes unseen " +
+            "by the second server")
+
+    // If the other server lacks writes it was not sent, nothing
+    // changes, and anti-entropy falls back to sending whole logs
+    synced, complete := antiEntropy(servers[0].viewClock(false))
+    assert(t, !synced && !complete, "Anti-entropy succeeded without " +
+            "sending a write the other server lacked")
+    assertEqual(t, len(servers[1].TentativeLog), 2, "Incomplete " +
+            "anti-entropy changed the other server's log")
+    synced, _ = antiEntropy(nil)
+    assert(t, synced, "Anti-entropy failed")
+    for _, server := range servers {
+        assertIDsEqual(writeIDs(server.TentativeLog), []int{0, 1, 2},
+                "Server did not receive all writes")
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+}
+
+/* Tests that servers receiving the same tentative writes in *
+ * different orders keep them in the same (accept) order, so  *
+ * their full views converge                                  */
+func TestUnitServerTentativeOrder(t *testing.T) {
+    serverPorts := []int{1154, 1155, 1156}
+    servers, clients := createNetwork("test_tentative_order",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+
+    // Both writes claim the same hour, so only the first one
+    // in the tentative order claims it
+    rooms := []Room{Room{"ORD0", createDate(0, 0), createDate(0, 1)},
+            Room{"ORD1", createDate(0, 0), createDate(0, 1)}}
+    for idx, room := range rooms {
+        writeArgs := getRoomWriteArgs(idx, room, "", getBoolQuery(false))
+        writeArgs.Check, writeArgs.CheckArgs = getIsFreeQuery(room.StartTime)
+        var writeReply WriteReply
+        err := clients[idx].Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+
+    // The last server receives the second write first
+    antiEntropy := func(from int, to int) {
+        servers[from].logLock.Lock()
+        synced := servers[from].antiEntropyWith(to)
+        servers[from].logLock.Unlock()
+        assert(t, synced, "Anti-entropy failed")
+    }
+    antiEntropy(2, 1)
+    assertDBContentsEqual(t, servers[2].logLock, servers[2].fullDB,
+            rooms[1:])
+    antiEntropy(2, 0)
+    antiEntropy(1, 0)
+    for _, server := range servers {
+        server.logLock.Lock()
+        ids := writeIDs(server.TentativeLog)
+        server.logLock.Unlock()
+        assert(t, reflect.DeepEqual(ids, []int{0, 1}), fmt.Sprintf(
+                "Server #%d has tentative writes %v, expected [0 1]",
+                server.id, ids))
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:1])
+    }
+}
+
+/* Tests that tentative writes are ordered by the hybrid logical *
+ * clock stamps of the servers that accepted them, rather than by *
+ * how many writes each server accepted                           */
+func TestUnitServerHybridOrder(t *testing.T) {
+    serverPorts := []int{1157, 1158}
+    servers, clients := createNetwork("test_hybrid_order",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    for idx, server := range servers {
+        physical := int64(100 * (idx + 1))
+        server.SetPhysicalClock(func() int64 { return physical })
+    }
+
+    rooms := make([]Room, 0)
+    write := func(serverID int) {
+        writeID := len(rooms)
+        room := Room{fmt.Sprintf("HLC%d", writeID), createDate(writeID, 0),
+                createDate(writeID, 1)}
+        rooms = append(rooms, room)
+        var writeReply WriteReply
+        err := clients[serverID].Call("BayouServer.Write",
+                getRoomWriteArgs(writeID, room, getBoolQuery(true),
+                getBoolQuery(false)), &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    assertIDs := func(server *BayouServer, exp []int) {
+        server.logLock.Lock()
+        ids := writeIDs(server.TentativeLog)
+        server.logLock.Unlock()
+        assert(t, reflect.DeepEqual(ids, exp), fmt.Sprintf("Server #%d " +
+                "has tentative writes %v, expected %v", server.id, ids, exp))
+    }
+
+    // The busy server's writes were accepted before the quiet server's
+    write(0)
+    write(0)
+    write(0)
+    write(1)
+    servers[0].logLock.Lock()
+    synced := servers[0].antiEntropyWith(1)
+    servers[0].logLock.Unlock()
+    assert(t, synced, "Anti-entropy failed")
+    for _, server := range servers {
+        assertIDs(server, []int{0, 1, 2, 3})
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+
+    // Writes are stamped after the writes their server has seen,
+    // even if its physical clock is behind
+    write(0)
+    assertIDs(servers[0], []int{0, 1, 2, 3, 4})
+    servers[0].logLock.Lock()
+    entry := servers[0].TentativeLog[4]
+    dump := logToString(servers[0].TentativeLog)
+    servers[0].logLock.Unlock()
+    assertEqual(t, entry.HLC, HLCStamp{200, 1, 0}, "Write was not stamped " +
+            "after the writes its server had seen")
+    assert(t, strings.Contains(dump, entry.HLC.String()), "Log dump does " +
+            "not show the writes' stamps")
+}
+
+/* Tests that inserting a tentative write ahead of a write whose *
+ * conflict was not resolved does not run that write's undo, so  *
+ * it cannot undo the changes of the write it conflicted with    */
+func TestUnitServerInsertBeforeConflict(t *testing.T) {
+    serverPorts := []int{1166, 1167, 1168}
+    servers, clients := createNetwork("test_insert_before_conflict",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    for idx, physical := range []int64{100, 300, 200} {
+        physical := physical
+        servers[idx].SetPhysicalClock(func() int64 { return physical })
+    }
+
+    // The second write claims the first's hour, and its undo
+    // deletes both of them, so it must not run while it conflicts
+    rooms := []Room{Room{"CNF", createDate(0, 0), createDate(0, 1)},
+            Room{"CNF", createDate(0, 0), createDate(0, 2)},
+            Room{"CNF2", createDate(1, 0), createDate(1, 1)}}
+    for idx, room := range rooms {
+        writeArgs := getRoomWriteArgs(idx, room, getBoolQuery(true),
+                getBoolQuery(false))
+        if idx == 1 {
+            writeArgs.Check, writeArgs.CheckArgs =
+                    getIsFreeQuery(room.StartTime)
+        }
+        var writeReply WriteReply
+        err := clients[idx].Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+
+    // The first server receives the conflicting write, then
+    // inserts the write ordered between the two into its own log
+    antiEntropy := func(from int, to int) {
+        servers[from].logLock.Lock()
+        synced := servers[from].antiEntropyWith(to)
+        servers[from].logLock.Unlock()
+        assert(t, synced, "Anti-entropy failed")
+    }
+    antiEntropy(0, 1)
+    assertDBContentsEqual(t, servers[0].logLock, servers[0].fullDB,
+            rooms[:1])
+    antiEntropy(2, 0)
+    servers[0].logLock.Lock()
+    ids := writeIDs(servers[0].TentativeLog)
+    servers[0].logLock.Unlock()
+    assert(t, reflect.DeepEqual(ids, []int{0, 2, 1}), fmt.Sprintf(
+            "Server has tentative writes %v, expected [0 2 1]", ids))
+    assertDBContentsEqual(t, servers[0].logLock, servers[0].fullDB,
+            []Room{rooms[0], rooms[2]})
+}
+
+/* Tests that a write whose conflict is left unresolved once a  *
+ * write is inserted before it is sent to the error log (which  *
+ * is persisted)                                                */
+func TestUnitServerRedoErrors(t *testing.T) {
+    serverPorts := []int{1172, 1173}
+    servers, clients := createNetwork("test_redo_errors",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    for idx, physical := range []int64{100, 200} {
+        physical := physical
+        servers[idx].SetPhysicalClock(func() int64 { return physical })
+    }
+
+    // Only the second write checks that its hour is free, which
+    // it is until the first write is ordered before it
+    rooms := []Room{Room{"RDO0", createDate(0, 0), createDate(0, 1)},
+            Room{"RDO1", createDate(0, 0), createDate(0, 1)}}
+    for idx, room := range rooms {
+        writeArgs := getRoomWriteArgs(idx, room, getBoolQuery(true),
+                getBoolQuery(false))
+        if idx == 1 {
+            writeArgs.Check, writeArgs.CheckArgs =
+                    getIsFreeQuery(room.StartTime)
+        }
+        var writeReply WriteReply
+        err := clients[idx].Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+        assert(t, !writeReply.HasConflict, "Write falsely had a conflict")
+    }
+
+    servers[0].logLock.Lock()
+    synced := servers[0].antiEntropyWith(1)
+    servers[0].logLock.Unlock()
+    assert(t, synced, "Anti-entropy failed")
+
+    server := servers[1]
+    server.logLock.Lock()
+    ids := writeIDs(server.TentativeLog)
+    errorIDs := writeIDs(server.ErrorLog)
+    persistedErrors := make([]LogEntry, 0)
+    _, err := server.wal.Replay(server.wal.segment, func(record WALRecord) {
+        persistedErrors = append(persistedErrors, record.Errors...)
+    })
+    server.logLock.Unlock()
+    ensureNoError(t, err, "Failed to replay WAL: ")
+    assert(t, reflect.DeepEqual(ids, []int{0, 1}), fmt.Sprintf(
+            "Server has tentative writes %v, expected [0 1]", ids))
+    assert(t, reflect.DeepEqual(errorIDs, []int{1}), fmt.Sprintf(
+            "Server has error log %v, expected [1]", errorIDs))
+    assert(t, reflect.DeepEqual(writeIDs(persistedErrors), []int{1}),
+            "Redone write was not persisted in the error log")
+    assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:1])
+}
+
+/* Tests that a peer's logs that do not match this server's (commit *
+ * logs that diverged, or write sets of different lengths) are       *
+ * rejected, without stopping either server                          */
+func TestUnitServerInvalidLogs(t *testing.T) {
+    serverPorts := []int{1170, 1171}
+    servers, clients := createNetwork("test_invalid_logs",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+
+    // Both servers commit a different write first
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    for i, server := range servers {
+        server.IsPrimary = true
+        room := Room{fmt.Sprintf("INV%d", i), createDate(i, 0),
+                createDate(i, 1)}
+        writeArgs := getRoomWriteArgs(i, room, check, merge)
+        var writeReply WriteReply
+        err := clients[i].Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    commitIDs := func(server *BayouServer) []int {
+        server.logLock.Lock()
+        defer server.logLock.Unlock()
+        return writeIDs(server.CommitLog)
+    }
+
+    servers[0].logLock.Lock()
+    exchanged := servers[0].antiEntropyWith(1)
+    servers[0].logLock.Unlock()
+    assert(t, !exchanged, "Diverged commit logs were exchanged")
+    for i, server := range servers {
+        assert(t, server.isActive, "Server stopped on diverged commit logs")
+        assert(t, reflect.DeepEqual(commitIDs(server), []int{i}),
+                "Diverged commit log changed the server's commit log")
+    }
+
+    // Send a tentative write without its undo entry
+    servers[1].logLock.Lock()
+    antiEntropyArgs := AntiEntropyArgs{SenderID: 0,
+            TentativeSet: []LogEntry{servers[1].CommitLog[0]},
+            TentativeIDs: []int{2},
+            OmitTimestamp: servers[1].Omitted[0].Copy(),
+            CommitClock: servers[1].commitClock.Copy(),
+            Epoch: servers[1].epoch}
+    servers[1].logLock.Unlock()
+    antiEntropyArgs.TentativeSet[0].WriteID = 2
+    var antiEntropyReply AntiEntropyReply
+    err := clients[1].Call("BayouServer.AntiEntropy", &antiEntropyArgs,
+            &antiEntropyReply)
+    assert(t, err != nil && strings.Contains(err.Error(), "do not match"),
+            "Write sets of different lengths were accepted")
+    assert(t, servers[1].isActive, "Server stopped on write sets of " +
+            "different lengths")
+    assert(t, reflect.DeepEqual(commitIDs(servers[1]), []int{1}),
+            "Invalid write sets changed the server's commit log")
+}
+
+/* Tests that servers keep serving writes while waiting for the *
+ * peers they send AntiEntropy RPCs to, and that the writes they *
+ * accept in the meantime are kept once the reply is handled     */
+func TestUnitServerNonBlockingAntiEntropy(t *testing.T) {
+    serverPorts := []int{1159, 1160}
+    servers, clients := createNetwork("test_nonblocking_anti_entropy",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+
+    rooms := make([]Room, 3)
+    write := func(serverID int, writeID int) {
+        rooms[writeID] = Room{fmt.Sprintf("NB%d", writeID),
+                createDate(writeID, 0), createDate(writeID, 1)}
+        var writeReply WriteReply
+        err := clients[serverID].Call("BayouServer.Write",
+                getRoomWriteArgs(writeID, rooms[writeID], getBoolQuery(true),
+                getBoolQuery(false)), &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    write(0, 0)
+    write(1, 1)
+
+    // Keep the target busy, so the sender waits for its reply
+    servers[1].logLock.Lock()
+    synced := make(chan bool, 1)
+    go func() {
+        servers[0].logLock.Lock()
+        exchanged, _ := servers[0].exchangeLogs(servers[0].getPeer(1), 1,
+                nil, false)
+        servers[0].logLock.Unlock()
+        synced <- exchanged
+    }()
+    time.Sleep(20 * time.Millisecond)
+
+    // Writes are accepted while the sender waits
+    start := time.Now()
+    write(0, 2)
+    elapsed := time.Since(start)
+    servers[1].logLock.Unlock()
+    assert(t, elapsed < time.Duration(ANTI_ENTROPY_TIMEOUT_MIN) *
+            time.Millisecond, fmt.Sprintf("Write was blocked for %s by " +
+            "anti-entropy", elapsed))
+    assert(t, <-synced, "Anti-entropy failed")
+
+    // The sender keeps the write the target was not sent
+    servers[0].logLock.Lock()
+    ids := writeIDs(servers[0].TentativeLog)
+    servers[0].logLock.Unlock()
+    assert(t, reflect.DeepEqual(ids, []int{0, 1, 2}), fmt.Sprintf("Sender " +
+            "has tentative writes %v, expected [0 1 2]", ids))
+    assertDBContentsEqual(t, servers[0].logLock, servers[0].fullDB, rooms)
+
+    // And sends it to the target in the next exchange
+    servers[0].performAntiEntropy()
+    for _, server := range servers {
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+}
+
+/* Tests that a server keeps accepting writes while pulling a *
+ * snapshot from a peer that cannot be reached or is slow to  *
+ * reply, and that the pull times out                         */
+func TestUnitServerSlowSnapshotPeer(t *testing.T) {
+    serverPorts := []int{1163, 1164}
+    servers, clients := createNetwork("test_slow_snapshot_peer",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    server := servers[0]
+
+    // A peer that accepts connections, but never replies
+    listener, err := net.Listen("tcp", ":1165")
+    ensureNoError(t, err, "Listen failed: ")
+    defer listener.Close()
+
+    rooms := make([]Room, 2)
+    write := func(writeID int) time.Duration {
+        rooms[writeID] = Room{fmt.Sprintf("SP%d", writeID),
+                createDate(writeID, 0), createDate(writeID, 1)}
+        var writeReply WriteReply
+        start := time.Now()
+        err := clients[0].Call("BayouServer.Write",
+                getRoomWriteArgs(writeID, rooms[writeID], getBoolQuery(true),
+                getBoolQuery(false)), &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+        return time.Since(start)
+    }
+    // Returns how long the write made while pulling the snapshot
+    // took, and whether the pull gave up in time
+    pullSnapshot := func(peerID int, writeID int) (time.Duration, bool) {
+        server.logLock.Lock()
+        server.snapshotPeer = peerID
+        server.logLock.Unlock()
+        pulled := make(chan bool, 1)
+        go func() {
+            server.performAntiEntropy()
+            pulled <- true
+        }()
+        time.Sleep(20 * time.Millisecond)
+        elapsed := write(writeID)
+        select {
+        case <-pulled:
+            return elapsed, true
+        case <-time.After(4 * peerTimeout()):
+            return elapsed, false
+        }
+    }
+    checkPull := func(peerID int, elapsed time.Duration, gaveUp bool) {
+        assert(t, elapsed < time.Duration(ANTI_ENTROPY_TIMEOUT_MIN) *
+                time.Millisecond, fmt.Sprintf("Write was blocked for %s " +
+                "by snapshot pull from %d", elapsed, peerID))
+        assert(t, gaveUp, fmt.Sprintf("Snapshot pull from %d did not " +
+                "time out", peerID))
+        server.logLock.Lock()
+        snapshotPeer := server.snapshotPeer
+        server.logLock.Unlock()
+        assertEqual(t, snapshotPeer, peerID, "Snapshot peer was reset " +
+                "by failed pull")
+    }
+
+    // Unreachable peer
+    server.logLock.Lock()
+    server.growMembers(3)
+    server.members[2].Address = "localhost:1165"
+    server.logLock.Unlock()
+    elapsed, gaveUp := pullSnapshot(2, 0)
+    checkPull(2, elapsed, gaveUp)
+
+    // Slow peer (only checked once it is released)
+    servers[1].logLock.Lock()
+    elapsed, gaveUp = pullSnapshot(1, 1)
+    servers[1].logLock.Unlock()
+    checkPull(1, elapsed, gaveUp)
+
+    // Once the peer replies, the snapshot is installed
+    // and the server keeps its tentative writes
+    server.performAntiEntropy()
+    server.logLock.Lock()
+    snapshotPeer := server.snapshotPeer
+    server.logLock.Unlock()
+    assertEqual(t, snapshotPeer, NO_PEER, "Snapshot was not installed")
+    assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+}
+
+/* Tests that the primary commits tentative writes *
+ * it learns about, and that all servers adopt the *
+ * primary's commit order                          */
+func TestUnitServerCommit(t *testing.T) {
+    numServers := 3
+    numWrites := 6
+    startPort := 1121
+
+    serverPorts := make([]int, numServers)
+    for i := 0; i < numServers; i++ {
+        serverPorts[i] = startPort + i
+    }
+
+    servers, clients := createNetwork("test_commit",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    primary := servers[0]
+    primary.IsPrimary = true
+    startNetworkComm(servers)
+
+    rooms := []Room{}
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+
+    // Perform a series of writes on the non-primary servers
+    for i := 0; i < numWrites; i++ {
+        room := Room{fmt.Sprintf("CMT%d", i), createDate(i, 0),
+                createDate(i, 1)}
+        rooms = append(rooms, room)
+        query, queryArgs := getInsertQuery(room)
+        undo, undoArgs := getDeleteQuery(room)
+        writeArgs := &WriteArgs{WriteID: i, Query: query, Undo: undo,
+                Check: check, Merge: merge, QueryArgs: queryArgs,
+                UndoArgs: undoArgs}
+        var writeReply WriteReply
+        serverID := 1 + (i % (numServers - 1))
+        err := clients[serverID].Call("BayouServer.Write",
+                writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+
+    // Wait for anti-entropy to commit and propagate the writes
+    maxRounds := numServers * 8
+    for round := 0; round < maxRounds; round++ {
+        sleep(ANTI_ENTROPY_TIMEOUT_MIN, false)
+        allCommitted := true
+        for _, server := range servers {
+            server.logLock.Lock()
+            if len(server.CommitLog) < numWrites {
+                allCommitted = false
+            }
+            server.logLock.Unlock()
+        }
+        if allCommitted {
+            break
+        }
+    }
+
+    // Ensure all servers committed all writes in the primary's order
+    primary.logLock.Lock()
+    commitOrder := make([]LogEntry, len(primary.CommitLog))
+    copy(commitOrder, primary.CommitLog)
+    primary.logLock.Unlock()
+    assertEqual(t, len(commitOrder), numWrites, "Primary did not commit " +
+            "all writes")
+    for idx, entry := range commitOrder {
+        assertEqual(t, entry.CSN, idx + 1, "Primary assigned wrong CSN")
+    }
+    for _, server := range servers {
+        server.logLock.Lock()
+        assert(t, len(server.TentativeLog) == 0, "Committed writes " +
+                "remained in tentative log")
+        assertLogsEqual(t, server.CommitLog, commitOrder, true)
+        server.logLock.Unlock()
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+}
+
+/* Tests that commits acknowledged by all servers are *
+ * truncated from the commit logs, without affecting  *
+ * the commit order or the databases                  */
+func TestUnitServerTruncation(t *testing.T) {
+    numServers := 3
+    numWrites := 6
+    startPort := 1126
+
+    serverPorts := make([]int, numServers)
+    for i := 0; i < numServers; i++ {
+        serverPorts[i] = startPort + i
+    }
+
+    servers, clients := createNetwork("test_truncation",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    primary := servers[0]
+    primary.IsPrimary = true
+    for _, server := range servers {
+        server.TruncationThreshold = 1
+    }
+    startNetworkComm(servers)
+
+    rooms := []Room{}
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+
+    // Perform a series of writes on the non-primary servers
+    for i := 0; i < numWrites; i++ {
+        room := Room{fmt.Sprintf("TRC%d", i), createDate(i, 0),
+                createDate(i, 1)}
+        rooms = append(rooms, room)
+        writeArgs := getRoomWriteArgs(i, room, check, merge)
+        var writeReply WriteReply
+        serverID := 1 + (i % (numServers - 1))
+        err := clients[serverID].Call("BayouServer.Write",
+                writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+
+    // Wait for all servers to commit the writes,
+    // and for the primary to truncate its log
+    maxRounds := numServers * 8
+    for round := 0; round < maxRounds; round++ {
+        sleep(ANTI_ENTROPY_TIMEOUT_MIN, false)
+        done := true
+        for _, server := range servers {
+            server.logLock.Lock()
+            if server.omitCSN + len(server.CommitLog) < numWrites {
+                done = false
+            }
+            server.logLock.Unlock()
+        }
+        primary.logLock.Lock()
+        if primary.omitCSN == UNCOMMITTED_CSN {
+            done = false
+        }
+        primary.logLock.Unlock()
+        if done {
+            break
+        }
+    }
+
+    // Ensure truncated commits are still reflected in the databases,
+    // and the remaining commits continue from the truncation point
+    for _, server := range servers {
+        server.logLock.Lock()
+        assertEqual(t, server.omitCSN + len(server.CommitLog), numWrites,
+                "Server did not commit all writes")
+        for idx, entry := range server.CommitLog {
+            assertEqual(t, entry.CSN, server.omitCSN + idx + 1,
+                    "Commit log does not continue from truncation point")
+        }
+        server.logLock.Unlock()
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+    primary.logLock.Lock()
+    assert(t, primary.omitCSN > UNCOMMITTED_CSN, "Primary did not " +
+            "truncate its commit log")
+    assert(t, len(primary.CommitLog) < numWrites, "Truncated commits " +
+            "remained in commit log")
+    primary.logLock.Unlock()
+}
+
+/* Tests that a new server missing truncated commits *
+ * is caught up with a snapshot of a peer's commits,  *
+ * keeping its own tentative writes                   */
+func TestUnitServerSnapshot(t *testing.T) {
+    numServers := 3
+    numWrites := 4
+    startPort := 1129
+
+    serverPorts := make([]int, numServers)
+    for i := 0; i < numServers; i++ {
+        serverPorts[i] = startPort + i
+    }
+
+    servers, clients := createNetwork("test_snapshot",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    primary := servers[0]
+    primary.IsPrimary = true
+    for _, server := range servers {
+        server.TruncationThreshold = 1
+    }
+    startNetworkComm(servers)
+
+    rooms := []Room{}
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    write := func(serverID int, writeID int) {
+        room := Room{fmt.Sprintf("SNP%d", writeID), createDate(writeID, 0),
+                createDate(writeID, 1)}
+        rooms = append(rooms, room)
+        writeArgs := getRoomWriteArgs(writeID, room, check, merge)
+        var writeReply WriteReply
+        err := clients[serverID].Call("BayouServer.Write",
+                writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    waitForCommits := func(numCommits int) {
+        maxRounds := numServers * 8
+        for round := 0; round < maxRounds; round++ {
+            sleep(ANTI_ENTROPY_TIMEOUT_MIN, false)
+            done := true
+            for _, server := range servers {
+                server.logLock.Lock()
+                if server.omitCSN + len(server.CommitLog) < numCommits {
+                    done = false
+                }
+                server.logLock.Unlock()
+            }
+            primary.logLock.Lock()
+            if primary.omitCSN == UNCOMMITTED_CSN {
+                done = false
+            }
+            primary.logLock.Unlock()
+            if done {
+                break
+            }
+        }
+    }
+
+    // Commit a series of writes, until the primary truncates them
+    for i := 0; i < numWrites; i++ {
+        write(0, i)
+    }
+    waitForCommits(numWrites)
+
+    // Replace the last server with a new one, which can
+    // no longer receive the truncated commits, and give
+    // it a tentative write of its own
+    newID := numServers - 1
+    servers[newID].Kill()
+    servers[newID].commitDB.Close()
+    servers[newID].fullDB.Close()
+    DeletePersist(getDataDir("test_snapshot"), newID)
+    clients[newID].Close()
+    commitDB := getDB("test_snapshot_new_commit.db", true)
+    fullDB := getDB("test_snapshot_new_full.db", true)
+    newServer, err := NewBayouServer(newID, clients, commitDB, fullDB,
+            ROOMS_SCHEMA, getDataDir("test_snapshot"), serverPorts[newID])
+    ensureNoError(t, err, "Error restarting server: ")
+    servers[newID] = newServer
+    servers[newID].TruncationThreshold = 1
+    clients[newID] = startRPCClient(serverPorts[newID])
+    write(newID, numWrites)
+    servers[newID].Start()
+    waitForCommits(numWrites + 1)
+
+    // Ensure the new server installed a snapshot, and
+    // all servers reflect all writes in both views
+    servers[newID].logLock.Lock()
+    assert(t, servers[newID].omitCSN > UNCOMMITTED_CSN, "New server " +
+            "did not install a snapshot")
+    servers[newID].logLock.Unlock()
+    for _, server := range servers {
+        server.logLock.Lock()
+        assertEqual(t, server.omitCSN + len(server.CommitLog), numWrites + 1,
+                "Server did not commit all writes")
+        server.logLock.Unlock()
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+
+    // Ensure a snapshot that cannot be restored is reported,
+    // leaving both views and the logs as they were
+    primary.logLock.Lock()
+    snapshot, err := primary.takeSnapshot()
+    primary.logLock.Unlock()
+    ensureNoError(t, err, "Taking snapshot failed: ")
+    snapshot.CommitLog = nil
+    snapshot.Database.Objects = append(snapshot.Database.Objects,
+            "CREATE INDEX broken ON missing(Name)")
+    server := servers[newID]
+    server.logLock.Lock()
+    numCommits := len(server.CommitLog)
+    err = server.installSnapshot(snapshot)
+    assert(t, err != nil, "Server installed a broken snapshot")
+    assertEqual(t, len(server.CommitLog), numCommits,
+            "Failed snapshot changed the commit log")
+    server.logLock.Unlock()
+    assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+    assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+}
+
+/* Tests that servers can join the network through the *
+ * primary, and that retiring servers hand off their    *
+ * writes before leaving                                */
+func TestUnitServerMembership(t *testing.T) {
+    serverPorts := []int{1132, 1133}
+    joinPort := 1134
+    servers, clients := createNetwork("test_membership",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    primary := servers[0]
+    primary.IsPrimary = true
+    startNetworkComm(servers)
+
+    rooms := []Room{}
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    write := func(client *rpc.Client, writeID int) {
+        room := Room{fmt.Sprintf("MEM%d", writeID), createDate(writeID, 0),
+                createDate(writeID, 1)}
+        rooms = append(rooms, room)
+        writeArgs := getRoomWriteArgs(writeID, room, check, merge)
+        var writeReply WriteReply
+        err := client.Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    write(clients[1], 0)
+
+    // Ensure only the primary can add servers
+    commitDB := getDB("test_membership_join_commit.db", true)
+    fullDB := getDB("test_membership_join_full.db", true)
+    _, err := JoinBayouServer(clients[1],
+            fmt.Sprintf("localhost:%d", joinPort), commitDB, fullDB,
+            ROOMS_SCHEMA, getDataDir("test_membership"), joinPort)
+    assert(t, err != nil, "Non-primary server added a server")
+
+    // Add a new server through the primary, and write to it
+    joined, err := JoinBayouServer(clients[0],
+            fmt.Sprintf("localhost:%d", joinPort), commitDB, fullDB,
+            ROOMS_SCHEMA, getDataDir("test_membership"), joinPort)
+    ensureNoError(t, err, "Failed to join network: ")
+    defer cleanupServers([]*BayouServer{joined})
+    assertEqual(t, joined.id, len(serverPorts), "New server was assigned " +
+            "wrong ID")
+    joinedClient := startRPCClient(joinPort)
+    defer joinedClient.Close()
+    joined.Start()
+    write(joinedClient, 1)
+
+    // Wait until all servers know of each other, and have
+    // committed both writes (and the new server's join)
+    allServers := []*BayouServer{servers[0], servers[1], joined}
+    numCommits := 3
+    for round := 0; round < len(allServers) * 8; round++ {
+        sleep(ANTI_ENTROPY_TIMEOUT_MIN, false)
+        done := true
+        for _, server := range allServers {
+            server.logLock.Lock()
+            if len(server.CommitLog) < numCommits ||
+                    len(server.members) < len(allServers) {
+                done = false
+            }
+            server.logLock.Unlock()
+        }
+        if done {
+            break
+        }
+    }
+    for _, server := range allServers {
+        server.logLock.Lock()
+        assertEqual(t, len(server.CommitLog), numCommits, "Server did not " +
+                "commit all writes")
+        assertEqual(t, len(server.members), len(allServers), "Server did " +
+                "not learn of the new server")
+        assertEqual(t, len(server.tentativeClock), len(allServers), "Vector " +
+                "clock did not grow with the new server")
+        server.logLock.Unlock()
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+    }
+
+    // Retire a server, after giving it a write to hand off
+    write(clients[1], 2)
+    err = servers[1].Retire()
+    ensureNoError(t, err, "Failed to retire server: ")
+
+    // Ensure the remaining servers commit the retirement and its
+    // write, and then drop the retired server, since both of them
+    // committed its retirement
+    remaining := []*BayouServer{primary, joined}
+    waitForDrop := func() {
+        for round := 0; round < len(remaining) * 8; round++ {
+            sleep(ANTI_ENTROPY_TIMEOUT_MIN, false)
+            done := true
+            for _, server := range remaining {
+                server.logLock.Lock()
+                if !server.members[1].Dropped ||
+                        server.lastCSN() < numCommits + 2 {
+                    done = false
+                }
+                server.logLock.Unlock()
+            }
+            if done {
+                break
+            }
+        }
+    }
+    waitForDrop()
+    hasRetiredID := func(server *BayouServer) bool {
+        clocks := []VectorClock{server.commitClock, server.tentativeClock,
+                server.omitClock, server.omitAcceptClock, server.acked[0]}
+        for _, entry := range append(server.CommitLog,
+                server.TentativeLog...) {
+            clocks = append(clocks, entry.Timestamp, entry.AcceptStamp)
+        }
+        for _, clock := range clocks {
+            if _, exists := clock[1]; exists {
+                return true
+            }
+        }
+        return false
+    }
+    for _, server := range remaining {
+        server.logLock.Lock()
+        retired := server.members[1]
+        lastCSN := server.lastCSN()
+        numClockEntries := len(server.tentativeClock)
+        stillStamped := hasRetiredID(server)
+        compacted := server.peers[1] == nil && server.Omitted[1] == nil &&
+                server.acked[1] == nil
+        activePeers := server.activePeers()
+        server.logLock.Unlock()
+
+        assert(t, retired.Retired, "Server did not learn of the retirement")
+        assertEqual(t, lastCSN, numCommits + 2, "Server did not commit " +
+                "the retirement and its write")
+        assert(t, retired.Dropped, "Server did not drop the retired server")
+        assertEqual(t, numClockEntries, len(remaining), "Vector clock " +
+                "did not shrink once the retired server was dropped")
+        assert(t, !stillStamped, "Clocks or log stamps still hold the " +
+                "dropped server's logical time")
+        assert(t, compacted, "Server kept per-server state of the " +
+                "dropped server")
+        for _, peerID := range activePeers {
+            assert(t, peerID != 1, "Retired server is still an active peer")
+        }
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+    }
+
+    // Ensure the remaining servers keep committing writes
+    // (that are stamped without the dropped server)
+    numCommits++
+    write(joinedClient, 3)
+    waitForDrop()
+    for _, server := range remaining {
+        server.logLock.Lock()
+        lastCSN := server.lastCSN()
+        stillStamped := hasRetiredID(server)
+        server.logLock.Unlock()
+        assertEqual(t, lastCSN, numCommits + 2, "Server did not commit " +
+                "the write after the retired server was dropped")
+        assert(t, !stillStamped, "Write was stamped with the dropped " +
+                "server's logical time")
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+    }
+}
+
+/* Tests handing off primaryship, and that a primary that *
+ * was replaced has its later commits rejected            */
+func TestUnitServerPrimary(t *testing.T) {
+    serverPorts := []int{1135, 1136, 1137}
+    servers, clients := createNetwork("test_primary",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    servers[0].IsPrimary = true
+
+    rooms := []Room{}
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    write := func(client *rpc.Client, writeID int) Room {
+        room := Room{fmt.Sprintf("PRM%d", writeID), createDate(writeID, 0),
+                createDate(writeID, 1)}
+        writeArgs := getRoomWriteArgs(writeID, room, check, merge)
+        var writeReply WriteReply
+        err := client.Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+        return room
+    }
+
+    // Servers are not started, so anti-entropy only happens here
+    sync := func(from int, to int) bool {
+        servers[from].logLock.Lock()
+        defer servers[from].logLock.Unlock()
+        return servers[from].antiEntropyWith(to)
+    }
+
+    rooms = append(rooms, write(clients[1], 0))
+    sync(1, 0)
+
+    // Hand off primaryship, and ensure only the new primary commits
+    err := servers[1].HandOffPrimary(2)
+    assert(t, err != nil, "Non-primary server handed off primaryship")
+    err = servers[0].HandOffPrimary(2)
+    ensureNoError(t, err, "Failed to hand off primaryship: ")
+    assert(t, !servers[0].IsPrimary, "Old primary is still the primary")
+    assert(t, servers[2].IsPrimary, "New primary was not designated")
+    assertEqual(t, servers[2].epoch.Number, 1, "New primary has wrong epoch")
+
+    rooms = append(rooms, write(clients[0], 1))
+    assertEqual(t, len(servers[0].TentativeLog), 1, "Old primary " +
+            "committed a write")
+    designationCSN := servers[2].lastCSN()
+    rooms = append(rooms, write(clients[2], 2))
+    lastCommit := servers[2].CommitLog[len(servers[2].CommitLog) - 1]
+    assertEqual(t, lastCommit.CSN, designationCSN + 1, "New primary did " +
+            "not continue from the designation")
+    assertEqual(t, lastCommit.Epoch, 1, "Commit has wrong epoch")
+    sync(0, 2)
+    sync(2, 1)
+
+    // Partition the new primary, and let it commit a write
+    // while another server takes over primaryship
+    client2 := clients[2]
+    clients[2] = nil
+    rooms = append(rooms, write(client2, 3))
+    err = servers[1].TakeOverPrimary()
+    clients[2] = client2
+    ensureNoError(t, err, "Failed to take over primaryship: ")
+    assert(t, servers[1].IsPrimary, "Server did not take over primaryship")
+    assertEqual(t, servers[1].epoch.Number, 2, "New primary has wrong epoch")
+
+    // Ensure the replaced primary's stale commit is committed again
+    // by the new primary, once the replaced one learns of the epoch
+    // Note: omit timestamps are resolved again after the snapshot
+    assert(t, !sync(2, 1), "Stale primary's commits were accepted")
+    synced := false
+    for i := 0; i < 2 && !synced; i++ {
+        synced = sync(2, 1)
+    }
+    assert(t, synced, "Anti-entropy failed after discarding stale commits")
+    assert(t, !servers[2].IsPrimary, "Replaced primary is still the primary")
+    assertEqual(t, servers[2].epoch.Number, 2, "Replaced primary did not " +
+            "learn of the new epoch")
+    assertEqual(t, len(servers[2].CommitLog), len(servers[1].CommitLog),
+            "Commit logs differ")
+    for idx, entry := range servers[1].CommitLog {
+        assertEqual(t, servers[2].CommitLog[idx].WriteID, entry.WriteID,
+                "Commit logs differ")
+    }
+    lastCommit = servers[1].CommitLog[len(servers[1].CommitLog) - 1]
+    assertEqual(t, lastCommit.WriteID, 3, "Stale commit was lost")
+    assertEqual(t, lastCommit.Epoch, 2, "Stale commit was not committed " +
+            "again")
+    assertDBContentsEqual(t, servers[1].logLock, servers[1].commitDB, rooms)
+    assertDBContentsEqual(t, servers[2].logLock, servers[2].commitDB, rooms)
+    assertDBContentsEqual(t, servers[2].logLock, servers[2].fullDB, rooms)
+
+    // Ensure each server promises an epoch to a single server,
+    // and the primary stops committing once it promised one
+    promise := func(serverID int, candidateID int, number int) bool {
+        var reply PromiseReply
+        err := clients[serverID].Call("BayouServer.PromiseEpoch",
+                &PromiseArgs{candidateID, number}, &reply)
+        ensureNoError(t, err, "PromiseEpoch RPC failed: ")
+        return reply.Granted
+    }
+    assert(t, !promise(0, 2, 2), "Server promised a past epoch")
+    assert(t, promise(0, 2, 3), "Server did not promise a new epoch")
+    assert(t, promise(0, 2, 3), "Server did not repeat its promise")
+    assert(t, !promise(0, 1, 3), "Server promised an epoch twice")
+    assert(t, promise(1, 0, 3), "Primary did not promise a new epoch")
+    rooms = append(rooms, write(clients[1], 4))
+    servers[1].logLock.Lock()
+    numTentative := len(servers[1].TentativeLog)
+    servers[1].logLock.Unlock()
+    assertEqual(t, numTentative, 1, "Primary committed a write after " +
+            "promising a new epoch")
+
+    // Ensure a take over fails without a majority of the servers
+    client1 := clients[1]
+    clients[1], clients[2] = nil, nil
+    err = servers[0].TakeOverPrimary()
+    clients[1], clients[2] = client1, client2
+    assert(t, err != nil, "Server took over primaryship without a majority")
+    assert(t, !servers[0].IsPrimary, "Server took over primaryship " +
+            "without a majority")
+
+    // Ensure a take over with a majority collects the write,
+    // and commits it
+    err = servers[0].TakeOverPrimary()
+    ensureNoError(t, err, "Failed to take over primaryship: ")
+    assertEqual(t, servers[0].epoch.Number, 5, "New primary has wrong epoch")
+    synced = false
+    for i := 0; i < 2 && !synced; i++ {
+        synced = sync(1, 0)
+    }
+    assert(t, synced, "Anti-entropy failed after taking over")
+    assert(t, !servers[1].IsPrimary, "Replaced primary is still the primary")
+    for _, server := range servers[:2] {
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+    }
+}
+
+/* Tests that handing off and taking over primaryship, and retiring, *
+ * release logLock while waiting for peers, so the server keeps       *
+ * serving reads, and that they account for changes made meanwhile    */
+func TestUnitServerUnlockedPeerCalls(t *testing.T) {
+    serverPorts := []int{1174, 1175, 1176}
+    servers, clients := createNetwork("test_unlocked_peer_calls",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    servers[0].IsPrimary = true
+
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    write := func(serverID int, writeID int) error {
+        room := Room{fmt.Sprintf("ULK%d", writeID), createDate(writeID, 0),
+                createDate(writeID, 1)}
+        writeArgs := getRoomWriteArgs(writeID, room, check, merge)
+        var writeReply WriteReply
+        return clients[serverID].Call("BayouServer.Write", writeArgs,
+                &writeReply)
+    }
+
+    // Runs the operation while the provided peers hold their logLocks
+    // (so their handlers wait), and runs during in the meantime.
+    // Returns the operation's error, and whether the server kept
+    // serving reads while waiting for the peers
+    stalled := func(serverID int, peerIDs []int, operation func() error,
+            during func()) (error, bool) {
+        for _, peerID := range peerIDs {
+            servers[peerID].logLock.Lock()
+        }
+        done := make(chan error, 1)
+        go func() {
+            done <- operation()
+        }()
+        time.Sleep(time.Duration(ANTI_ENTROPY_TIMEOUT_MIN / 3) *
+                time.Millisecond)
+
+        readDone := make(chan error, 1)
+        go func() {
+            readArgs := &ReadArgs{Query: getReadAllQuery(), FromCommit: true}
+            var readReply ReadReply
+            readDone <- clients[serverID].Call("BayouServer.Read", readArgs,
+                    &readReply)
+        }()
+        served := false
+        select {
+        case err := <-readDone:
+            served = err == nil
+        case <-time.After(peerTimeout() / 2):
+        }
+        during()
+
+        for _, peerID := range peerIDs {
+            servers[peerID].logLock.Unlock()
+        }
+        return <-done, served
+    }
+
+    // Hand off primaryship while the new primary is stalled
+    err, served := stalled(0, []int{2}, func() error {
+        return servers[0].HandOffPrimary(2)
+    }, func() {})
+    ensureNoError(t, err, "Failed to hand off primaryship: ")
+    assert(t, served, "Primary held logLock while handing off primaryship")
+    assert(t, servers[2].IsPrimary, "New primary was not designated")
+
+    // Ensure a take over fails if its server promises a newer
+    // epoch to another server while waiting for its peers
+    servers[1].logLock.Lock()
+    synced := servers[1].antiEntropyWith(2)
+    servers[1].logLock.Unlock()
+    assert(t, synced, "Anti-entropy failed")
+    assertEqual(t, servers[1].epoch.Number, 1, "Server did not learn of " +
+            "the new primary's epoch")
+    var promiseReply PromiseReply
+    err, served = stalled(1, []int{0, 2}, func() error {
+        return servers[1].TakeOverPrimary()
+    }, func() {
+        clients[1].Call("BayouServer.PromiseEpoch", &PromiseArgs{0, 10},
+                &promiseReply)
+    })
+    assert(t, served, "Server held logLock while taking over primaryship")
+    assert(t, promiseReply.Granted, "Server refused to promise an epoch " +
+            "while taking over primaryship")
+    assert(t, err != nil && strings.Contains(err.Error(), "promised"),
+            "Server took over primaryship after promising a newer epoch " +
+            "to another server")
+    assert(t, !servers[1].IsPrimary, "Server took over primaryship after " +
+            "promising a newer epoch to another server")
+
+    err, served = stalled(1, []int{0}, func() error {
+        return servers[1].TakeOverPrimary()
+    }, func() {})
+    ensureNoError(t, err, "Failed to take over primaryship: ")
+    assert(t, served, "Server held logLock while taking over primaryship")
+    assert(t, servers[1].IsPrimary, "Server did not take over primaryship")
+    assertEqual(t, servers[1].epoch.Number, 11, "New primary has wrong epoch")
+
+    // Ensure a retiring server rejects writes while handing off its own
+    ensureNoError(t, write(0, 0), "Write RPC failed: ")
+    var retiringErr error
+    err, served = stalled(0, []int{1, 2}, func() error {
+        return servers[0].Retire()
+    }, func() {
+        retiringErr = write(0, 1)
+    })
+    ensureNoError(t, err, "Failed to retire: ")
+    assert(t, served, "Server held logLock while retiring")
+    assert(t, retiringErr != nil && strings.Contains(retiringErr.Error(),
+            INACTIVE_ERROR), "Retiring server accepted a write")
+    handedOff := 0
+    for _, server := range servers[1:] {
+        server.logLock.Lock()
+        for _, writeID := range writeIDs(server.TentativeLog) {
+            if writeID == 0 {
+                handedOff++
+            }
+        }
+        for _, writeID := range writeIDs(server.CommitLog) {
+            if writeID == 0 {
+                handedOff++
+            }
+        }
+        server.logLock.Unlock()
+    }
+    assert(t, handedOff > 0, "Retired server's write was not handed off")
+}
+
+/* Tests that a failing write is reported to the caller, and kept *
+ * in the log as failed (without effect) by every replica          */
+func TestUnitServerFailedWrite(t *testing.T) {
+    serverPorts := []int{1138, 1139}
+    servers, clients := createNetwork("test_failed_write",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    servers[0].IsPrimary = true
+
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    write := func(writeArgs *WriteArgs) error {
+        var writeReply WriteReply
+        return clients[1].Call("BayouServer.Write", writeArgs, &writeReply)
+    }
+
+    // The failed write's undo would remove the other writes' rooms
+    rooms := []Room{Room{"FLD0", createDate(0, 0), createDate(0, 1)},
+            Room{"FLD2", createDate(2, 0), createDate(2, 1)}}
+    err := write(getRoomWriteArgs(0, rooms[0], check, merge))
+    ensureNoError(t, err, "Write RPC failed: ")
+    failedArgs := getRoomWriteArgs(1, rooms[0], check, merge)
+    failedArgs.Query = "INSERT INTO nowhere VALUES(1)"
+    failedArgs.QueryArgs = nil
+    err = write(failedArgs)
+    assert(t, err != nil, "Failed write did not return an error")
+    err = write(getRoomWriteArgs(2, rooms[1], check, merge))
+    ensureNoError(t, err, "Write RPC after a failed write failed: ")
+
+    servers[1].logLock.Lock()
+    assertEqual(t, len(servers[1].TentativeLog), 3, "Failed write was not " +
+            "kept in the log")
+    assert(t, servers[1].TentativeLog[1].Error != "", "Failed write was " +
+            "not recorded as failed")
+    servers[1].logLock.Unlock()
+
+    // Ensure the primary commits the failed write as failed, and
+    // rolling back the tentative writes does not undo it
+    servers[1].logLock.Lock()
+    synced := servers[1].antiEntropyWith(0)
+    servers[1].logLock.Unlock()
+    assert(t, synced, "Anti-entropy failed")
+    for _, server := range servers {
+        server.logLock.Lock()
+        assertEqual(t, len(server.CommitLog), 3, "Server did not commit " +
+                "all writes")
+        assert(t, server.CommitLog[1].Error != "", "Failed write was not " +
+                "committed as failed")
+        assertEqual(t, server.CommitLog[0].Error, "", "Write was " +
+                "committed as failed")
+        server.logLock.Unlock()
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+}
+
+/* Tests that each write is applied to each view atomically, *
+ * including writes made of several statements               */
+func TestUnitServerWriteTransaction(t *testing.T) {
+    serverPorts := []int{1142}
+    servers, clients := createNetwork("test_write_transaction",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    server := servers[0]
+    server.IsPrimary = true
+
+    rooms := []Room{Room{"TXN0", createDate(0, 0), createDate(0, 1)},
+            Room{"TXN1", createDate(1, 0), createDate(1, 1)},
+            Room{"TXN2", createDate(2, 0), createDate(2, 1)}}
+    write := func(writeID int, writeRooms []Room, failing bool) error {
+        writeArgs := getRoomWriteArgs(writeID, writeRooms[0],
+                getBoolQuery(true), getBoolQuery(false))
+        for _, room := range writeRooms[1:] {
+            query, queryArgs := getInsertQuery(room)
+            writeArgs.Query += ";" + query
+            writeArgs.QueryArgs = append(writeArgs.QueryArgs, queryArgs...)
+        }
+        if failing {
+            writeArgs.Query += "; INSERT INTO nowhere VALUES(1)"
+        }
+        var writeReply WriteReply
+        return clients[0].Call("BayouServer.Write", writeArgs, &writeReply)
+    }
+
+    // Ensure all statements of a write are applied
+    err := write(0, rooms[:2], false)
+    ensureNoError(t, err, "Multi-statement Write RPC failed: ")
+    assertDBContentsEqual(t, server.logLock, server.commitDB, rooms[:2])
+    assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:2])
+
+    // Ensure a failing statement undoes the write's earlier statements
+    err = write(1, rooms[2:], true)
+    assert(t, err != nil, "Failed write did not return an error")
+    assertDBContentsEqual(t, server.logLock, server.commitDB, rooms[:2])
+    assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:2])
+    server.logLock.Lock()
+    assert(t, server.CommitLog[1].Error != "", "Failed write was not " +
+            "committed as failed")
+    server.logLock.Unlock()
+}
+
+/* Tests that query arguments are bound (rather than interpreted *
+ * as SQL) on every replica, and unsupported arguments rejected   */
+func TestUnitServerQueryArgs(t *testing.T) {
+    serverPorts := []int{1140, 1141}
+    servers, clients := createNetwork("test_query_args",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    servers[0].IsPrimary = true
+
+    rooms := []Room{Room{`a"); DROP TABLE rooms; --`, createDate(0, 0),
+            createDate(0, 1)}, Room{`b" OR "1" == "1`, createDate(1, 0),
+            createDate(1, 1)}}
+    for idx, room := range rooms {
+        writeArgs := getRoomWriteArgs(idx, room, getBoolQuery(true),
+                getBoolQuery(false))
+        var writeReply WriteReply
+        err := clients[1].Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+
+    servers[1].logLock.Lock()
+    synced := servers[1].antiEntropyWith(0)
+    servers[1].logLock.Unlock()
+    assert(t, synced, "Anti-entropy failed")
+    for _, server := range servers {
+        assertEqual(t, len(server.ErrorLog), 0, "Write with quoted " +
+                "arguments failed")
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+    }
+
+    // Ensure a read binds its arguments, so it only matches the room
+    query, queryArgs := getReadQuery(rooms[1])
+    readArgs := &ReadArgs{Query: query, FromCommit: true,
+            QueryArgs: queryArgs}
+    var readReply ReadReply
+    err := clients[0].Call("BayouServer.Read", readArgs, &readReply)
+    ensureNoError(t, err, "Read RPC failed: ")
+    assertRoomListsEqual(t, scanRooms(t, readReply.Data),
+            []Room{rooms[1]}, "Read with quoted arguments returned " +
+            "wrong rooms: ")
+
+    // Ensure arguments of unsupported types are rejected
+    writeArgs := getRoomWriteArgs(2, rooms[0], getBoolQuery(true),
+            getBoolQuery(false))
+    writeArgs.UndoArgs = []interface{}{rooms[0]}
+    var writeReply WriteReply
+    err = clients[0].Call("BayouServer.Write", writeArgs, &writeReply)
+    assert(t, err != nil, "Write with unsupported argument was accepted")
+    writeArgs = getRoomWriteArgs(2, rooms[0], getBoolQuery(true),
+            getBoolQuery(false))
+    writeArgs.ProcArgs = []interface{}{rooms[0]}
+    err = clients[0].Call("BayouServer.Write", writeArgs, &writeReply)
+    assert(t, err != nil, "Write with unsupported procedure argument " +
+            "was accepted")
+    readArgs.QueryArgs = []interface{}{rooms[0]}
+    err = clients[0].Call("BayouServer.Read", readArgs, &readReply)
+    assert(t, err != nil, "Read with unsupported argument was accepted")
+    assertEqual(t, len(servers[0].TentativeLog) + len(servers[0].CommitLog),
+            len(rooms), "Rejected write was logged")
+
+    // Ensure a nil argument is accepted, binding NULL
+    nullRoom := Room{"NUL0", createDate(2, 0), createDate(2, 1)}
+    writeArgs = getRoomWriteArgs(2, nullRoom, getBoolQuery(true),
+            getBoolQuery(false))
+    writeArgs.Query = `
+        INSERT INTO rooms(Name, StartTime, EndTime)
+        values(?, dateTime(?), ?)
+    `
+    writeArgs.QueryArgs = []interface{}{nullRoom.Name,
+            nullRoom.StartTime.Format(TIME_FORMAT_STR), nil}
+    writeReply = WriteReply{}
+    err = clients[0].Call("BayouServer.Write", writeArgs, &writeReply)
+    ensureNoError(t, err, "Write with nil argument failed: ")
+    servers[0].logLock.Lock()
+    synced = servers[0].antiEntropyWith(1)
+    servers[0].logLock.Unlock()
+    assert(t, synced, "Anti-entropy of write with nil argument failed")
+    readArgs = &ReadArgs{Query: `SELECT Name FROM rooms WHERE EndTime IS ?`,
+            FromCommit: true, QueryArgs: []interface{}{nil}}
+    readReply = ReadReply{}
+    err = clients[1].Call("BayouServer.Read", readArgs, &readReply)
+    ensureNoError(t, err, "Read with nil argument failed: ")
+    assertEqual(t, len(readReply.Data.Rows), 1, "Read with nil argument " +
+            "returned wrong number of rows")
+    assertEqual(t, readReply.Data.Rows[0][0], nullRoom.Name, "Read with " +
+            "nil argument returned wrong room")
+}
+
+/* Tests that servers enforce session guarantees */
+func TestUnitServerSession(t *testing.T) {
+    serverPorts := []int{1124, 1125}
+    servers, clients := createNetwork("test_session",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+
+    session := NewSession(READ_YOUR_WRITES)
+    room := Room{"SES0", createDate(0, 0), createDate(0, 1)}
+
+    // Write to the first server as part of the session
+    writeArgs := getRoomWriteArgs(0, room, getBoolQuery(true),
+            getBoolQuery(false))
+    writeArgs.Session = *session
+    var writeReply WriteReply
+    err := clients[0].Call("BayouServer.Write", writeArgs, &writeReply)
+    ensureNoError(t, err, "Session Write RPC failed: ")
+    session.observeWrite(writeReply.AcceptStamp)
+
+    // Ensure the other server refuses to serve the session's
+    // read, since it has not yet received the session's write
+    readArgs := &ReadArgs{Query: getReadAllQuery(), FromCommit: false,
+            Session: *session}
+    var readReply ReadReply
+    err = clients[1].Call("BayouServer.Read", readArgs, &readReply)
+    assert(t, err != nil, "Read violating read-your-writes succeeded.")
+
+    // Ensure reads without guarantees are still served
+    readArgs = &ReadArgs{Query: getReadAllQuery(), FromCommit: false}
+    readReply = ReadReply{}
+    err = clients[1].Call("BayouServer.Read", readArgs, &readReply)
+    ensureNoError(t, err, "Read without guarantees failed: ")
+    assertEqual(t, len(readReply.Data.Rows), 0, "Unsynchronized server " +
+            "returned unexpected data")
+
+    // Once anti-entropy runs, the read should wait for the write
+    startNetworkComm(servers)
+    readArgs = &ReadArgs{Query: getReadAllQuery(), FromCommit: false,
+            Session: *session}
+    readReply = ReadReply{}
+    err = clients[1].Call("BayouServer.Read", readArgs, &readReply)
+    ensureNoError(t, err, "Read-your-writes Read RPC failed: ")
+    assertRoomListsEqual(t, scanRooms(t, readReply.Data), []Room{room},
+            "Read did not reflect session's write")
+}
+
+/* Name of a test merge procedure that writes a room (given *
+ * its name, start and end time) to the database, then fails *
+ * to resolve                                                */
+const REJECTING_MERGE_PROC string = "testRejectingMerge"
+
+func init() {
+    RegisterProcedure(REJECTING_MERGE_PROC,
+            func(tx *BayouTx, args []interface{}) (bool, error) {
+        room := Room{args[0].(string), args[1].(time.Time),
+                args[2].(time.Time)}
+        query, queryArgs := getInsertQuery(room)
+        return false, tx.Execute(query, queryArgs...)
+    })
+    gob.Register(Room{})
+}
+
+/* Tests writes using registered Go procedures */
+func TestUnitServerProcedures(t *testing.T) {
+    servers, clients := createBayouNetwork("test_procedures", 1)
+    server := servers[0]
+    client := clients[0]
+    defer removeBayouNetwork(servers, clients)
+
+    // Claim an hour, then claim it again with the next free hour merge
+    ctx := context.Background()
+    err := client.ClaimRoom(ctx, "Frist", 1, 1)
+    ensureNoError(t, err, "Claiming a free room failed: ")
+    err = client.ClaimRoomOrNextHour(ctx, "Jadwin", 1, 1)
+    ensureNoError(t, err, "Claiming the next free hour failed: ")
+    err = client.ClaimRoomOrNextHour(ctx, "Fine", 1, 1)
+    ensureNoError(t, err, "Claiming the next free hour failed: ")
+
+    room, err := client.CheckRoom(ctx, "Jadwin", 1, 2, false)
+    ensureNoError(t, err, "Checking room failed: ")
+    assertEqual(t, room.Name, "Jadwin", "Merge procedure did not claim " +
+            "the next free hour")
+    room, err = client.CheckRoom(ctx, "Fine", 1, 3, false)
+    ensureNoError(t, err, "Checking room failed: ")
+    assertEqual(t, room.Name, "Fine", "Merge procedure did not claim " +
+            "the next free hour")
+    assertEqual(t, len(server.ErrorLog), 0, "Resolved write was written " +
+            "to error log")
+
+    // Ensure an unresolved merge procedure's writes are discarded
+    rejected := Room{"Rejected", createDate(2, 0), createDate(2, 1)}
+    writeArgs := getRoomWriteArgs(0, rejected, getBoolQuery(false),
+            getBoolQuery(true))
+    writeArgs.MergeProc = REJECTING_MERGE_PROC
+    writeArgs.ProcArgs = []interface{}{rejected.Name, rejected.StartTime,
+            rejected.EndTime}
+    err, hasConflict, wasResolved, _ := client.sendWrite(ctx, writeArgs)
+    assert(t, IsClientError(err, CLIENT_ERROR_CONFLICT), "Unresolved " +
+            "write did not return a conflict error")
+    assert(t, hasConflict, "Write failed to return conflict.")
+    assert(t, !wasResolved, "Rejecting merge procedure resolved write.")
+    assertEqual(t, len(server.ErrorLog), 1, "Unresolved write was not " +
+            "written to error log")
+    room, err = client.CheckRoom(ctx, "Rejected", 2, 0, false)
+    ensureNoError(t, err, "Checking room failed: ")
+    assertEqual(t, room.Name, "-1", "Unresolved merge procedure's " +
+            "write was kept")
+
+    // Ensure a procedure given malformed arguments fails the write
+    malformed := Room{"Frist", createDate(1, 1), createDate(1, 2)}
+    writeArgs = getRoomWriteArgs(1, malformed, getBoolQuery(false),
+            getBoolQuery(false))
+    writeArgs.MergeProc = NEXT_FREE_HOUR_PROC
+    writeArgs.ProcArgs = []interface{}{malformed.Name, "owner", 1}
+    err, _, _, _ = client.sendWrite(ctx, writeArgs)
+    assert(t, IsClientError(err, CLIENT_ERROR_FAILED), "Write with " +
+            "malformed procedure arguments did not fail")
+    writeArgs.ProcArgs = []interface{}{malformed.Name, "owner", 1, "1"}
+    err, _, _, _ = client.sendWrite(ctx, writeArgs)
+    assert(t, IsClientError(err, CLIENT_ERROR_FAILED), "Write with " +
+            "malformed procedure arguments did not fail")
+
+    // Ensure a merged write is undone by reverting the merge procedure's
+    // claim, rather than by running the undo of its own query (which
+    // would delete the claim it conflicted with)
+    merged := Room{"Frist", createDate(1, 1), createDate(1, 2)}
+    writeArgs = getRoomWriteArgs(2, merged, "", getBoolQuery(false))
+    writeArgs.Check, writeArgs.CheckArgs = getIsFreeQuery(merged.StartTime)
+    writeArgs.MergeProc = NEXT_FREE_HOUR_PROC
+    writeArgs.ProcArgs = []interface{}{merged.Name, "owner", 1, 1}
+    err, _, _, _ = client.sendWrite(ctx, writeArgs)
+    ensureNoError(t, err, "Claiming the next free hour failed: ")
+    server.logLock.Lock()
+    server.rollbackDB(len(server.TentativeLog) - 1)
+    server.logLock.Unlock()
+    room, err = client.CheckRoom(ctx, "Frist", 1, 1, false)
+    ensureNoError(t, err, "Checking room failed: ")
+    assertEqual(t, room.Name, "Frist", "Undoing a merged write undid " +
+            "the claim it conflicted with")
+    room, err = client.CheckRoom(ctx, "Frist", 1, 4, false)
+    ensureNoError(t, err, "Checking room failed: ")
+    assertEqual(t, room.Name, "-1", "Undoing a merged write kept the " +
+            "merge procedure's claim")
+
+    // Ensure undoing the merged writes removes the alternate claims
+    server.logLock.Lock()
+    server.rollbackDB(0)
+    server.logLock.Unlock()
+    assertDBContentsEqual(t, server.logLock, server.fullDB, []Room{})
+}
+
+/* Tests writes with alternate writes */
+func TestUnitServerAlternates(t *testing.T) {
+    servers, clients := createBayouNetwork("test_alternates", 1)
+    server := servers[0]
+    client := clients[0]
+    defer removeBayouNetwork(servers, clients)
+
+    // Book room A at 10, else room B at 10, else room A at 11
+    roomA10 := Room{"A", createDate(1, 10), createDate(1, 11)}
+    roomB10 := Room{"B", createDate(1, 10), createDate(1, 11)}
+    roomA11 := Room{"A", createDate(1, 11), createDate(1, 12)}
+    choices := []Room{roomA10, roomB10, roomA11}
+
+    ctx := context.Background()
+    for exp := 0; exp < len(choices); exp++ {
+        claimed, err := client.ClaimFirstFreeRoom(ctx, choices)
+        ensureNoError(t, err, "Claiming a free room failed: ")
+        assertEqual(t, claimed, exp, fmt.Sprintf("Claimed choice %d " +
+                "instead of %d", claimed, exp))
+    }
+    claimed, err := client.ClaimFirstFreeRoom(ctx, choices)
+    assertEqual(t, claimed, -1, "Claimed a room when none were free")
+    assert(t, IsClientError(err, CLIENT_ERROR_CONFLICT), "Claim when no " +
+            "room was free did not return a conflict error")
+    assertEqual(t, len(server.ErrorLog), 1, "Unresolved write was not " +
+            "written to error log")
+    assertEqual(t, server.TentativeLog[1].Alternate, 0, "Applied " +
+            "alternate not recorded on log entry")
+    assertDBContentsEqual(t, server.logLock, server.fullDB,
+            []Room{roomA10, roomA11, roomB10})
+
+    // Ensure rolling back undoes the applied alternates
+    server.logLock.Lock()
+    server.rollbackDB(0)
+    server.logLock.Unlock()
+    assertDBContentsEqual(t, server.logLock, server.fullDB, []Room{})
+}
+
 /* Tests server persistence and recovery */
 func TestUnitServerPersist(t *testing.T) {
     servers, clients := createBayouNetwork("persistTest", 1)
-    clients[0].ClaimRoom("Frist",  1, 1)
-    clients[0].ClaimRoom("Jadwin", 1, 1)
+    clients[0].ClaimRoom(context.Background(), "Frist",  1, 1)
+    clients[0].ClaimRoom(context.Background(), "Jadwin", 1, 1)
 
     log1 := servers[0].TentativeLog
 
+    // Ensure no one else can open the server's persist files
+    _, err := OpenPersistStore(getDataDir("persistTest"), 0)
+    assert(t, err != nil, "Opened persist files of a live server")
+
     // kill them all (muahaha)
     clients[0].Kill()
     servers[0].Kill()
@@ -681,6 +2585,492 @@ func TestUnitServerPersist(t *testing.T) {
     assertLogsEqual(t, log1, log2, true)
 }
 
+/* Tests recovery from a checkpoint and the WAL records after it, *
+ * including rollbacks, ignoring a record torn by a crash         */
+func TestUnitServerWAL(t *testing.T) {
+    numWrites := 7
+    servers, clients := createBayouNetwork("walTest", 1)
+    server := servers[0]
+    assertEqual(t, server.wal.SyncMode, WAL_SYNC_ALWAYS, "WAL does not " +
+            "sync every record by default")
+    server.wal.CheckpointInterval = 4
+    for i := 0; i < numWrites; i++ {
+        clients[0].ClaimRoom(context.Background(), fmt.Sprintf("WAL%d", i),
+                1, 1)
+    }
+    server.logLock.Lock()
+    server.rollbackDB(numWrites - 2)
+    server.logLock.Unlock()
+    clients[0].ClaimRoom(context.Background(), "WAL", 2, 1)
+
+    // Ensure segments before the latest checkpoint were deleted
+    segments := server.store.listSegments()
+    assert(t, len(segments) <= 2, "WAL segments were not compacted")
+    assert(t, segments[0] > 0, "No checkpoint was taken")
+
+    tentativeLog := server.TentativeLog
+    undoLog := server.UndoLog
+    clients[0].Kill()
+    server.Kill()
+    server.commitDB.Close()
+    server.fullDB.Close()
+
+    // Simulate a crash while writing a record
+    lastSegment := segments[len(segments) - 1]
+    file, err := os.OpenFile(server.store.segmentPath(lastSegment),
+            os.O_WRONLY | os.O_APPEND, 0644)
+    ensureNoError(t, err, "Failed to open WAL segment: ")
+    _, err = file.Write([]byte{0xff, 0, 0, 0, 1, 2, 3})
+    ensureNoError(t, err, "Failed to write WAL segment: ")
+    file.Close()
+
+    servers, clients = createBayouNetwork("walTest", 1)
+    defer removeBayouNetwork(servers, clients)
+    assertEqual(t, len(servers[0].TentativeLog), numWrites - 1,
+            "Recovered wrong number of writes")
+    assertLogsEqual(t, servers[0].TentativeLog, tentativeLog, true)
+    assertLogsEqual(t, servers[0].UndoLog, undoLog, true)
+}
+
+/* Tests that a write whose WAL record cannot be written is reported *
+ * to the client (and persisted by the next checkpoint), and that a  *
+ * server whose WAL holds an invalid record fails to restart         */
+func TestUnitServerWALErrors(t *testing.T) {
+    testName := "test_wal_errors"
+    serverPorts := []int{1169}
+    servers, clients := createNetwork(testName, serverPorts, serverPorts)
+    server := servers[0]
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    write := func(writeID int) error {
+        room := Room{fmt.Sprintf("WALE%d", writeID), createDate(writeID, 0),
+                createDate(writeID, 1)}
+        writeArgs := getRoomWriteArgs(writeID, room, check, merge)
+        var writeReply WriteReply
+        return clients[0].Call("BayouServer.Write", writeArgs, &writeReply)
+    }
+    err := write(0)
+    ensureNoError(t, err, "Write RPC failed: ")
+
+    // Make appending to the current segment fail
+    server.logLock.Lock()
+    segmentPath := server.store.segmentPath(server.wal.segment)
+    server.wal.file.Close()
+    server.wal.file, err = os.Open(segmentPath)
+    server.logLock.Unlock()
+    ensureNoError(t, err, "Failed to open WAL segment: ")
+    err = write(1)
+    assert(t, err != nil && strings.Contains(err.Error(), "persist"),
+            "Write that was not persisted did not fail")
+
+    // Ensure the server checkpoints its state (including the
+    // write it failed to persist) before appending again
+    err = write(2)
+    ensureNoError(t, err, "Write RPC failed after a failed append: ")
+    server.logLock.Lock()
+    tentativeLog := server.TentativeLog
+    lastSegment := server.wal.segment
+    server.logLock.Unlock()
+    assertEqual(t, len(tentativeLog), 3, "Server lost the write it " +
+            "failed to persist")
+    cleanupRPCClients(clients)
+    server.Kill()
+    server.commitDB.Close()
+    server.fullDB.Close()
+
+    servers, clients = createNetwork(testName, serverPorts, serverPorts)
+    server = servers[0]
+    defer DeletePersist(server.store.dir, server.id)
+    assertLogsEqual(t, server.TentativeLog, tentativeLog, true)
+    lastSegment = server.wal.segment - 1
+    cleanupRPCClients(clients)
+    server.Kill()
+    server.commitDB.Close()
+    server.fullDB.Close()
+
+    // Append a record that passes its checksum, but cannot be decoded
+    payload := []byte{0x02, 0xff, 0xff}
+    frame := make([]byte, WAL_HEADER_SIZE + len(payload))
+    binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+    binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+    copy(frame[WAL_HEADER_SIZE:], payload)
+    file, err := os.OpenFile(server.store.segmentPath(lastSegment),
+            os.O_WRONLY | os.O_APPEND, 0644)
+    ensureNoError(t, err, "Failed to open WAL segment: ")
+    _, err = file.Write(frame)
+    file.Close()
+    ensureNoError(t, err, "Failed to write WAL segment: ")
+
+    commitDB := getDB(testName + "_0_commit.db", false)
+    fullDB := getDB(testName + "_0_full.db", false)
+    defer commitDB.Close()
+    defer fullDB.Close()
+    _, err = NewBayouServer(0, make([]*rpc.Client, 1), commitDB, fullDB,
+            ROOMS_SCHEMA, getDataDir(testName), serverPorts[0])
+    assert(t, err != nil, "Server restarted from an invalid WAL record")
+}
+
+/* Tests that a restarted server resumes applying writes from the *
+ * position each view reflects (rather than applying them again),  *
+ * and rebuilds a view that was lost                               */
+func TestUnitServerAppliedIndex(t *testing.T) {
+    testName := "test_applied_index"
+    port := 1143
+    servers, clients := createNetwork(testName, []int{port}, []int{port})
+    server := servers[0]
+    server.IsPrimary = true
+
+    rooms := []Room{Room{"APL0", createDate(0, 0), createDate(0, 1)},
+            Room{"APL1", createDate(1, 0), createDate(1, 1)}}
+    check := getBoolQuery(true)
+    merge := getBoolQuery(false)
+    for i, room := range rooms {
+        // Only the first write is committed
+        server.IsPrimary = i == 0
+        var writeReply WriteReply
+        err := clients[0].Call("BayouServer.Write",
+                getRoomWriteArgs(i, room, check, merge), &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+
+    // Restarts the server, resetting its full view if requested
+    restart := func(resetFull bool) {
+        cleanupRPCClients(clients)
+        server.Kill()
+        server.commitDB.Close()
+        server.fullDB.Close()
+        commitDB := getDB(testName + "_0_commit.db", false)
+        fullDB := getDB(testName + "_0_full.db", resetFull)
+        var err error
+        server, err = NewBayouServer(0, make([]*rpc.Client, 1), commitDB,
+                fullDB, ROOMS_SCHEMA, getDataDir(testName), port)
+        ensureNoError(t, err, "Error restarting server: ")
+        servers[0] = server
+        clients[0] = startRPCClient(port)
+    }
+    assertRestarted := func() {
+        server.logLock.Lock()
+        numErrors := len(server.ErrorLog)
+        commitApplied := server.commitDB.applied
+        fullApplied := server.fullDB.applied
+        commitCSN := server.CommitLog[0].CSN
+        server.logLock.Unlock()
+        assertEqual(t, numErrors, 0, "Writes failed when replayed after " +
+                "restarting")
+        assertEqual(t, commitApplied.CSN, commitCSN, "Commit view does " +
+                "not reflect the commit")
+        assertEqual(t, fullApplied.CSN, commitCSN, "Full view does not " +
+                "reflect the commit")
+        assertEqual(t, len(fullApplied.Writes), 1, "Full view does not " +
+                "reflect the tentative write")
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms[:1])
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+
+    // Ensure no write is applied twice to either view
+    restart(false)
+    defer func() { removeNetwork(servers, clients) }()
+    assertRestarted()
+
+    // Ensure a lost full view is rebuilt from the commit view
+    restart(true)
+    assertRestarted()
+}
+
+/* Tests that a primary restarted with views reflecting commits its *
+ * log lost rebuilds them from the log, and commits no writes until  *
+ * it recovers the lost commits, so that no CSN is assigned twice    */
+func TestUnitServerLostCommits(t *testing.T) {
+    testName := "test_lost_commits"
+    serverPorts := []int{1161, 1162}
+    servers, clients := createNetwork(testName, serverPorts, serverPorts)
+    defer func() { removeNetwork(servers, clients) }()
+    servers[0].IsPrimary = true
+
+    rooms := []Room{Room{"LST0", createDate(0, 0), createDate(0, 1)},
+            Room{"LST1", createDate(1, 0), createDate(1, 1)},
+            Room{"LST2", createDate(2, 0), createDate(2, 1)}}
+    write := func(writeID int) {
+        var writeReply WriteReply
+        err := clients[0].Call("BayouServer.Write", getRoomWriteArgs(writeID,
+                rooms[writeID], getBoolQuery(true), getBoolQuery(false)),
+                &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    // Note: the first exchange may only resolve the omit timestamps
+    antiEntropy := func(server *BayouServer, targetID int) {
+        server.logLock.Lock()
+        exchanged := false
+        for attempt := 0; attempt < 2 && !exchanged; attempt++ {
+            exchanged = server.antiEntropyWith(targetID)
+        }
+        server.logLock.Unlock()
+        assert(t, exchanged, "Anti-entropy failed")
+    }
+
+    // Commit two writes (the second of which reaches the other server),
+    // then restart the primary as if it crashed before logging the
+    // second one, after applying it
+    write(0)
+    servers[0].logLock.Lock()
+    segment := servers[0].wal.segment
+    size := servers[0].wal.size
+    servers[0].logLock.Unlock()
+    write(1)
+    antiEntropy(servers[1], 0)
+    cleanupRPCClients(clients[:1])
+    servers[0].Kill()
+    servers[0].commitDB.Close()
+    servers[0].fullDB.Close()
+    err := os.Truncate(servers[0].store.segmentPath(segment), size)
+    ensureNoError(t, err, "Truncating WAL failed: ")
+    commitDB := getDB(testName + "_0_commit.db", false)
+    fullDB := getDB(testName + "_0_full.db", false)
+    server, err := NewBayouServer(0, clients, commitDB, fullDB,
+            ROOMS_SCHEMA, getDataDir(testName), serverPorts[0])
+    ensureNoError(t, err, "Error restarting server: ")
+    servers[0] = server
+    clients[0] = startRPCClient(serverPorts[0])
+
+    // Ensure the views were rebuilt from the log, and the primary
+    // keeps new writes tentative while the lost commit is missing
+    server.logLock.Lock()
+    server.IsPrimary = true
+    lastCSN := server.lastCSN()
+    commitApplied := server.commitDB.applied
+    fullApplied := server.fullDB.applied
+    server.logLock.Unlock()
+    assertEqual(t, lastCSN, 1, "Server did not lose the commit")
+    assertEqual(t, commitApplied.CSN, 1, "Commit view was not rebuilt " +
+            "from the log")
+    assertEqual(t, fullApplied.CSN, 1, "Full view was not rebuilt from " +
+            "the log")
+    write(2)
+    server.logLock.Lock()
+    numTentative := len(server.TentativeLog)
+    server.logLock.Unlock()
+    assertEqual(t, numTentative, 1, "Server committed a write before " +
+            "recovering its lost commit")
+
+    // Ensure the lost commit is recovered, and the write is then
+    // committed after it on both servers
+    antiEntropy(server, 1)
+    antiEntropy(servers[1], 0)
+    for _, server := range servers {
+        server.logLock.Lock()
+        commitLog := server.CommitLog
+        server.logLock.Unlock()
+        assertEqual(t, len(commitLog), len(rooms), "Server did not " +
+                "commit all writes")
+        for idx, entry := range commitLog {
+            assertEqual(t, entry.WriteID, idx, "Commit has wrong write")
+            assertEqual(t, entry.CSN, idx + 1, "Commit has wrong CSN")
+        }
+        assertDBContentsEqual(t, server.logLock, server.commitDB, rooms)
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms)
+    }
+}
+
+/* Tests that writes without an undo are rolled back by reverting *
+ * the changes captured when they were applied, and that writes   *
+ * whose changes cannot be reverted are rolled back by rebuilding *
+ * the full view                                                  */
+func TestUnitServerAutoUndo(t *testing.T) {
+    serverPorts := []int{1144}
+    servers, clients := createNetwork("test_auto_undo",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    server := servers[0]
+
+    noUndo := func(query string, queryArgs []interface{}) *WriteArgs {
+        return &WriteArgs{WriteID: randomInt(), Query: query,
+                QueryArgs: queryArgs, Check: getBoolQuery(true),
+                Merge: getBoolQuery(false)}
+    }
+    write := func(writeArgs *WriteArgs) {
+        var writeReply WriteReply
+        err := clients[0].Call("BayouServer.Write", writeArgs, &writeReply)
+        ensureNoError(t, err, "Write RPC without an undo failed: ")
+    }
+    rollback := func() {
+        server.logLock.Lock()
+        server.rollbackDB(0)
+        server.logLock.Unlock()
+    }
+
+    rooms := []Room{Room{"AUT0", createDate(0, 0), createDate(0, 1)},
+            Room{"AUT1", createDate(1, 0), createDate(1, 1)},
+            Room{"AUT2", createDate(2, 0), createDate(2, 1)}}
+    server.IsPrimary = true
+    write(noUndo(getInsertQuery(rooms[0])))
+    write(noUndo(getInsertQuery(rooms[1])))
+    server.IsPrimary = false
+
+    // Ensure inserted, updated, and deleted rows are all reverted
+    write(noUndo(getInsertQuery(rooms[2])))
+    write(noUndo(`UPDATE rooms SET EndTime = dateTime(?) WHERE Name == ?`,
+            []interface{}{createDate(0, 2).Format(TIME_FORMAT_STR),
+            rooms[0].Name}))
+    write(noUndo(getDeleteQuery(rooms[1])))
+    assertDBContentsEqual(t, server.logLock, server.fullDB,
+            []Room{Room{"AUT0", createDate(0, 0), createDate(0, 2)},
+            rooms[2]})
+    rollback()
+    assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:2])
+
+    // Ensure a write changing the schema is rolled back too
+    insertQuery, insertArgs := getInsertQuery(rooms[2])
+    write(noUndo("CREATE TABLE extra(Value); " + insertQuery, insertArgs))
+    rollback()
+    assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:2])
+    server.logLock.Lock()
+    created, err := server.fullDB.Check(`SELECT EXISTS (SELECT * FROM ` +
+            `sqlite_master WHERE type == "table" AND name == "extra")`)
+    server.logLock.Unlock()
+    ensureNoError(t, err, "Checking for the created table failed: ")
+    assert(t, !created, "Table created by a rolled back write remains")
+}
+
+/* Tests that rolling back the full view by undoing writes, and by *
+ * rebuilding it from the commit view, leave it in the same state   */
+func TestUnitServerRollbackModes(t *testing.T) {
+    serverPorts := []int{1145}
+    servers, clients := createNetwork("test_rollback_modes",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    server := servers[0]
+
+    rooms := []Room{Room{"RBM0", createDate(0, 0), createDate(0, 1)},
+            Room{"RBM1", createDate(1, 0), createDate(1, 1)},
+            Room{"RBM2", createDate(2, 0), createDate(2, 1)}}
+    write := func(room Room) {
+        var writeReply WriteReply
+        err := clients[0].Call("BayouServer.Write", getRoomWriteArgs(
+                randomInt(), room, getBoolQuery(true), getBoolQuery(false)),
+                &writeReply)
+        ensureNoError(t, err, "Write RPC failed: ")
+    }
+    server.IsPrimary = true
+    write(rooms[0])
+    server.IsPrimary = false
+
+    for _, mode := range []RollbackMode{ROLLBACK_UNDO, ROLLBACK_REBUILD} {
+        server.RollbackMode = mode
+        write(rooms[1])
+        write(rooms[2])
+
+        // Ensure only the writes after the target length are rolled back
+        server.logLock.Lock()
+        server.rollbackDB(1)
+        numApplied := server.fullDB.applied.numApplied(server.TentativeLog)
+        server.logLock.Unlock()
+        assertEqual(t, numApplied, 1, "Full view does not reflect the " +
+                "tentative writes kept")
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:2])
+
+        server.logLock.Lock()
+        server.rollbackDB(0)
+        server.logLock.Unlock()
+        assertDBContentsEqual(t, server.logLock, server.fullDB, rooms[:1])
+    }
+}
+
+/* Tests that the migrations registered with a server are written to *
+ * the log, so that every server (even one constructed without them) *
+ * migrates both of its views, and that they are only written once   */
+func TestUnitServerMigrations(t *testing.T) {
+    testName := "test_migrations"
+    serverPorts := []int{1147, 1148}
+    servers, clients := createNetwork(testName, serverPorts, serverPorts)
+    defer removeNetwork(servers, clients)
+    servers[0].IsPrimary = true
+    startNetworkComm(servers)
+
+    room := Room{"MIG0", createDate(0, 0), createDate(0, 1)}
+    var writeReply WriteReply
+    err := clients[1].Call("BayouServer.Write", getRoomWriteArgs(0, room,
+            getBoolQuery(true), getBoolQuery(false)), &writeReply)
+    ensureNoError(t, err, "Write RPC failed: ")
+
+    // Restarts the second server with migrations adding a column and
+    // an index, and returns the number of migrations in its logs
+    schema := Schema{ROOMS_SCHEMA.Tables, []Migration{
+            Migration{1, `ALTER TABLE rooms ADD COLUMN Capacity INTEGER ` +
+                    `NOT NULL DEFAULT 0`},
+            Migration{2, `CREATE INDEX rooms_by_name ON rooms(Name)`}}}
+    restart := func() int {
+        servers[1].Kill()
+        servers[1].commitDB.Close()
+        servers[1].fullDB.Close()
+        clients[1].Close()
+        commitDB := getDB(testName + "_1_commit.db", false)
+        fullDB := getDB(testName + "_1_full.db", false)
+
+        // Ensure an invalid schema, or a port in use, is reported
+        // (releasing the persist files for the restart)
+        invalid := Schema{schema.Tables, schema.Migrations[1:]}
+        _, err := NewBayouServer(1, clients, commitDB, fullDB, invalid,
+                getDataDir(testName), serverPorts[1])
+        assert(t, err != nil, "Server started with an invalid schema")
+        _, err = NewBayouServer(1, clients, commitDB, fullDB, schema,
+                getDataDir(testName), serverPorts[0])
+        assert(t, err != nil, "Server started on a port in use")
+
+        server, err := NewBayouServer(1, clients, commitDB, fullDB, schema,
+                getDataDir(testName), serverPorts[1])
+        ensureNoError(t, err, "Error restarting server: ")
+        servers[1] = server
+        clients[1] = startRPCClient(serverPorts[1])
+
+        numMigrations := 0
+        for _, entry := range append(servers[1].CommitLog,
+                servers[1].TentativeLog...) {
+            if entry.Migration != NO_MIGRATION {
+                numMigrations++
+            }
+        }
+        servers[1].Start()
+        return numMigrations
+    }
+    migrated := func(server *BayouServer) bool {
+        server.logLock.Lock()
+        defer server.logLock.Unlock()
+        commitVersion, err := server.commitDB.SchemaVersion()
+        ensureNoError(t, err, "Reading schema version failed: ")
+        fullVersion, err := server.fullDB.SchemaVersion()
+        ensureNoError(t, err, "Reading schema version failed: ")
+        return commitVersion == 2 && fullVersion == 2
+    }
+
+    assertEqual(t, restart(), 2, "Server did not write its migrations")
+    for round := 0; round < 16; round++ {
+        sleep(ANTI_ENTROPY_TIMEOUT_MIN, false)
+        if migrated(servers[0]) && migrated(servers[1]) {
+            break
+        }
+    }
+
+    // Ensure both views of each server were migrated, keeping their rows
+    for _, server := range servers {
+        assert(t, migrated(server), "Server did not commit the migrations")
+        for _, db := range []*BayouDB{server.commitDB, server.fullDB} {
+            server.logLock.Lock()
+            result, err := db.Read(`SELECT Capacity FROM rooms`)
+            indexed, indexErr := db.Check(`SELECT EXISTS (SELECT * FROM ` +
+                    `sqlite_master WHERE name == "rooms_by_name")`)
+            server.logLock.Unlock()
+            ensureNoError(t, err, "Reading migrated column failed: ")
+            ensureNoError(t, indexErr, "Checking for migrated index failed: ")
+            assertEqual(t, len(result), 1, "Migrated table lost its rows")
+            assert(t, indexed, "Migrated index was not created")
+            assertDBContentsEqual(t, server.logLock, db, []Room{room})
+        }
+    }
+
+    // Ensure migrations the views reflect are not written again
+    assertEqual(t, restart(), 2, "Server wrote applied migrations again")
+}
+
 /******************************
  *    BAYOU NETWORK TESTS     *
  ******************************/
@@ -708,19 +3098,104 @@ func removeBayouNetwork(servers []*BayouServer, clients []*BayouClient) {
     cleanupServers(servers)
 }
 
-/* Tests client functionality */
+/* Tests client functionality, and the *
+ * kinds of errors client calls return  */
 func TestUnitClient(t *testing.T) {
-    servers, clients := createBayouNetwork("test_client", 1)
+    servers, clients := createBayouNetwork("test_client", 2)
     defer removeBayouNetwork(servers, clients)
+    ctx := context.Background()
 
     // Test non-conflicting write
-    clients[0].ClaimRoom("Frist", 1, 1)
+    err := clients[0].ClaimRoom(ctx, "Frist", 1, 1)
+    ensureNoError(t, err, "Claiming a free room failed: ")
 
     // Check that room is claimed
-    room := clients[0].CheckRoom("Frist", 1, 1, false)
+    room, err := clients[0].CheckRoom(ctx, "Frist", 1, 1, false)
+    ensureNoError(t, err, "Checking room failed: ")
     assert(t, room.Name == "Frist", "Room is broken")
 
     // Check that other room is not claimed
-    room = clients[0].CheckRoom("Frist", 2, 1, false)
+    room, err = clients[0].CheckRoom(ctx, "Frist", 2, 1, false)
+    ensureNoError(t, err, "Checking room failed: ")
     assert(t, room.Name == "-1", "Room is broken")
+
+    // Ensure each kind of failure returns its kind of error
+    err = clients[0].ClaimRoom(ctx, "Jadwin", 1, 1)
+    assert(t, IsClientError(err, CLIENT_ERROR_CONFLICT), "Conflicting " +
+            "claim did not return a conflict error")
+    canceled, cancel := context.WithCancel(ctx)
+    cancel()
+    _, err = clients[0].CheckRoom(canceled, "Frist", 1, 1, false)
+    assert(t, IsClientError(err, CLIENT_ERROR_CANCELED), "Canceled call " +
+            "did not return a canceled error")
+    expired, cancel := context.WithTimeout(ctx, 0)
+    defer cancel()
+    _, err = clients[0].CheckRoom(expired, "Frist", 1, 1, false)
+    assert(t, IsClientError(err, CLIENT_ERROR_TIMEOUT), "Expired call " +
+            "did not return a timeout error")
+
+    // The other server never hears of the session's write
+    clients[1].JoinSession(clients[0].Session())
+    clients[1].Session().Guarantees = READ_YOUR_WRITES
+    _, err = clients[1].CheckRoom(ctx, "Frist", 1, 1, false)
+    assert(t, IsClientError(err, CLIENT_ERROR_UNRESOLVED), "Read of an " +
+            "unsynchronized server did not return an unresolved error")
+
+    servers[1].Kill()
+    _, err = clients[1].CheckRoom(ctx, "Frist", 1, 1, false)
+    assert(t, IsClientError(err, CLIENT_ERROR_INACTIVE), "Call to a " +
+            "killed server did not return an inactive error")
+}
+
+/* Tests that a client with multiple servers fails over *
+ * to another when its server is killed, without        *
+ * breaking its session's guarantees                    */
+func TestUnitReplicatedClient(t *testing.T) {
+    serverPorts := []int{1149, 1150, 1151}
+    servers, rpcClients := createNetwork("test_replicated_client",
+            serverPorts, serverPorts)
+    defer removeNetwork(servers, rpcClients)
+    ctx := context.Background()
+
+    addresses := []string{"localhost:1150", "localhost:1151",
+            "localhost:1149"}
+    client := NewReplicatedClient(0, addresses)
+    defer client.Kill()
+    client.StartSession(READ_YOUR_WRITES)
+
+    // The first server serves calls until it is killed
+    err := client.ClaimRoom(ctx, "Fail", 1, 1)
+    ensureNoError(t, err, "Claiming a free room failed: ")
+    assertEqual(t, client.Replica(), addresses[0], "Client did not call " +
+            "its first server")
+    servers[1].logLock.Lock()
+    servers[1].antiEntropyWith(2)
+    servers[1].logLock.Unlock()
+    servers[1].Kill()
+
+    room, err := client.CheckRoom(ctx, "Fail", 1, 1, false)
+    ensureNoError(t, err, "Checking room after failover failed: ")
+    assertEqual(t, room.Name, "Fail", "Read after failover did not " +
+            "reflect the session's write")
+    assertEqual(t, client.Replica(), addresses[1], "Client did not fail " +
+            "over to its next server")
+
+    // The only server left never hears of the session's next write,
+    // so it must not serve the session's reads
+    err = client.ClaimRoom(ctx, "Fail", 2, 1)
+    ensureNoError(t, err, "Claiming a free room failed: ")
+    servers[2].Kill()
+    _, err = client.CheckRoom(ctx, "Fail", 2, 1, false)
+    assert(t, IsClientError(err, CLIENT_ERROR_UNRESOLVED), "Read of an " +
+            "unsynchronized server did not return an unresolved error")
+
+    // Nearest servers are called first, and servers that were down last
+    nearest := NewReplicatedClient(1, addresses)
+    nearest.Policy = REPLICA_NEAREST
+    nearest.replicas[0].latency = 3 * time.Millisecond
+    nearest.replicas[1].latency = 1 * time.Millisecond
+    nearest.replicas[1].down = true
+    nearest.replicas[2].latency = 2 * time.Millisecond
+    assert(t, reflect.DeepEqual(nearest.replicaOrder(), []int{2, 0, 1}),
+            "Replicas were not ordered by latency")
 }
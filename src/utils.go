@@ -6,6 +6,8 @@ import (
     "log"
     "math/rand"
     "os"
+    "reflect"
+    "sync"
     "time"
 )
 
@@ -73,8 +75,11 @@ func restoreStdLog() {
  *    RANDOMNESS UTILITIES     *
  *******************************/
 
-/* Source of randomness used by bayou package */
+/* Source of randomness used by bayou package, and the lock *
+ * guarding it (since rand.Rand is not safe for concurrent   *
+ * use, and servers and clients draw from it concurrently)   */
 var random *rand.Rand
+var randomLock = &sync.Mutex{}
 
 func init() {
     random = rand.New(rand.NewSource(time.Now().Unix()))
@@ -82,11 +87,15 @@ func init() {
 
 /* Returns a random integer */
 func randomInt() int {
+    randomLock.Lock()
+    defer randomLock.Unlock()
     return random.Int()
 }
 
 /* Returns a random integer less than max */
 func randomIntn(max int) int {
+    randomLock.Lock()
+    defer randomLock.Unlock()
     return random.Intn(max)
 }
 
@@ -130,13 +139,38 @@ func timesEqual(time1 time.Time, time2 time.Time) bool {
 func getLengthAtTime(log []LogEntry, targetTimestamp VectorClock) int {
     var searchIndex int
     for searchIndex = len(log) - 1; searchIndex >= 0; searchIndex-- {
-        if targetTimestamp.LessThan(log[searchIndex].Timestamp) {
+        if targetTimestamp.TotalCompare(log[searchIndex].Timestamp) >= 0 {
             break
         }
     }
     return searchIndex + 1
 }
 
+/* Returns the IDs of the writes in the log, in order */
+func writeIDs(log []LogEntry) []int {
+    ids := make([]int, len(log))
+    for idx, entry := range log {
+        ids[idx] = entry.WriteID
+    }
+    return ids
+}
+
+/* Returns (copies of) the writes in the log, and their undo entries, *
+ * whose accept stamps are not covered by the provided version vector *
+ * (all of them, if it is empty)                                      */
+func unseenWrites(log []LogEntry, undoLog []LogEntry,
+        clock VectorClock) ([]LogEntry, []LogEntry) {
+    unseen := make([]LogEntry, 0)
+    unseenUndo := make([]LogEntry, 0)
+    for idx, entry := range log {
+        if len(clock) == 0 || !clock.Dominates(entry.AcceptStamp) {
+            unseen = append(unseen, entry)
+            unseenUndo = append(unseenUndo, undoLog[idx])
+        }
+    }
+    return unseen, unseenUndo
+}
+
 func logToString(log []LogEntry) string {
     logStr := ""
     for _, entry := range log {
@@ -151,7 +185,12 @@ func entriesAreEqual(entry1 LogEntry, entry2 LogEntry, checkTime bool) bool {
     contentEqual := (entry1.WriteID == entry2.WriteID) &&
             (entry1.Query == entry2.Query) &&
             (entry1.Check == entry2.Check) &&
-            (entry1.Merge == entry2.Merge)
+            (entry1.Merge == entry2.Merge) &&
+            argsAreEqual(entry1.QueryArgs, entry2.QueryArgs) &&
+            argsAreEqual(entry1.CheckArgs, entry2.CheckArgs) &&
+            argsAreEqual(entry1.MergeArgs, entry2.MergeArgs) &&
+            (entry1.CheckProc == entry2.CheckProc) &&
+            (entry1.MergeProc == entry2.MergeProc)
     if checkTime && contentEqual {
         if len(entry1.Timestamp) != len(entry2.Timestamp) {
             return false
@@ -165,12 +204,48 @@ func entriesAreEqual(entry1 LogEntry, entry2 LogEntry, checkTime bool) bool {
     return contentEqual
 }
 
+/* Returns whether two query argument lists are equal *
+ * (an empty list equals a nil one, since gob does not *
+ * distinguish them)                                   */
+func argsAreEqual(args1 []interface{}, args2 []interface{}) bool {
+    if len(args1) != len(args2) {
+        return false
+    }
+    for idx, _ := range args1 {
+        time1, isTime := args1[idx].(time.Time)
+        if time2, ok := args2[idx].(time.Time); isTime && ok {
+            if !time1.Equal(time2) {
+                return false
+            }
+        } else if !reflect.DeepEqual(args1[idx], args2[idx]) {
+            return false
+        }
+    }
+    return true
+}
+
 func NewLogEntry(writeID int, vclock VectorClock, query string,
         check string, merge string) LogEntry {
-    // Make defensive copy of VectorClock
-    copyclock := NewVectorClock(len(vclock))
-    copy(copyclock, vclock)
-    return LogEntry{writeID, copyclock, query, check, merge}
+    // Make defensive copies of VectorClock
+    copyclock := vclock.Copy()
+    acceptStamp := vclock.Copy()
+    return LogEntry{writeID, copyclock, query, check, merge, nil, nil, nil,
+            UNCOMMITTED_CSN, acceptStamp, "", "", nil, nil, NO_ALTERNATE, "",
+            false, false, Membership{}, NO_MIGRATION, 0, HLCStamp{}}
+}
+
+/* Returns whether the entry is ordered before the other one in   *
+ * tentative logs: by the hybrid logical clock stamps the servers *
+ * accepting them took (so writes come after any write their      *
+ * server had seen, and otherwise in about the order they were    *
+ * accepted in), then by accept stamp. Every server orders        *
+ * tentative writes the same way, so their full views converge    */
+func (entry LogEntry) acceptedBefore(other LogEntry) bool {
+    order := entry.HLC.Compare(other.HLC)
+    if order == 0 {
+        order = entry.AcceptStamp.TotalCompare(other.AcceptStamp)
+    }
+    return order < 0
 }
 
 func (entry LogEntry) String() string {
@@ -178,51 +253,110 @@ func (entry LogEntry) String() string {
     if len(queryStr) > MAX_QUERY_CHARS {
         queryStr = queryStr[:MAX_QUERY_CHARS] + "..."
     }
-    return fmt.Sprintf("#%d: ", entry.WriteID) + "\n" +
-            entry.Timestamp.String() + "\n" + queryStr
+    csnStr := "Tentative"
+    if entry.CSN != UNCOMMITTED_CSN {
+        csnStr = fmt.Sprintf("CSN %d", entry.CSN)
+    }
+    return fmt.Sprintf("#%d (%s): ", entry.WriteID, csnStr) + "\n" +
+            entry.Timestamp.String() + "\t" + entry.HLC.String() + "\n" +
+            queryStr
 }
 
 /***************************
  *    CLIENT UTILITIES     *
  ***************************/
 
-/* Returns a query string that inserts a room   *
- * into the database wwith provided information */
-func getInsertQuery(room Room) string {
+/* Returns a query string that inserts a room into   *
+ * the database, and the arguments to bind to it     */
+func getInsertQuery(room Room) (string, []interface{}) {
     startTxt := room.StartTime.Format(TIME_FORMAT_STR)
     endTxt   := room.EndTime.Format(TIME_FORMAT_STR)
-    return fmt.Sprintf(`
+    return `
         INSERT OR REPLACE INTO rooms(
             Name,
             StartTime,
             EndTime
-        ) values("%s", dateTime("%s"), dateTime("%s"))
-    `, room.Name, startTxt, endTxt)
+        ) values(?, dateTime(?), dateTime(?))
+    `, []interface{}{room.Name, startTxt, endTxt}
 }
 
-/* Returns a query string that deletes  *
- * the specified room from the database */
-func getDeleteQuery(room Room) string {
+/* Returns a query string that deletes the specified *
+ * room from the database, and its arguments         */
+func getDeleteQuery(room Room) (string, []interface{}) {
     startTxt := room.StartTime.Format(TIME_FORMAT_STR)
     endTxt   := room.EndTime.Format(TIME_FORMAT_STR)
-    return fmt.Sprintf(`
+    return `
         DELETE FROM rooms
-        WHERE StartTime BETWEEN dateTime("%s") AND dateTime("%s")
-            AND Name == "%s"
-    `, startTxt, endTxt, room.Name)
+        WHERE StartTime BETWEEN dateTime(?) AND dateTime(?)
+            AND Name == ?
+    `, []interface{}{startTxt, endTxt, room.Name}
 }
 
-/* Returns a query string that retrieves *
- * the specified room from the database  */
-func getReadQuery(room Room) string {
+/* Returns a query string that claims the room,     *
+ * recording the provided owner, and its arguments  */
+func getClaimQuery(room Room, owner string) (string, []interface{}) {
     startTxt := room.StartTime.Format(TIME_FORMAT_STR)
     endTxt   := room.EndTime.Format(TIME_FORMAT_STR)
-    return fmt.Sprintf(`
+    return `
+        INSERT INTO rooms(
+            Name,
+            StartTime,
+            EndTime,
+            Owner
+        ) values(?, dateTime(?), dateTime(?), ?)
+    `, []interface{}{room.Name, startTxt, endTxt, owner}
+}
+
+/* Returns a query string that deletes all rooms claimed *
+ * by the provided owner, and its arguments              */
+func getUnclaimQuery(owner string) (string, []interface{}) {
+    return `
+        DELETE FROM rooms
+        WHERE Owner == ?
+    `, []interface{}{owner}
+}
+
+/* Returns a query string that returns whether no room is *
+ * claimed at the provided start time, and its arguments  */
+func getIsFreeQuery(startTime time.Time) (string, []interface{}) {
+    startTxt := startTime.Format(TIME_FORMAT_STR)
+    return `
+        SELECT CASE WHEN EXISTS (
+                SELECT *
+                FROM rooms
+                WHERE StartTime == dateTime(?)
+        )
+        THEN CAST(0 AS BIT)
+        ELSE CAST(1 AS BIT) END
+    `, []interface{}{startTxt}
+}
+
+/* Returns a query string that returns whether the provided  *
+ * room is not claimed at its start time, and its arguments  */
+func getIsRoomFreeQuery(room Room) (string, []interface{}) {
+    startTxt := room.StartTime.Format(TIME_FORMAT_STR)
+    return `
+        SELECT CASE WHEN EXISTS (
+                SELECT *
+                FROM rooms
+                WHERE StartTime == dateTime(?) AND Name == ?
+        )
+        THEN CAST(0 AS BIT)
+        ELSE CAST(1 AS BIT) END
+    `, []interface{}{startTxt, room.Name}
+}
+
+/* Returns a query string that retrieves the specified *
+ * room from the database, and its arguments           */
+func getReadQuery(room Room) (string, []interface{}) {
+    startTxt := room.StartTime.Format(TIME_FORMAT_STR)
+    endTxt   := room.EndTime.Format(TIME_FORMAT_STR)
+    return `
         SELECT Name, StartTime, EndTime
         FROM rooms
-        WHERE StartTime BETWEEN dateTime("%s") AND dateTime("%s")
-            AND Name == "%s"
-    `, startTxt, endTxt, room.Name)
+        WHERE StartTime BETWEEN dateTime(?) AND dateTime(?)
+            AND Name == ?
+    `, []interface{}{startTxt, endTxt, room.Name}
 }
 
 /* Returns a query string that retrieves all the rooms *
@@ -247,20 +381,6 @@ func getBoolQuery(value bool) string {
     return fmt.Sprintf("SELECT %d", bitValue)
 }
 
-/* Deserializes the result of a BayouDB read *
- * into a slice of client Room structs       */
-func deserializeRooms(rr ReadResult) []Room {
-    rooms := make([]Room, len(rr))
-    for i, rowData := range rr {
-        room := Room{}
-        room.Name = string(rowData["Name"].([]byte))
-        room.StartTime = rowData["StartTime"].(time.Time)
-        room.EndTime = rowData["EndTime"].(time.Time)
-        rooms[i] = room
-    }
-    return rooms
-}
-
 /* Returns whether two Rooms have identical content */
 func roomsAreEqual(room1 Room, room2 Room) bool {
     return (room1.Name == room2.Name) &&
@@ -3,24 +3,53 @@ package bayou
 import (
     "errors"
     "fmt"
+    "sort"
     "strings"
 )
 
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Orders of two vector clocks, as returned by Compare */
+const (
+    // Every logical time is less than or equal to the other's
+    // (and they are not equal): the clock happened before it
+    CLOCK_BEFORE ClockOrder = iota
+    // The other clock happened before this one
+    CLOCK_AFTER
+    // Every logical time is equal to the other's
+    CLOCK_EQUAL
+    // Some logical times are less than the other's, and some
+    // are greater: neither clock happened before the other
+    CLOCK_CONCURRENT
+)
+
 /************************
  *   TYPE DEFINITIONS   *
  ************************/
 
-/* Vector Clock: parallel array holding a monotonically *
- * increasing logical time (int) for each peer server   */
-type VectorClock []int
+/* Vector Clock: monotonically increasing logical time (int) *
+ * for each server, by server ID. Servers missing from a     *
+ * clock have a logical time of zero, and retired servers    *
+ * are dropped from clocks (see dropMembers)                 */
+type VectorClock map[int]int
+
+/* Order of two vector clocks */
+type ClockOrder int
 
 /****************************
  *   VECTOR CLOCK METHODS   *
  ****************************/
 
-/* Returns a new vector clock of the specified length */
+/* Returns a new vector clock with a zero logical time *
+ * for each of the specified number of servers         */
 func NewVectorClock(length int) VectorClock {
-    return make([]int, length)
+    vc := make(VectorClock, length)
+    for idx := 0; idx < length; idx++ {
+        vc[idx] = 0
+    }
+    return vc
 }
 
 /* Sets the logical time at idx to specified value        *
@@ -38,48 +67,172 @@ func (vc VectorClock) Inc(idx int) {
     vc[idx] = vc[idx] + 1
 }
 
-/* Returns whether this vector clock is *
- * strictly "less than" the other one   */
+/* Returns whether this vector clock is strictly "less   *
+ * than" the other one. Servers missing from a clock     *
+ * (that joined since it was created, or were dropped)   *
+ * are treated as having a logical time of zero          */
 func (vc VectorClock) LessThan(other VectorClock) bool {
-    if len(vc) != len(other) {
-        debugf("WARNING: Vector clocks of different lengths were compared:\n" +
-            "This: " + vc.String() + "\tOther: " + other.String())
-        return false
-    }
     // vc is less than other iff each logical time is less
     // than or equal to the other's logical time for each
     // peer, and at least one of those is strictly less than
-    strictly_less_seen := false
-    for idx, _ := range vc {
-        if !strictly_less_seen && vc[idx] < other[idx] {
-            strictly_less_seen = true
-        }
-        if (vc[idx] > other[idx]) {
+    return vc.Compare(other) == CLOCK_BEFORE
+}
+
+/* Returns whether each logical time of this vector clock is *
+ * greater than or equal to the other's. Servers missing     *
+ * from a clock are treated as a logical time of zero        */
+func (vc VectorClock) Dominates(other VectorClock) bool {
+    for idx, _ := range other {
+        if vc.timeAt(idx) < other[idx] {
             return false
         }
     }
-    return strictly_less_seen
+    return true
+}
+
+/* Returns how this vector clock is ordered relative to the other *
+ * one. Servers missing from a clock are treated as zero           */
+func (vc VectorClock) Compare(other VectorClock) ClockOrder {
+    less := false
+    greater := false
+    for _, idx := range vc.serverIDs(other) {
+        myTime := vc.timeAt(idx)
+        otherTime := other.timeAt(idx)
+        if myTime < otherTime {
+            less = true
+        } else if myTime > otherTime {
+            greater = true
+        }
+    }
+    switch {
+    case less && greater:
+        return CLOCK_CONCURRENT
+    case less:
+        return CLOCK_BEFORE
+    case greater:
+        return CLOCK_AFTER
+    }
+    return CLOCK_EQUAL
+}
+
+/* Returns whether each logical time of this vector clock is *
+ * equal to the other's. Servers missing from a clock are    *
+ * treated as a logical time of zero                         */
+func (vc VectorClock) Equal(other VectorClock) bool {
+    return vc.Compare(other) == CLOCK_EQUAL
+}
+
+/* Returns -1, 0 or 1 if this vector clock comes before, at the same *
+ * point as, or after the other in a total order of clocks: by the   *
+ * sum of their logical times, then by server ID (the clock ahead at *
+ * the lowest ID they differ at comes first). Clocks come before the *
+ * clocks they happened before, and concurrent clocks are ordered    *
+ * the same way by every server (0 is only returned for equal ones)  */
+func (vc VectorClock) TotalCompare(other VectorClock) int {
+    sum := vc.sum()
+    otherSum := other.sum()
+    if sum != otherSum {
+        if sum < otherSum {
+            return -1
+        }
+        return 1
+    }
+    for _, idx := range vc.serverIDs(other) {
+        if vc.timeAt(idx) > other.timeAt(idx) {
+            return -1
+        }
+        if vc.timeAt(idx) < other.timeAt(idx) {
+            return 1
+        }
+    }
+    return 0
+}
+
+/* Returns a copy of this vector clock, *
+ * which can be changed independently   */
+func (vc VectorClock) Copy() VectorClock {
+    copied := make(VectorClock, len(vc))
+    for idx, time := range vc {
+        copied[idx] = time
+    }
+    return copied
 }
 
-/* Sets all logical clocks to the max of  *
- * this and the other VC's logical clocks */
-func (vc VectorClock) Max(other VectorClock) {
-    if len(vc) != len(other) {
-        debugf("WARNING: Vector clocks of different lengths were maxed:\n" +
-            "This: " + vc.String() + "\tOther: " + other.String())
+/* Sets all logical clocks to the max of   *
+ * this and the other VC's logical clocks  *
+ * Grows this clock with the servers only  *
+ * the other has entries for               */
+func (vc *VectorClock) Max(other VectorClock) {
+    if *vc == nil {
+        *vc = NewVectorClock(0)
     }
     // Update logical clock if other one is higher,
-    // or append to vector clock if other one is longer
+    // or add it if this clock has no entry for the server
+    for idx, time := range other {
+        current, exists := (*vc)[idx]
+        if !exists || current < time {
+            (*vc)[idx] = time
+        }
+    }
+}
+
+/* Returns a copy of this vector clock without the entries of *
+ * the provided servers (or this clock, if it has none)       */
+func (vc VectorClock) without(serverIDs map[int]bool) VectorClock {
+    dropped := false
+    for idx, _ := range vc {
+        if serverIDs[idx] {
+            dropped = true
+        }
+    }
+    if !dropped {
+        return vc
+    }
+    kept := make(VectorClock, len(vc))
+    for idx, time := range vc {
+        if !serverIDs[idx] {
+            kept[idx] = time
+        }
+    }
+    return kept
+}
+
+/* Returns the sum of the clock's logical times, which is *
+ * greater for every clock this one is "less than"        */
+func (vc VectorClock) sum() int {
+    total := 0
+    for _, time := range vc {
+        total += time
+    }
+    return total
+}
+
+/* Returns the logical time at idx, or zero if the *
+ * clock has no entry for idx                      */
+func (vc VectorClock) timeAt(idx int) int {
+    return vc[idx]
+}
+
+/* Returns the IDs of the servers either this clock or *
+ * the other has an entry for, in increasing order     */
+func (vc VectorClock) serverIDs(other VectorClock) []int {
+    ids := make([]int, 0, len(vc) + len(other))
+    for idx, _ := range vc {
+        ids = append(ids, idx)
+    }
     for idx, _ := range other {
-        if idx >= len(vc) {
-            vc = append(vc, other[idx])
-        } else if vc[idx] < other[idx] {
-            vc[idx] = other[idx]
+        if _, exists := vc[idx]; !exists {
+            ids = append(ids, idx)
         }
     }
+    sort.Ints(ids)
+    return ids
 }
 
 func (vc VectorClock) String() string {
-    return "VC: " +  strings.Trim(strings.Replace(fmt.Sprint(([]int)(vc)),
-        " ", ", ", -1), "[]")
+    times := make([]string, 0, len(vc))
+    for _, idx := range vc.serverIDs(nil) {
+        times = append(times, fmt.Sprintf("%d: %d", idx, vc[idx]))
+    }
+    return "VC: " + strings.Join(times, ", ")
 }
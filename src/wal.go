@@ -0,0 +1,411 @@
+package bayou
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "io/ioutil"
+    "os"
+)
+
+/*****************
+ *   CONSTANTS   *
+ *****************/
+
+/* Default size (in bytes) after which a new WAL segment is started */
+const WAL_SEGMENT_SIZE int64 = 4 << 20
+
+/* Default number of WAL records after which the server state *
+ * is checkpointed, and the segments before it are deleted    */
+const WAL_CHECKPOINT_INTERVAL int = 1024
+
+/* Rollback length of WAL records that keep the tentative log */
+const NO_ROLLBACK int = -1
+
+/* Size (in bytes) of a WAL record's header: its *
+ * payload's length, followed by its checksum    */
+const WAL_HEADER_SIZE int = 8
+
+/* Modes for syncing WAL segments to stable storage. Only the  *
+ * default mode keeps every acknowledged write after a crash:  *
+ * the others trade the latest records for faster appends      */
+const (
+    // Sync after every record (the default)
+    WAL_SYNC_ALWAYS WALSyncMode = iota
+    // Sync when a segment is completed, or the WAL is closed
+    WAL_SYNC_SEGMENT
+    // Leave syncing to the operating system
+    WAL_SYNC_NEVER
+)
+
+/************************
+ *   TYPE DEFINITIONS   *
+ ************************/
+
+/* When WAL segments are synced to stable storage */
+type WALSyncMode int
+
+/* Change to a server's persistent state. Changes are replayed *
+ * in field order: the tentative (and undo) log is rolled back *
+ * first, and the state (if any) replaced last                 */
+type WALRecord struct {
+    // Length to truncate the tentative and undo logs to
+    // (NO_ROLLBACK if they are kept)
+    Rollback  int
+    // Number of commits truncated from the head of the commit log
+    Truncated int
+    // Entries appended to each log
+    Commits   []LogEntry
+    Tentative []LogEntry
+    Undo      []LogEntry
+    Errors    []LogEntry
+    // Server state besides its logs (nil if unchanged)
+    State     *PersistState
+}
+
+/* Server state kept besides its logs */
+type PersistState struct {
+    IsPrimary       bool
+    Omitted         []VectorClock
+    Acked           []VectorClock
+    OmitClock       VectorClock
+    OmitCSN         int
+    OmitAcceptClock VectorClock
+    Members         []Member
+    Epoch           Epoch
+    RecoveryCSN     int
+    Promised        Epoch
+}
+
+/* Append-only write-ahead log of changes to a server's state, split  *
+ * into numbered segments. Records are framed with their length and   *
+ * checksum, so a record torn by a crash is detected and ignored when *
+ * recovering. Segments before the latest checkpoint are deleted      */
+type WAL struct {
+    // Store the segments are saved in
+    store      *PersistStore
+    // When segments are synced to stable storage (weaker modes
+    // than WAL_SYNC_ALWAYS must be set explicitly)
+    SyncMode   WALSyncMode
+    // Size (in bytes) after which a new segment is started
+    SegmentSize int64
+    // Number of records after which the server is checkpointed
+    CheckpointInterval int
+
+    // Number, file, and size of the segment being appended to
+    segment    int
+    file       *os.File
+    size       int64
+    // Encoder of the current segment, which writes to buffer
+    // (so type information is only sent once per segment)
+    encoder    *gob.Encoder
+    buffer     bytes.Buffer
+    // Records appended since the latest checkpoint
+    numRecords int
+    // Error of the latest failed append or checkpoint (nil once a
+    // checkpoint succeeds): records appended after a failed one may
+    // not be replayed, so the server checkpoints instead meanwhile
+    err        error
+}
+
+/*******************
+ *   WAL METHODS   *
+ *******************/
+
+/* Returns a new (closed) WAL saved in the provided store */
+func NewWAL(store *PersistStore) *WAL {
+    wal := &WAL{}
+    wal.store = store
+    wal.SyncMode = WAL_SYNC_ALWAYS
+    wal.SegmentSize = WAL_SEGMENT_SIZE
+    wal.CheckpointInterval = WAL_CHECKPOINT_INTERVAL
+    wal.segment = 0
+    wal.file = nil
+    wal.numRecords = 0
+    return wal
+}
+
+/* Reads the records of all segments from the provided one on, *
+ * in order. Reading a segment stops at its first torn record  *
+ * Returns the number of the last segment found (or one less   *
+ * than the provided segment, if none were found), or an error *
+ * if a segment cannot be read, or holds an invalid record     */
+func (wal *WAL) Replay(fromSegment int,
+        apply func(WALRecord)) (int, error) {
+    lastSegment := fromSegment - 1
+    for _, segment := range wal.store.listSegments() {
+        if segment > lastSegment {
+            lastSegment = segment
+        }
+        if segment < fromSegment {
+            continue
+        }
+
+        data, err := ioutil.ReadFile(wal.store.segmentPath(segment))
+        if err != nil {
+            return lastSegment, errors.New("Error reading WAL segment: " +
+                    err.Error())
+        }
+        payloads := readFrames(data)
+        dec := gob.NewDecoder(&payloads)
+        for {
+            var record WALRecord
+            err = dec.Decode(&record)
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                return lastSegment, errors.New(fmt.Sprintf("Error " +
+                        "decoding record of WAL segment %d: %s", segment,
+                        err.Error()))
+            }
+            apply(record)
+        }
+    }
+    return lastSegment, nil
+}
+
+/* Starts appending to a new segment with the provided number *
+ * Returns an error (leaving the current segment open) if the *
+ * new segment cannot be created                              */
+func (wal *WAL) Open(segment int) error {
+    file, err := os.OpenFile(wal.store.segmentPath(segment),
+            os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+    if err == nil && wal.SyncMode != WAL_SYNC_NEVER {
+        err = wal.store.syncDir()
+        if err != nil {
+            file.Close()
+        }
+    }
+    if err != nil {
+        return errors.New("Error opening WAL segment: " + err.Error())
+    }
+    wal.segment = segment
+    wal.file = file
+    wal.size = 0
+    wal.buffer.Reset()
+    wal.encoder = gob.NewEncoder(&wal.buffer)
+    return nil
+}
+
+/* Appends a record to the current segment, starting a new *
+ * segment first if the current one is full. Records are   *
+ * dropped once the WAL is closed (i.e. its server killed) *
+ * Returns an error if the record could not be written (in *
+ * which case its frame may be torn)                       */
+func (wal *WAL) Append(record WALRecord) error {
+    if wal.file == nil {
+        return nil
+    }
+    if wal.size >= wal.SegmentSize {
+        err := wal.Rotate()
+        if err != nil {
+            return err
+        }
+    }
+
+    wal.buffer.Reset()
+    err := wal.encoder.Encode(record)
+    if err != nil {
+        return errors.New("Error encoding WAL record: " + err.Error())
+    }
+    payload := wal.buffer.Bytes()
+
+    frame := make([]byte, WAL_HEADER_SIZE + len(payload))
+    binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+    binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+    copy(frame[WAL_HEADER_SIZE:], payload)
+    _, err = wal.file.Write(frame)
+    if err == nil && wal.SyncMode == WAL_SYNC_ALWAYS {
+        err = wal.file.Sync()
+    }
+    if err != nil {
+        return errors.New("Error writing WAL record: " + err.Error())
+    }
+    wal.size += int64(len(frame))
+    wal.numRecords++
+    return nil
+}
+
+/* Starts a new segment, and completes the current one */
+func (wal *WAL) Rotate() error {
+    file := wal.file
+    err := wal.Open(wal.segment + 1)
+    if err != nil {
+        return err
+    }
+    return wal.closeSegment(file)
+}
+
+/* Deletes all segments before the provided one, returning *
+ * the error deleting one of them (if any)                 */
+func (wal *WAL) Compact(beforeSegment int) error {
+    var err error
+    for _, segment := range wal.store.listSegments() {
+        if segment < beforeSegment {
+            removeErr := os.Remove(wal.store.segmentPath(segment))
+            if removeErr != nil {
+                err = errors.New("Error deleting WAL segment: " +
+                        removeErr.Error())
+            }
+        }
+    }
+    return err
+}
+
+/* Completes the current segment (see closeSegment) */
+func (wal *WAL) Close() error {
+    if wal.file == nil {
+        return nil
+    }
+    err := wal.closeSegment(wal.file)
+    wal.file = nil
+    return err
+}
+
+/* Closes the provided segment file, syncing it unless *
+ * syncing is left to the operating system             */
+func (wal *WAL) closeSegment(file *os.File) error {
+    var err error
+    if wal.SyncMode != WAL_SYNC_NEVER {
+        err = file.Sync()
+    }
+    closeErr := file.Close()
+    if err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return errors.New("Error closing WAL segment: " + err.Error())
+    }
+    return nil
+}
+
+/* Returns the payloads of the provided segment data's records  *
+ * up to the first record that is incomplete or fails its       *
+ * checksum (which was torn by a crash while being written)     */
+func readFrames(data []byte) bytes.Buffer {
+    var payloads bytes.Buffer
+    for len(data) >= WAL_HEADER_SIZE {
+        length := int(binary.LittleEndian.Uint32(data[0:4]))
+        checksum := binary.LittleEndian.Uint32(data[4:8])
+        if len(data) < WAL_HEADER_SIZE + length {
+            break
+        }
+        payload := data[WAL_HEADER_SIZE:WAL_HEADER_SIZE + length]
+        if crc32.ChecksumIEEE(payload) != checksum {
+            break
+        }
+        payloads.Write(payload)
+        data = data[WAL_HEADER_SIZE + length:]
+    }
+    return payloads
+}
+
+/***************************
+ *   SERVER WAL METHODS    *
+ ***************************/
+
+/* Appends a record of a change to this server's state to its   *
+ * WAL, checkpointing the server once enough records were added  *
+ * (or instead, if an earlier record could not be written, since *
+ * the records after it may not be replayed). Returns an error   *
+ * if the change could not be persisted                          */
+func (server *BayouServer) persist(record WALRecord) error {
+    if server.wal.err != nil {
+        return server.checkpoint()
+    }
+    err := server.wal.Append(record)
+    if err != nil {
+        debugf("Server #%d failed to persist a change: %s", server.id,
+                err.Error())
+        server.wal.err = err
+        return err
+    }
+    if server.wal.numRecords >= server.wal.CheckpointInterval {
+        return server.checkpoint()
+    }
+    return nil
+}
+
+/* Returns this server's state besides its logs, to be recorded */
+func (server *BayouServer) persistState() *PersistState {
+    return &PersistState{server.IsPrimary, server.Omitted, server.acked,
+            server.omitClock, server.omitCSN, server.omitAcceptClock,
+            server.members, server.epoch, server.recoveryCSN,
+            server.promised}
+}
+
+/* Saves all of this server's state in a checkpoint, starting a *
+ * new segment first so all earlier segments can be deleted     *
+ * Returns an error if the checkpoint could not be saved        */
+func (server *BayouServer) checkpoint() error {
+    if server.wal.file == nil {
+        return nil
+    }
+    err := server.wal.Rotate()
+    if err == nil {
+        err = server.savePersist()
+    }
+    if err != nil {
+        debugf("Server #%d failed to checkpoint: %s", server.id,
+                err.Error())
+        server.wal.err = err
+        return err
+    }
+    server.wal.err = nil
+    server.wal.numRecords = 0
+
+    // Segments left behind are skipped when replaying
+    err = server.wal.Compact(server.wal.segment)
+    if err != nil {
+        debugf("Server #%d failed to compact its WAL: %s", server.id,
+                err.Error())
+    }
+    return nil
+}
+
+/* Returns the error the RPC handlers reply when the changes they *
+ * made may not have been persisted (nil if they were)            */
+func (server *BayouServer) persistError() error {
+    if server.wal.err == nil {
+        return nil
+    }
+    return errors.New(fmt.Sprintf("Server #%d failed to persist its " +
+            "changes: %s", server.id, server.wal.err.Error()))
+}
+
+/* Applies a WAL record to this server's logs and state */
+func (server *BayouServer) replayRecord(record WALRecord) {
+    if record.Rollback != NO_ROLLBACK {
+        server.TentativeLog = server.TentativeLog[:record.Rollback]
+        server.UndoLog = server.UndoLog[:record.Rollback]
+    }
+    if record.Truncated > 0 {
+        remaining := make([]LogEntry, len(server.CommitLog) -
+                record.Truncated)
+        copy(remaining, server.CommitLog[record.Truncated:])
+        server.CommitLog = remaining
+    }
+    server.CommitLog = append(server.CommitLog, record.Commits...)
+    server.TentativeLog = append(server.TentativeLog, record.Tentative...)
+    server.UndoLog = append(server.UndoLog, record.Undo...)
+    server.ErrorLog = append(server.ErrorLog, record.Errors...)
+
+    if record.State != nil {
+        state := record.State
+        server.IsPrimary = state.IsPrimary
+        server.Omitted = state.Omitted
+        server.acked = state.Acked
+        server.omitClock = state.OmitClock
+        server.omitCSN = state.OmitCSN
+        server.omitAcceptClock = state.OmitAcceptClock
+        server.members = state.Members
+        server.epoch = state.Epoch
+        server.recoveryCSN = state.RecoveryCSN
+        server.promised = state.Promised
+    }
+}